@@ -0,0 +1,65 @@
+package client
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// EncodeBatch writes the values as the single text line. Every value is prefixed with its length
+// and a line break, the result is compressed with gzip and encoded with base64.
+func EncodeBatch(w io.Writer, values []string) error {
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	compressor := gzip.NewWriter(encoder)
+	for _, v := range values {
+		if _, err := fmt.Fprintf(compressor, "%d\n%s", len(v), v); err != nil {
+			return err
+		}
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// DecodeBatch returns the values of the line written by EncodeBatch.
+func DecodeBatch(line string) ([]string, error) {
+	decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.TrimRight(line, "\r\n")))
+	decompressor, err := gzip.NewReader(decoder)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+	reader := bufio.NewReader(decompressor)
+	var values []string
+	for {
+		header, err := reader.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(header, "\n"))
+		if err != nil || size < 0 {
+			return nil, ErrInvalidResponse
+		}
+		v := make([]byte, size)
+		if _, err := io.ReadFull(reader, v); err != nil {
+			return nil, ErrInvalidResponse
+		}
+		values = append(values, string(v))
+	}
+}
+
+// Batch returns the values of the PULL GZIP line.
+func (r *Response) Batch() ([]string, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return DecodeBatch(r.Message)
+}
@@ -12,23 +12,209 @@ import (
 )
 
 const (
-	CmdPush     = "PUSH"
-	CmdPull     = "PULL"
-	CmdGet      = "GET"
-	CmdStatus   = "STATUS"
-	CmdPrepare  = "PREPARE"
-	CmdPromise  = "PROMISE"
-	CmdRefuse   = "REFUSE"
-	CmdAccept   = "ACCEPT"
-	CmdAccepted = "ACCEPTED"
-	CmdSet      = "SET"
-	CmdOK       = "OK"
+	CmdPush      = "PUSH"
+	CmdPull      = "PULL"
+	CmdGet       = "GET"
+	CmdStatus    = "STATUS"
+	CmdPrepare   = "PREPARE"
+	CmdPromise   = "PROMISE"
+	CmdReject    = "REJECT"
+	CmdRefuse    = "REFUSE"
+	CmdAccept    = "ACCEPT"
+	CmdAccepted  = "ACCEPTED"
+	CmdSet       = "SET"
+	CmdOK        = "OK"
+	CmdCasFailed = "CAS_FAILED"
+	// CmdKeepalive is pushed to the idle PULL and WATCH subscribers, it is not a value.
+	CmdKeepalive   = "KEEPALIVE"
+	CmdDelete      = "DELETE"
+	CmdLen         = "LEN"
+	CmdPeek        = "PEEK"
+	CmdPing        = "PING"
+	CmdPong        = "PONG"
+	CmdPushBatch   = "PUSHBATCH"
+	CmdRange       = "RANGE"
+	CmdDump        = "DUMP"
+	CmdErr         = "ERR"
+	CmdRedirect    = "REDIRECT"
+	CmdCommit      = "COMMIT"
+	CmdTruncate    = "TRUNCATE"
+	CmdWatch       = "WATCH"
+	CmdFirst       = "FIRST"
+	CmdLast        = "LAST"
+	CmdCommitted   = "COMMITTED"
+	CmdUse         = "USE"
+	CmdDrain       = "DRAIN"
+	CmdUndrain     = "UNDRAIN"
+	CmdGetByID     = "GETBYID"
+	CmdMget        = "MGET"
+	CmdHeartbeat   = "HEARTBEAT"
+	CmdSnapshot    = "SNAPSHOT"
+	CmdHello       = "HELLO"
+	CmdCas         = "CAS"
+	CmdFlush       = "FLUSH"
+	CmdBatch       = "BATCH"
+	CmdSubscribers = "SUBSCRIBERS"
+	CmdRetention   = "RETENTION"
+	CmdDeleteRange = "DELRANGE"
+	CmdBumpN       = "BUMPN"
+	CmdInspect     = "INSPECT"
+	CmdUnsupported = "UNSUPPORTED" // answers the forward-compatible command unknown to the node
+	CmdDegraded    = "DEGRADED"    // answers HEALTH of the node which can not reach the quorum
+	CmdExport      = "EXPORT"
+	CmdHealth      = "HEALTH"
+	CmdStepDown    = "STEPDOWN"
+	CmdReplay      = "REPLAY"
+	CmdWindow      = "WINDOW"
+	CmdCompact     = "COMPACT"
+	// CmdSubscribeFilter is PULL forwarding the matching values only, see SubscribeFilter.
+	CmdSubscribeFilter = "SUBF"
+	CmdConfig          = "CONFIG"
+	// CmdPartial precedes the error of PUSHBATCH the log has failed midway, see Response.Partial.
+	CmdPartial = "PARTIAL"
+	// CmdSubscription is the first line of PULL with the ID keyword.
+	CmdSubscription = "SUBSCRIPTION"
+	CmdUnsubscribe  = "UNSUB"
+	CmdSwap         = "SWAP"
+	CmdCountIf      = "COUNTIF"
+)
+
+const (
+	CodeUnknownCmd      = "unknown_cmd"
+	CodeIncorrectCmd    = "incorrect_cmd"
+	CodeOutOfRange      = "out_of_range"
+	CodeInternalError   = "internal_error"
+	CodeTimeout         = "timeout"
+	CodeCanceled        = "canceled"
+	CodeShuttingDown    = "shutting_down"
+	CodeUnauthorized    = "unauthorized"
+	CodeMessageTooLarge = "message_too_large"
+	CodeQuorumFailed    = "quorum_failed"
+	CodeRateLimited     = "rate_limited"
+	CodeEmptyLog        = "empty_log"
+	CodeMissingValue    = "missing_value"
+	CodeReadOnly        = "read_only"
+	CodeValueTooLarge   = "value_too_large"
+	CodeNotFound        = "not_found"
+	CodeOverflow        = "overflow"
+	CodeIdleTimeout     = "idle_timeout"
+	CodeAborted         = "aborted"
+	CodeCorruptEntry    = "corrupt_entry"
+	// CodeTooManySubscribers rejects PULL and WATCH of the node serving the maximum of the subscribers.
+	CodeTooManySubscribers = "too_many_subscribers"
+	CodeInvalidEncoding    = "invalid_encoding"
 )
 
 const (
 	MetaKeyName = "name"
 )
 
+// Keys of the STATUS response.
+const (
+	StatusLen         = "len"
+	StatusProposal    = "proposal"
+	StatusLeader      = "leader"
+	StatusSubscribers = "subscribers"
+	StatusDrained     = "drained"
+	// StatusRole is "voter" or "replica" for the read replica.
+	StatusRole = "role"
+	// The keys of the verbose STATUS only.
+	StatusPeers         = "peers"
+	StatusCommitted     = "committed"
+	StatusLeaderAddress = "leader_address"
+)
+
+// Keys of the CONFIG response.
+const (
+	ConfigMaxMessageSize = "max_message_size"
+	ConfigMaxValueSize   = "max_value_size"
+	ConfigMaxSubscribers = "max_subscribers"
+	ConfigIdleTimeout    = "idle_timeout"
+	ConfigCommitAttempts = "commit_attempts"
+	ConfigSlowPolicy     = "slow_policy"
+	// ConfigRateLimit is followed by the category, e.g. rate_limit_write=10/20 is the rate and the burst.
+	ConfigRateLimit         = "rate_limit_"
+	ConfigLogRedaction      = "log_redaction"
+	ConfigPanicRecovery     = "panic_recovery"
+	ConfigNamedStreams      = "named_streams"
+	ConfigCodec             = "codec"
+	ConfigChecksums         = "checksums"
+	ConfigPaxosDedup        = "paxos_dedup"
+	ConfigDeadLetter        = "dead_letter"
+	ConfigReadReplica       = "read_replica"
+	ConfigUTF8Validation    = "utf8_validation"
+	ConfigForwardCompatible = "forward_compatible"
+	ConfigSnapshotPath      = "snapshot_path"
+	// ConfigRedacted replaces the value which is not exposed.
+	ConfigRedacted = "redacted"
+	// ConfigOff is the value of the disabled limit.
+	ConfigOff = "off"
+)
+
+const (
+	// PullFollow makes PULL skip the existing values and stream only the new ones.
+	PullFollow = "FOLLOW"
+	// PullID makes PULL push "SUBSCRIPTION <id>" first, the ID is sent with UNSUB.
+	PullID = "ID"
+	// PullGzip makes PULL send the values in the compressed batches, see Response.Batch.
+	PullGzip = "GZIP"
+	// PullDrop and PullCoalesce override the node policy for the slow reader, see Pull.Policy.
+	PullDrop     = "DROP"
+	PullCoalesce = "COALESCE"
+	// timeoutSuffix limits the command duration, see WithTimeout.
+	timeoutSuffix = "timeout="
+	// MgetMissing is the MGET line for the missing index.
+	MgetMissing = "$nil"
+	// GetLinearizable makes GET wait until the local log catches up with the quorum.
+	GetLinearizable = "LINEARIZABLE"
+	// ExportNDJSON and ExportCSV are the formats of EXPORT.
+	ExportNDJSON = "NDJSON"
+	ExportCSV    = "CSV"
+	// GetDefault precedes the value GET pushes for the missing index instead of failing.
+	GetDefault = "DEFAULT"
+	// PushDedup marks the PUSH response for the idempotency key seen before.
+	PushDedup = "DEDUP"
+	// PushDurable makes PUSH acknowledge the value after syncing the log.
+	PushDurable = "DURABLE"
+	// PushBlock makes PUSH wait for the room in the log full up to the retention count.
+	PushBlock = "BLOCK"
+	// FilterPrefix, FilterSuffix and FilterContains select the SUBF filter.
+	FilterPrefix   = "PREFIX"
+	FilterSuffix   = "SUFFIX"
+	FilterContains = "CONTAINS"
+	// BatchAtomic makes BATCH skip the commands after the failed one.
+	BatchAtomic = "ATOMIC"
+	// RetentionCount and RetentionAge are the kinds of the RETENTION limit.
+	RetentionCount = "COUNT"
+	RetentionAge   = "AGE"
+	// StatusBrief and StatusVerbose choose the detail of STATUS, the brief one is the default.
+	StatusBrief   = "BRIEF"
+	StatusVerbose = "VERBOSE"
+	// StatusLatency asks STATUS for the command latencies, StatusReset clears them after.
+	StatusLatency = "LATENCY"
+	StatusReset   = "RESET"
+)
+
+// HELLO response keys.
+const (
+	HelloVersion      = "version"
+	HelloCapabilities = "capabilities"
+)
+
+// Capabilities listed in the HELLO response.
+const (
+	CapJSON     = "json"
+	CapGzip     = "gzip"
+	CapBatch    = "batch"
+	CapFollow   = "follow"
+	CapTimeout  = "timeout"
+	CapTrace    = "trace"
+	CapCoalesce = "coalesce"
+	CapSnapshot = "snapshot"
+	CapStreams  = "streams"
+	CapAliases  = "aliases"
+)
+
 var (
 	ErrInvalidResponse = errors.New("invalid response")
 )
@@ -85,17 +271,31 @@ func (c *Connection) Close() error {
 	return c.connection.Close()
 }
 
+// closeWrite tells the node the request is the last one of the connection, the node closes
+// the connection after the response. The connection serves several requests otherwise.
+func (c *Connection) closeWrite() error {
+	if conn, ok := c.connection.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
 type Request interface {
 	String() string
 }
 
 func (c *Connection) write(message string) error {
+	// Meta belongs to the header line, the payload is sent after it as is.
+	header, payload := message, ""
+	if i := strings.Index(message, payloadSeparator); i != -1 {
+		header, payload = message[:i], message[i+len(payloadSeparator):]
+	}
 	msgparts := make([]string, 0, len(c.Client.Meta)+1)
-	msgparts = append(msgparts, message)
+	msgparts = append(msgparts, header)
 	for key, value := range c.Client.Meta {
 		msgparts = append(msgparts, fmt.Sprintf("%s=%s", key, value))
 	}
-	_, err := fmt.Fprint(c.connection, strings.Join(msgparts, ";")+"\n")
+	_, err := fmt.Fprint(c.connection, strings.Join(msgparts, ";")+payloadSeparator+payload)
 	return err
 }
 
@@ -112,7 +312,7 @@ func (c *Connection) QueryOne(r Request) (*Response, error) {
 	if err := c.write(message); err != nil {
 		return nil, err
 	}
-	nodeResponse, err := bufio.NewReader(c.connection).ReadString('\n')
+	nodeResponse, err := readMessage(bufio.NewReader(c.connection))
 	if err != nil {
 		return nil, err
 	}
@@ -151,6 +351,9 @@ func (c *Connection) QueryMany(r Request) (*Responses, error) {
 	if err := c.write(message); err != nil {
 		return nil, err
 	}
+	if err := c.closeWrite(); err != nil {
+		return nil, err
+	}
 	responses := &Responses{
 		responses: make(chan *Response),
 		errors:    make(chan error),
@@ -158,8 +361,9 @@ func (c *Connection) QueryMany(r Request) (*Responses, error) {
 	go func() {
 		defer close(responses.responses)
 		defer close(responses.errors)
+		reader := bufio.NewReader(c.connection)
 		for {
-			nodeResponse, err := bufio.NewReader(c.connection).ReadString('\n')
+			nodeResponse, err := readMessage(reader)
 			if err == io.EOF {
 				break
 			}
@@ -234,12 +438,101 @@ func (r *Response) Cmd() (string, string) {
 	return cmd, args
 }
 
+// payloadSeparator separates the header line from the length-prefixed payload.
+const payloadSeparator = "\r\n"
+
+// withValue appends the value to the command. Values with line breaks are sent as
+// a length-prefixed payload after the header line, other ones are quoted if needed.
+func withValue(header, v string) string {
+	if strings.ContainsAny(v, "\r\n") {
+		return fmt.Sprintf("%s $%d%s%s", header, len(v), payloadSeparator, v)
+	}
+	return header + " " + quote(v)
+}
+
+// quote wraps the value in double quotes if it is empty, contains spaces, tabs, quotes or backslashes,
+// starts with $ which is reserved for the payload length or looks like the timeout suffix.
+func quote(v string) string {
+	if !strings.ContainsAny(v, " \t\"\\") && v != "" && !strings.HasPrefix(v, "$") &&
+		!strings.HasPrefix(strings.ToLower(v), timeoutSuffix) {
+		return v
+	}
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return `"` + v + `"`
+}
+
+// Error is the failure reported by the node.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Err returns *Error if the response is an error frame, nil otherwise.
+func (r *Response) Err() error {
+	cmd, args := r.Cmd()
+	if cmd != CmdErr {
+		return nil
+	}
+	parsed := strings.SplitN(args, " ", 2)
+	nodeErr := &Error{Code: parsed[0]}
+	if len(parsed) == 2 {
+		nodeErr.Message = parsed[1]
+	}
+	return nodeErr
+}
+
+// Redirect returns the leader address if the node redirects the write to it.
+func (r *Response) Redirect() (string, bool) {
+	cmd, args := r.Cmd()
+	if cmd != CmdRedirect || args == "" {
+		return "", false
+	}
+	return args, true
+}
+
+// Unsupported returns the command the node does not know if it answers with UNSUPPORTED, the client
+// may fall back to the older commands then.
+func (r *Response) Unsupported() (string, bool) {
+	cmd, args := r.Cmd()
+	if cmd != CmdUnsupported || args == "" {
+		return "", false
+	}
+	return args, true
+}
+
 type Push struct {
 	V string
+	// Key is the optional idempotency key, a retried PUSH with the same key is not appended again.
+	// The keyed value is sent quoted, so it must not contain line breaks.
+	Key string
+	// Durable makes the node sync the log before the acknowledgment. The durable value is sent
+	// quoted as well.
+	Durable bool
+	// Block makes the single node wait until the log full up to the retention count has room for the
+	// value instead of dropping the oldest one, it is not combined with the Key.
+	Block bool
 }
 
 func (p *Push) String() string {
-	return fmt.Sprintf("%s %s", CmdPush, p.V)
+	message := withValue(CmdPush, p.V)
+	if p.Key != "" || p.Durable || p.Block {
+		message = CmdPush + " " + quote(p.V)
+	}
+	if p.Key != "" {
+		message += " " + quote(p.Key)
+	}
+	if p.Durable {
+		message += " " + PushDurable
+	}
+	if p.Block {
+		message += " " + PushBlock
+	}
+	return message
 }
 
 func (r *Response) Ok() (bool, error) {
@@ -251,20 +544,114 @@ func (r *Response) Ok() (bool, error) {
 	return cmd == CmdOK, nil
 }
 
+type PushBatch struct {
+	V []string
+}
+
+func (p *PushBatch) String() string {
+	parts := make([]string, 0, len(p.V)+2)
+	parts = append(parts, CmdPushBatch, strconv.Itoa(len(p.V)))
+	for _, v := range p.V {
+		parts = append(parts, quote(v))
+	}
+	return strings.Join(parts, " ")
+}
+
 type Get struct {
-	N int
+	N            int
+	Linearizable bool
+	// Default is pushed for the missing index, nil fails GET.
+	Default *string
 }
 
 func (p *Get) String() string {
-	return fmt.Sprintf("%s %d", CmdGet, p.N)
+	header := fmt.Sprintf("%s %d", CmdGet, p.N)
+	if p.Linearizable {
+		header += " " + GetLinearizable
+	}
+	if p.Default != nil {
+		return withValue(header+" "+GetDefault, *p.Default)
+	}
+	return header
+}
+
+type Range struct {
+	From int
+	To   int
+}
+
+func (r *Range) String() string {
+	return fmt.Sprintf("%s %d %d", CmdRange, r.From, r.To)
 }
 
 type Pull struct {
 	N int
+	// Buffer is the number of values the node queues for the slow reader, zero means the node default.
+	Buffer int
+	Follow bool
+	Gzip   bool
+	// Policy is PullDrop to disconnect the slow reader with the overflow error or PullCoalesce
+	// to skip the values it has not kept up with. Empty means the node default.
+	Policy string
+	// Window is the number of the values the node pushes before it waits for the credit added with
+	// the Window command, zero means no flow control. The first line of the subscription is then
+	// the one read by Response.WindowID.
+	Window int
+	// ID makes the node push the line read by Response.SubscriptionID first.
+	ID bool
 }
 
 func (p *Pull) String() string {
-	return fmt.Sprintf("%s %d", CmdPull, p.N)
+	message := fmt.Sprintf("%s %d", CmdPull, p.N)
+	if p.Buffer > 0 {
+		message += " " + strconv.Itoa(p.Buffer)
+	}
+	if p.Follow {
+		message += " " + PullFollow
+	}
+	if p.ID {
+		message += " " + PullID
+	}
+	if p.Gzip {
+		message += " " + PullGzip
+	}
+	if p.Policy != "" {
+		message += " " + p.Policy
+	}
+	if p.Window > 0 {
+		message += fmt.Sprintf(" %s %d", CmdWindow, p.Window)
+	}
+	return message
+}
+
+// SubscribeFilter is PULL pushing only the values matching the pattern with the Filter, FilterPrefix
+// if it is empty.
+type SubscribeFilter struct {
+	N       int
+	Filter  string
+	Pattern string
+}
+
+func (s *SubscribeFilter) String() string {
+	message := fmt.Sprintf("%s %d", CmdSubscribeFilter, s.N)
+	if s.Filter != "" {
+		message += " " + s.Filter
+	}
+	return message + " " + quote(s.Pattern)
+}
+
+// CountIf counts the values matching the pattern with the Filter like SubscribeFilter.
+type CountIf struct {
+	Filter  string
+	Pattern string
+}
+
+func (c *CountIf) String() string {
+	message := CmdCountIf
+	if c.Filter != "" {
+		message += " " + c.Filter
+	}
+	return message + " " + quote(c.Pattern)
 }
 
 type Prepare struct {
@@ -275,6 +662,8 @@ func (p *Prepare) String() string {
 	return fmt.Sprintf("%s %d", CmdPrepare, p.N)
 }
 
+// Promise is the answer to PREPARE. For the promise with Previous set N, ID and V describe the value
+// accepted earlier. For the rejection N is the proposal already promised by the node.
 type Promise struct {
 	Promise  bool
 	Previous bool
@@ -285,7 +674,7 @@ type Promise struct {
 
 func (r *Response) Promise() (*Promise, error) {
 	cmd, args := r.Cmd()
-	if cmd != CmdPromise && cmd != CmdRefuse {
+	if cmd != CmdPromise && cmd != CmdReject && cmd != CmdRefuse {
 		return nil, ErrInvalidResponse
 	}
 
@@ -293,15 +682,25 @@ func (r *Response) Promise() (*Promise, error) {
 		Promise: cmd == CmdPromise,
 	}
 
-	splitArgs := strings.Split(args, " ")
-	if len(splitArgs) == 3 {
-		previousN, err := strconv.Atoi(splitArgs[0])
+	if cmd == CmdReject {
+		promisedN, err := strconv.Atoi(args)
+		if err != nil {
+			return nil, err
+		}
+		promise.N = promisedN
+		return promise, nil
+	}
+
+	// The value goes last and may contain spaces.
+	splitArgs := r.fields(4)
+	if len(splitArgs) == 4 {
+		previousN, err := strconv.Atoi(splitArgs[1])
 		if err != nil {
 			return nil, err
 		}
 		promise.N = previousN
-		promise.ID = splitArgs[1]
-		promise.V = splitArgs[2]
+		promise.ID = splitArgs[2]
+		promise.V = splitArgs[3]
 		promise.Previous = true
 	}
 	return promise, nil
@@ -314,22 +713,32 @@ type Accept struct {
 }
 
 func (a *Accept) String() string {
-	return fmt.Sprintf("%s %d %s %s", CmdAccept, a.N, a.ID, a.V)
+	return withValue(fmt.Sprintf("%s %d %s", CmdAccept, a.N, a.ID), a.V)
 }
 
+// Accepted is the answer to ACCEPT. For the rejection N is the proposal promised by the node,
+// it is zero for the REFUSE of the older nodes.
 type Accepted struct {
 	Accepted bool
+	N        int
 }
 
 func (r *Response) Accepted() (*Accepted, error) {
-	cmd, _ := r.Cmd()
-	if cmd != CmdAccepted && cmd != CmdRefuse {
+	cmd, args := r.Cmd()
+	if cmd != CmdAccepted && cmd != CmdReject && cmd != CmdRefuse {
 		return nil, ErrInvalidResponse
 	}
 
 	accepted := &Accepted{
 		Accepted: cmd == CmdAccepted,
 	}
+	if cmd == CmdReject {
+		promisedN, err := strconv.Atoi(args)
+		if err != nil {
+			return nil, err
+		}
+		accepted.N = promisedN
+	}
 
 	return accepted, nil
 }
@@ -341,5 +750,508 @@ type Set struct {
 }
 
 func (s *Set) String() string {
-	return fmt.Sprintf("%s %d %s %s", CmdSet, s.N, s.ID, s.V)
+	return withValue(fmt.Sprintf("%s %d %s", CmdSet, s.N, s.ID), s.V)
+}
+
+type Delete struct {
+	N int
+}
+
+func (d *Delete) String() string {
+	return fmt.Sprintf("%s %d", CmdDelete, d.N)
+}
+
+// DeleteRange removes the values with the indexes in [From, To).
+type DeleteRange struct {
+	From int
+	To   int
+}
+
+func (d *DeleteRange) String() string {
+	return fmt.Sprintf("%s %d %d", CmdDeleteRange, d.From, d.To)
+}
+
+// Compact reclaims the slots of the values removed from the node log.
+type Compact struct{}
+
+func (c *Compact) String() string {
+	return CmdCompact
+}
+
+type Len struct{}
+
+func (l *Len) String() string {
+	return CmdLen
+}
+
+type Peek struct {
+	K int
+}
+
+func (p *Peek) String() string {
+	return fmt.Sprintf("%s %d", CmdPeek, p.K)
+}
+
+type Ping struct{}
+
+func (p *Ping) String() string {
+	return CmdPing
+}
+
+type StepDown struct {
+	Target string
+}
+
+func (s *StepDown) String() string {
+	return CmdStepDown + " " + quote(s.Target)
+}
+
+type Replay struct {
+	// At is the time of the first value, it is sent in milliseconds.
+	At time.Time
+}
+
+func (r *Replay) String() string {
+	return fmt.Sprintf("%s %d", CmdReplay, r.At.UnixNano()/int64(time.Millisecond))
+}
+
+// Window adds K values to the credit of the PULL subscription ID.
+type Window struct {
+	ID uint64
+	K  int
+}
+
+func (w *Window) String() string {
+	return fmt.Sprintf("%s %d %d", CmdWindow, w.ID, w.K)
+}
+
+// WindowID returns the ID of the subscription from the first line pushed to the PULL with the window.
+func (r *Response) WindowID() (uint64, error) {
+	if err := r.Err(); err != nil {
+		return 0, err
+	}
+	var id uint64
+	if _, err := fmt.Sscanf(r.Message, CmdWindow+" %d", &id); err != nil {
+		return 0, ErrInvalidResponse
+	}
+	return id, nil
+}
+
+// Config lists the effective options of the node as key=value lines, see the Config keys.
+type Config struct{}
+
+func (c *Config) String() string {
+	return CmdConfig
+}
+
+// Partial returns the number of the values PUSHBATCH has written before the error which follows the line.
+func (r *Response) Partial() (int, bool) {
+	cmd, args := r.Cmd()
+	if cmd != CmdPartial {
+		return 0, false
+	}
+	written, err := strconv.Atoi(args)
+	if err != nil {
+		return 0, false
+	}
+	return written, true
+}
+
+// Unsubscribe ends the PULL subscription ID.
+type Unsubscribe struct {
+	ID uint64
+}
+
+func (u *Unsubscribe) String() string {
+	return fmt.Sprintf("%s %d", CmdUnsubscribe, u.ID)
+}
+
+// SubscriptionID returns the ID of the subscription from the first line pushed to the PULL with ID.
+func (r *Response) SubscriptionID() (uint64, error) {
+	if err := r.Err(); err != nil {
+		return 0, err
+	}
+	var id uint64
+	if _, err := fmt.Sscanf(r.Message, CmdSubscription+" %d", &id); err != nil {
+		return 0, ErrInvalidResponse
+	}
+	return id, nil
+}
+
+type Health struct{}
+
+func (h *Health) String() string {
+	return CmdHealth
+}
+
+// Healthy reports whether the node answers HEALTH with OK, otherwise it returns the reason of DEGRADED.
+func (r *Response) Healthy() (bool, string, error) {
+	cmd, args := r.Cmd()
+	switch cmd {
+	case CmdOK:
+		return true, "", nil
+	case CmdDegraded:
+		return false, args, nil
+	}
+	if err := r.Err(); err != nil {
+		return false, "", err
+	}
+	return false, "", ErrInvalidResponse
+}
+
+type Dump struct{}
+
+func (d *Dump) String() string {
+	return CmdDump
+}
+
+type Status struct {
+	Verbose bool
+	// Latency asks for the command latencies, Reset clears them after the response.
+	Latency bool
+	Reset   bool
+}
+
+func (s *Status) String() string {
+	switch {
+	case s.Latency && s.Reset:
+		return CmdStatus + " " + StatusLatency + " " + StatusReset
+	case s.Latency:
+		return CmdStatus + " " + StatusLatency
+	case s.Verbose:
+		return CmdStatus + " " + StatusVerbose
+	}
+	return CmdStatus
+}
+
+// Status parses one key=value line of the STATUS response.
+func (r *Response) Status() (string, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(r.Message), "=", 2)
+	if len(parts) != 2 {
+		return "", "", ErrInvalidResponse
+	}
+	return parts[0], parts[1], nil
+}
+
+// BumpN makes the next proposals of the node greater than N.
+type BumpN struct {
+	N int
+}
+
+func (b *BumpN) String() string {
+	return fmt.Sprintf("%s %d", CmdBumpN, b.N)
+}
+
+type Commit struct {
+	V string
+}
+
+func (c *Commit) String() string {
+	return withValue(CmdCommit, c.V)
+}
+
+type Truncate struct {
+	KeepLast int
+}
+
+func (t *Truncate) String() string {
+	return fmt.Sprintf("%s %d", CmdTruncate, t.KeepLast)
+}
+
+// Retention sets the retention policy of the node log, the Age in seconds takes precedence over the Count.
+type Retention struct {
+	Count int
+	Age   time.Duration
+}
+
+func (r *Retention) String() string {
+	if r.Age > 0 {
+		return fmt.Sprintf("%s %s %d", CmdRetention, RetentionAge, int(r.Age/time.Second))
+	}
+	return fmt.Sprintf("%s %s %d", CmdRetention, RetentionCount, r.Count)
+}
+
+type Watch struct {
+	N int
+}
+
+func (w *Watch) String() string {
+	return fmt.Sprintf("%s %d", CmdWatch, w.N)
+}
+
+type First struct{}
+
+func (f *First) String() string {
+	return CmdFirst
+}
+
+type Last struct{}
+
+func (l *Last) String() string {
+	return CmdLast
+}
+
+// Entry is the answer to FIRST and LAST.
+type Entry struct {
+	N int
+	V string
+}
+
+func (r *Response) Entry() (*Entry, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	parts := r.fields(2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidResponse
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{N: n, V: parts[1]}, nil
+}
+
+type Committed struct{}
+
+func (c *Committed) String() string {
+	return CmdCommitted
+}
+
+// Use selects the stream for the following commands of the connection, empty Stream resets it.
+type Use struct {
+	Stream string
+}
+
+func (u *Use) String() string {
+	if u.Stream == "" {
+		return CmdUse
+	}
+	return CmdUse + " " + quote(u.Stream)
+}
+
+type Drain struct{}
+
+func (d *Drain) String() string {
+	return CmdDrain
+}
+
+type Undrain struct{}
+
+func (u *Undrain) String() string {
+	return CmdUndrain
+}
+
+type GetByID struct {
+	ID string
+}
+
+func (g *GetByID) String() string {
+	return CmdGetByID + " " + quote(g.ID)
+}
+
+type Inspect struct {
+	N int
+}
+
+func (i *Inspect) String() string {
+	return fmt.Sprintf("%s %d", CmdInspect, i.N)
+}
+
+type Export struct {
+	// Format is ExportNDJSON or ExportCSV, empty means the node default NDJSON.
+	Format string
+}
+
+func (e *Export) String() string {
+	if e.Format == "" {
+		return CmdExport
+	}
+	return CmdExport + " " + e.Format
+}
+
+type Mget struct {
+	N []int
+}
+
+func (m *Mget) String() string {
+	parts := make([]string, 0, len(m.N)+1)
+	parts = append(parts, CmdMget)
+	for _, n := range m.N {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, " ")
+}
+
+// MgetValue returns the value of the MGET line, false means the missing index.
+func (r *Response) MgetValue() (string, bool) {
+	if strings.TrimRight(r.Message, "\r\n") == MgetMissing {
+		return "", false
+	}
+	return value(r.Message), true
+}
+
+// Heartbeat renews the lease of the leader, it is sent between the nodes.
+type Heartbeat struct {
+	N int
+}
+
+func (h *Heartbeat) String() string {
+	return fmt.Sprintf("%s %d", CmdHeartbeat, h.N)
+}
+
+// WithTimeout appends the suffix limiting the duration of the command on the node to the message.
+func WithTimeout(message string, timeout time.Duration) string {
+	suffix := fmt.Sprintf(" %s%d", timeoutSuffix, timeout.Milliseconds())
+	if i := strings.Index(message, payloadSeparator); i != -1 {
+		return message[:i] + suffix + message[i:]
+	}
+	return message + suffix
+}
+
+// Snapshot makes the node write its log to the configured file.
+type Snapshot struct{}
+
+func (s *Snapshot) String() string {
+	return CmdSnapshot
+}
+
+// Hello asks the node for its version and capabilities.
+type Hello struct{}
+
+func (h *Hello) String() string {
+	return CmdHello
+}
+
+// ServerInfo is the parsed HELLO response.
+type ServerInfo struct {
+	Version      string
+	Capabilities []string
+}
+
+// Supports reports whether the node has the capability.
+func (i *ServerInfo) Supports(capability string) bool {
+	for _, c := range i.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHello parses the key=value lines of the HELLO response, the unknown keys are skipped.
+func ParseHello(lines []string) (*ServerInfo, error) {
+	info := &ServerInfo{}
+	for _, line := range lines {
+		key, value, err := (&Response{Message: line}).Status()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case HelloVersion:
+			info.Version = value
+		case HelloCapabilities:
+			info.Capabilities = nil
+			if value != "" {
+				info.Capabilities = strings.Split(value, ",")
+			}
+		}
+	}
+	if info.Version == "" {
+		return nil, ErrInvalidResponse
+	}
+	return info, nil
+}
+
+// Swap exchanges the values with the indexes I and J.
+type Swap struct {
+	I, J int
+}
+
+func (s *Swap) String() string {
+	return fmt.Sprintf("%s %d %d", CmdSwap, s.I, s.J)
+}
+
+// Cas replaces the value with the epoch N if it equals Expected. Expected must not contain line breaks.
+type Cas struct {
+	N        int
+	Expected string
+	New      string
+}
+
+func (c *Cas) String() string {
+	return withValue(fmt.Sprintf("%s %d %s", CmdCas, c.N, quote(c.Expected)), c.New)
+}
+
+// CasFailed parses the CAS response: it returns the actual value and true for the mismatch.
+func (r *Response) CasFailed() (string, bool) {
+	if !strings.HasPrefix(r.Message, CmdCasFailed+" ") {
+		return "", false
+	}
+	return value(strings.TrimPrefix(r.Message, CmdCasFailed+" ")), true
+}
+
+// Flush makes the node sync its log.
+type Flush struct{}
+
+func (f *Flush) String() string {
+	return CmdFlush
+}
+
+// Batch executes the single-line commands in one message, see ParseBatch. Atomic skips
+// the commands after the failed one.
+type Batch struct {
+	Commands []string
+	Atomic   bool
+}
+
+func (b *Batch) String() string {
+	header := fmt.Sprintf("%s %d", CmdBatch, len(b.Commands))
+	if b.Atomic {
+		header += " " + BatchAtomic
+	}
+	return withValue(header, strings.Join(b.Commands, "\n"))
+}
+
+// ParseBatch splits the BATCH response into the responses of the commands. Every response
+// is the "BATCH <i> <k>" line followed by k lines of the command i.
+func ParseBatch(lines []string) ([][]string, error) {
+	var results [][]string
+	for len(lines) > 0 {
+		var i, k int
+		if _, err := fmt.Sscanf(lines[0], CmdBatch+" %d %d", &i, &k); err != nil {
+			return nil, ErrInvalidResponse
+		}
+		if i != len(results) || k < 0 || k > len(lines)-1 {
+			return nil, ErrInvalidResponse
+		}
+		results = append(results, lines[1:1+k])
+		lines = lines[1+k:]
+	}
+	return results, nil
+}
+
+// Subscribers lists the live PULL requests of the node.
+type Subscribers struct{}
+
+func (s *Subscribers) String() string {
+	return CmdSubscribers
+}
+
+// Subscriber is the line of the SUBSCRIBERS response.
+type Subscriber struct {
+	Address string
+	From    int
+	Behind  int
+}
+
+func (r *Response) Subscriber() (*Subscriber, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	subscriber := &Subscriber{}
+	if _, err := fmt.Sscanf(r.Message, "%s %d %d", &subscriber.Address, &subscriber.From, &subscriber.Behind); err != nil {
+		return nil, ErrInvalidResponse
+	}
+	return subscriber, nil
 }
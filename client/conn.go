@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+)
+
+// Transport sends the message to the node and returns the response lines.
+// The channel is closed when the node ends the response or ctx is done.
+type Transport func(ctx context.Context, message string) (<-chan string, error)
+
+// NewTCPTransport sends every message over a new TCP connection of the client.
+func NewTCPTransport(c *Client) Transport {
+	return func(ctx context.Context, message string) (<-chan string, error) {
+		connection, err := c.Connect()
+		if err != nil {
+			return nil, err
+		}
+		err = connection.write(message)
+		if err == nil {
+			err = connection.closeWrite()
+		}
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		c.Logger.Println("this -> ", c.Address, message)
+
+		lines := make(chan string)
+		stop := make(chan struct{})
+		go func() {
+			// Closing the connection interrupts the blocked read.
+			select {
+			case <-ctx.Done():
+			case <-stop:
+			}
+			connection.Close()
+		}()
+		go func() {
+			defer close(lines)
+			defer close(stop)
+			reader := bufio.NewReader(connection.connection)
+			for {
+				line, err := readMessage(reader)
+				if err != nil {
+					return
+				}
+				c.Logger.Println("this <- ", c.Address, line)
+				select {
+				case lines <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return lines, nil
+	}
+}
+
+// RedirectError is returned when the write must be sent to the leader.
+type RedirectError struct {
+	Addr string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("redirect to %s", e.Addr)
+}
+
+// Conn is the typed client of the stream protocol.
+type Conn struct {
+	transport Transport
+}
+
+func NewConn(transport Transport) *Conn {
+	return &Conn{transport: transport}
+}
+
+// Dial creates Conn using TCP transport to the address.
+func Dial(address string, timeout *time.Duration) (*Conn, error) {
+	c, err := New(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(NewTCPTransport(c)), nil
+}
+
+// query sends the request and returns all response lines. Error frames are returned as *Error.
+func (c *Conn) query(ctx context.Context, r Request) ([]string, error) {
+	lines, err := c.transport(ctx, r.String())
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	for line := range lines {
+		if err := (&Response{Message: line}).Err(); err != nil {
+			return nil, err
+		}
+		results = append(results, line)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (c *Conn) Push(ctx context.Context, v string) error {
+	lines, err := c.query(ctx, &Push{V: v})
+	if err != nil {
+		return err
+	}
+	if len(lines) != 1 {
+		return ErrInvalidResponse
+	}
+	response := &Response{Message: lines[0]}
+	if addr, ok := response.Redirect(); ok {
+		return &RedirectError{Addr: addr}
+	}
+	ok, err := response.Ok()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+// Get returns the value with the epoch n. It returns ErrNotFound if there is no such value.
+func (c *Conn) Get(ctx context.Context, n int) (string, error) {
+	lines, err := c.query(ctx, &Range{From: n, To: n + 1})
+	if err != nil {
+		return "", err
+	}
+	if len(lines) == 0 {
+		return "", ErrNotFound
+	}
+	return (&Response{Message: lines[0]}).Value(), nil
+}
+
+// Pull streams the values starting from the epoch n until ctx is done. The keepalives are skipped,
+// the channel is closed after the error frame ending the subscription.
+func (c *Conn) Pull(ctx context.Context, n int) (<-chan string, error) {
+	lines, err := c.transport(ctx, (&Pull{N: n}).String())
+	if err != nil {
+		return nil, err
+	}
+	values := make(chan string)
+	go func() {
+		defer close(values)
+		for line := range lines {
+			if line == CmdKeepalive {
+				continue
+			}
+			if isControl(line) {
+				// Drain the lines until the node ends the response.
+				for range lines {
+				}
+				return
+			}
+			select {
+			case values <- (&Response{Message: line}).Value():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return values, nil
+}
+
+func (c *Conn) Len(ctx context.Context) (int, error) {
+	lines, err := c.query(ctx, &Len{})
+	if err != nil {
+		return 0, err
+	}
+	if len(lines) != 1 {
+		return 0, ErrInvalidResponse
+	}
+	return strconv.Atoi(lines[0])
+}
+
+// Hello returns the version and the capabilities of the node.
+func (c *Conn) Hello(ctx context.Context) (*ServerInfo, error) {
+	lines, err := c.query(ctx, &Hello{})
+	if err != nil {
+		return nil, err
+	}
+	return ParseHello(lines)
+}
@@ -0,0 +1,244 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+	storage "github.com/tariel-x/stream/log"
+	"github.com/tariel-x/stream/stream"
+)
+
+type request struct {
+	message string
+}
+
+func (r *request) Message() string {
+	return r.message
+}
+
+func (r *request) Address() string {
+	return "localhost:7000"
+}
+
+func (r *request) Name() string {
+	return r.Address()
+}
+
+type response struct {
+	ctx   context.Context
+	lines chan string
+}
+
+func (r *response) Push(message string) {
+	select {
+	case r.lines <- message:
+	case <-r.ctx.Done():
+	}
+}
+
+type acceptMessage struct {
+	n int
+	v string
+}
+
+func (am *acceptMessage) N() int {
+	return am.n
+}
+
+func (am *acceptMessage) ID() string {
+	return am.v
+}
+
+func (am *acceptMessage) V() string {
+	return am.v
+}
+
+// paxos commits every value immediately with the next N.
+type paxos struct {
+	n int
+}
+
+func (p *paxos) Commit(ctx context.Context, v, id string) ([]stream.AcceptMessage, error) {
+	msg := &acceptMessage{n: p.n, v: v}
+	p.n++
+	return []stream.AcceptMessage{msg}, nil
+}
+
+func (p *paxos) Prepare(n int, proposer string) (bool, stream.AcceptMessage) {
+	return true, nil
+}
+
+func (p *paxos) ReadIndex(ctx context.Context) (int, error) {
+	return p.n - 1, nil
+}
+
+func (p *paxos) Accept(n int, v, id string) (bool, int) {
+	return true, p.n
+}
+
+func (p *paxos) Set(n int, id string) {}
+
+func (p *paxos) Lease(leader string, n int) bool {
+	return true
+}
+
+func (p *paxos) CommittedIndex() int {
+	return p.n - 1
+}
+
+func (p *paxos) SetMinN(n int) {}
+
+func (p *paxos) TransferLeadership(target string) error {
+	return nil
+}
+
+func (p *paxos) QuorumReachable() (bool, string) {
+	return true, ""
+}
+
+func (p *paxos) State() stream.PaxosState {
+	return stream.PaxosState{N: p.n}
+}
+
+func (p *paxos) Leader() (string, bool) {
+	return "", true
+}
+
+// handlerTransport passes messages directly to the handler.
+func handlerTransport(h *stream.Handler) client.Transport {
+	return func(ctx context.Context, message string) (<-chan string, error) {
+		resp := &response{ctx: ctx, lines: make(chan string)}
+		go func() {
+			defer close(resp.lines)
+			h.Process(ctx, &request{message: message}, resp)
+		}()
+		return resp.lines, nil
+	}
+}
+
+func newConn(t *testing.T) *client.Conn {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(lg, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.NewConn(handlerTransport(h))
+}
+
+func TestConn_RoundTrip(t *testing.T) {
+	conn := newConn(t)
+	ctx := context.Background()
+	for _, v := range []string{"a", "b c", "d\ne"} {
+		if err := conn.Push(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	length, err := conn.Len(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 3 {
+		t.Errorf("expected 3, got %d", length)
+	}
+
+	v, err := conn.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "b c" {
+		t.Errorf("expected %q, got %q", "b c", v)
+	}
+	if v, err := conn.Get(ctx, 2); err != nil || v != "d\ne" {
+		t.Errorf("expected %q, got %q %v", "d\ne", v, err)
+	}
+	if _, err := conn.Get(ctx, 10); err != client.ErrNotFound {
+		t.Errorf("expected %s, got %v", client.ErrNotFound, err)
+	}
+}
+
+func TestConn_Pull(t *testing.T) {
+	conn := newConn(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, v := range []string{"a", "b"} {
+		if err := conn.Push(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := conn.Pull(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "b"} {
+		if v := <-results; v != expected {
+			t.Errorf("expected %s, got %s", expected, v)
+		}
+	}
+	if err := conn.Push(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-results; v != "c" {
+		t.Errorf("expected c, got %s", v)
+	}
+}
+
+func TestConn_PullControlLines(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, _ := stream.NewHandler(lg, &paxos{}, stream.WithIdleTimeout(20*time.Millisecond))
+	conn := client.NewConn(handlerTransport(h))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Push(ctx, client.CmdKeepalive); err != nil {
+		t.Fatal(err)
+	}
+	results, err := conn.Pull(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stored value is delivered, the keepalive and the idle_timeout error frame are not.
+	var values []string
+	for v := range results {
+		values = append(values, v)
+	}
+	if len(values) != 1 || values[0] != client.CmdKeepalive {
+		t.Errorf("unexpected %q", values)
+	}
+	if ctx.Err() != nil {
+		t.Error("the error frame must close the channel")
+	}
+}
+
+func TestResponse_FramedValue(t *testing.T) {
+	framed := client.FrameValue("a $1\r\n")
+	promise, err := (&client.Response{Message: client.CmdPromise + " 3 id " + framed}).Promise()
+	if err != nil || !promise.Previous || promise.N != 3 || promise.ID != "id" || promise.V != "a $1\r\n" {
+		t.Errorf("unexpected %+v %v", promise, err)
+	}
+	entry, err := (&client.Response{Message: "4 " + framed}).Entry()
+	if err != nil || entry.N != 4 || entry.V != "a $1\r\n" {
+		t.Errorf("unexpected %+v %v", entry, err)
+	}
+	if v, ok := (&client.Response{Message: client.FrameValue(client.MgetMissing)}).MgetValue(); !ok || v != client.MgetMissing {
+		t.Errorf("the value equal to the marker must be found, got %q %t", v, ok)
+	}
+	if v := (&client.Response{Message: "plain\n"}).Value(); v != "plain" {
+		t.Errorf("unexpected %q", v)
+	}
+}
+
+func TestConn_Hello(t *testing.T) {
+	info, err := newConn(t).Hello(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != stream.Version || !info.Supports(client.CapJSON) || info.Supports("unknown") {
+		t.Errorf("unexpected %+v", info)
+	}
+}
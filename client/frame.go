@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FrameValue returns the value as the last field of the response line. The value containing line
+// breaks or $ is sent as "$<len>\r\n<bytes>" like the length-prefixed payload of the request,
+// so is the value looking like the KEEPALIVE or ERR line of the subscription. Other values are sent as is.
+func FrameValue(v string) string {
+	if !strings.ContainsAny(v, "\r\n$") && !isControl(v) {
+		return v
+	}
+	return fmt.Sprintf("$%d%s%s", len(v), payloadSeparator, v)
+}
+
+// isControl reports whether the line is the KEEPALIVE or ERR one the node pushes between the values.
+func isControl(line string) bool {
+	return line == CmdKeepalive || line == CmdErr || strings.HasPrefix(line, CmdErr+" ")
+}
+
+// value returns the last field of the response line written by FrameValue. The line ending of
+// the value sent as is is trimmed.
+func value(field string) string {
+	if !strings.HasPrefix(field, "$") {
+		return strings.TrimRight(field, "\r\n")
+	}
+	i := strings.Index(field, payloadSeparator)
+	if i == -1 {
+		return strings.TrimRight(field, "\r\n")
+	}
+	size, err := strconv.Atoi(field[1:i])
+	start := i + len(payloadSeparator)
+	if err != nil || size < 0 || start+size > len(field) {
+		return strings.TrimRight(field, "\r\n")
+	}
+	return field[start : start+size]
+}
+
+// fields splits the response line into up to n fields, the last one is the value.
+func (r *Response) fields(n int) []string {
+	parts := strings.SplitN(r.Message, " ", n)
+	parts[len(parts)-1] = value(parts[len(parts)-1])
+	return parts
+}
+
+// framedSize returns the length of the framed value following the line. The error frames are never
+// followed by the value.
+func framedSize(line string) (int, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, CmdErr+" ") {
+		return 0, false
+	}
+	i := strings.LastIndex(line, " ") + 1
+	if i >= len(line) || line[i] != '$' {
+		return 0, false
+	}
+	size, err := strconv.Atoi(line[i+1:])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// readMessage reads the response line together with its framed value, the line ending is trimmed.
+func readMessage(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return line, err
+	}
+	header := strings.TrimRight(line, "\r\n")
+	size, ok := framedSize(header)
+	if !ok {
+		return header, nil
+	}
+	// The value is followed by the line break of the response line.
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", err
+	}
+	return header + payloadSeparator + string(payload[:size]), nil
+}
+
+// Unframe returns the response line with the framed value replaced by the value itself, it is
+// meant for the responses which are not sent as lines.
+func Unframe(message string) string {
+	i := strings.Index(message, payloadSeparator)
+	if i == -1 {
+		return message
+	}
+	if _, ok := framedSize(message[:i]); !ok {
+		return message
+	}
+	j := strings.LastIndex(message[:i], " ") + 1
+	return message[:j] + value(message[j:])
+}
+
+// Value returns the value of the response line pushed for the value, such as the GET, RANGE or PULL one.
+func (r *Response) Value() string {
+	return value(r.Message)
+}
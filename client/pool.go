@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// DialFunc creates the Conn to the node address.
+type DialFunc func(address string) (*Conn, error)
+
+// Pool spreads the commands over the Conns of the nodes round-robin. The Conn failed to deliver
+// the command is replaced with the new one and the command is sent with the next Conn. The writes
+// redirected by the followers are sent to the leader, which is used for the writes since then.
+type Pool struct {
+	dial DialFunc
+
+	m      sync.Mutex
+	conns  []*pooled
+	next   int
+	leader string
+}
+
+type pooled struct {
+	address string
+	conn    *Conn
+}
+
+// NewPool creates size Conns for every address with the dial, nil dial means Dial with the default timeout.
+func NewPool(addresses []string, size int, dial DialFunc) (*Pool, error) {
+	if len(addresses) == 0 || size < 1 {
+		return nil, errors.New("empty pool")
+	}
+	if dial == nil {
+		dial = func(address string) (*Conn, error) {
+			return Dial(address, nil)
+		}
+	}
+	p := &Pool{dial: dial}
+	for i := 0; i < size; i++ {
+		for _, address := range addresses {
+			conn, err := dial(address)
+			if err != nil {
+				return nil, err
+			}
+			p.conns = append(p.conns, &pooled{address: address, conn: conn})
+		}
+	}
+	return p, nil
+}
+
+// pick returns the slot of the next Conn.
+func (p *Pool) pick() *pooled {
+	p.m.Lock()
+	defer p.m.Unlock()
+	slot := p.conns[p.next%len(p.conns)]
+	p.next++
+	return slot
+}
+
+// writer returns the slot of the known leader or the next one.
+func (p *Pool) writer() *pooled {
+	p.m.Lock()
+	leader := p.leader
+	p.m.Unlock()
+	if leader == "" {
+		return p.pick()
+	}
+	for range p.conns {
+		if slot := p.pick(); slot.address == leader {
+			return slot
+		}
+	}
+	if conn := p.connTo(leader); conn != nil {
+		return &pooled{address: leader, conn: conn}
+	}
+	return p.pick()
+}
+
+// connTo returns the Conn of the pool to the address or dials the new one, nil for the failed dial.
+func (p *Pool) connTo(address string) *Conn {
+	p.m.Lock()
+	for _, slot := range p.conns {
+		if slot.address == address {
+			p.m.Unlock()
+			return slot.conn
+		}
+	}
+	p.m.Unlock()
+	conn, err := p.dial(address)
+	if err != nil {
+		return nil
+	}
+	return conn
+}
+
+// reconnect replaces the failed Conn of the slot, the slot keeps the failed Conn if the dial fails.
+func (p *Pool) reconnect(slot *pooled, failed *Conn) {
+	conn, err := p.dial(slot.address)
+	if err != nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if slot.conn == failed {
+		slot.conn = conn
+	}
+}
+
+// delivered reports whether the command has reached the node, the node errors and the ctx one
+// are not retried with another Conn.
+func delivered(ctx context.Context, err error) bool {
+	var nodeErr *Error
+	var redirect *RedirectError
+	return err == nil || ctx.Err() != nil || errors.As(err, &nodeErr) || errors.As(err, &redirect) ||
+		errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidResponse)
+}
+
+// do runs fn with the Conns starting from the slot until it reaches the node or every Conn fails.
+func (p *Pool) do(ctx context.Context, slot *pooled, fn func(*Conn) error) error {
+	var err error
+	for attempt := 0; attempt < len(p.conns); attempt++ {
+		p.m.Lock()
+		conn := slot.conn
+		p.m.Unlock()
+		if err = fn(conn); delivered(ctx, err) {
+			return err
+		}
+		p.reconnect(slot, conn)
+		slot = p.pick()
+	}
+	return err
+}
+
+// Push sends the value to the leader if it is known. The redirected write is sent once more to the leader.
+func (p *Pool) Push(ctx context.Context, v string) error {
+	push := func(conn *Conn) error {
+		return conn.Push(ctx, v)
+	}
+	err := p.do(ctx, p.writer(), push)
+	var redirect *RedirectError
+	if !errors.As(err, &redirect) {
+		return err
+	}
+	conn := p.connTo(redirect.Addr)
+	if conn == nil {
+		return err
+	}
+	if err := conn.Push(ctx, v); err != nil {
+		return err
+	}
+	p.m.Lock()
+	p.leader = redirect.Addr
+	p.m.Unlock()
+	return nil
+}
+
+func (p *Pool) Get(ctx context.Context, n int) (string, error) {
+	var v string
+	err := p.do(ctx, p.pick(), func(conn *Conn) error {
+		var err error
+		v, err = conn.Get(ctx, n)
+		return err
+	})
+	return v, err
+}
+
+// Pull subscribes with the next Conn, the failed subscription is not moved to another one.
+func (p *Pool) Pull(ctx context.Context, n int) (<-chan string, error) {
+	var values <-chan string
+	err := p.do(ctx, p.pick(), func(conn *Conn) error {
+		var err error
+		values, err = conn.Pull(ctx, n)
+		return err
+	})
+	return values, err
+}
+
+func (p *Pool) Len(ctx context.Context) (int, error) {
+	var length int
+	err := p.do(ctx, p.pick(), func(conn *Conn) error {
+		var err error
+		length, err = conn.Len(ctx)
+		return err
+	})
+	return length, err
+}
+
+func (p *Pool) Hello(ctx context.Context) (*ServerInfo, error) {
+	var info *ServerInfo
+	err := p.do(ctx, p.pick(), func(conn *Conn) error {
+		var err error
+		info, err = conn.Hello(ctx)
+		return err
+	})
+	return info, err
+}
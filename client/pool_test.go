@@ -0,0 +1,142 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tariel-x/stream/client"
+	storage "github.com/tariel-x/stream/log"
+	"github.com/tariel-x/stream/stream"
+)
+
+// nodes are the transports of the fake cluster sharing one handler. The down nodes fail to connect,
+// the followers redirect the pushes to the leader.
+type nodes struct {
+	transport client.Transport
+	leader    string
+
+	m        sync.Mutex
+	down     map[string]bool
+	dials    map[string]int
+	messages map[string]int
+}
+
+func newNodes(t *testing.T, leader string) *nodes {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(lg, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &nodes{
+		transport: handlerTransport(h),
+		leader:    leader,
+		down:      map[string]bool{},
+		dials:     map[string]int{},
+		messages:  map[string]int{},
+	}
+}
+
+func (n *nodes) dial(address string) (*client.Conn, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.dials[address]++
+	return client.NewConn(func(ctx context.Context, message string) (<-chan string, error) {
+		n.m.Lock()
+		down := n.down[address]
+		n.messages[address]++
+		n.m.Unlock()
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		if n.leader != "" && address != n.leader && strings.HasPrefix(message, client.CmdPush) {
+			lines := make(chan string, 1)
+			lines <- client.CmdRedirect + " " + n.leader
+			close(lines)
+			return lines, nil
+		}
+		return n.transport(ctx, message)
+	}), nil
+}
+
+func (n *nodes) count(counts map[string]int, address string) int {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return counts[address]
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	cluster := newNodes(t, "")
+	pool, err := client.NewPool([]string{"a", "b"}, 2, cluster.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		if err := pool.Push(ctx, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The Conns are reused, every one gets its share.
+	for _, address := range []string{"a", "b"} {
+		if dials := cluster.count(cluster.dials, address); dials != 2 {
+			t.Errorf("%s: %d dials, want 2", address, dials)
+		}
+		if messages := cluster.count(cluster.messages, address); messages != 4 {
+			t.Errorf("%s: %d messages, want 4", address, messages)
+		}
+	}
+}
+
+func TestPool_Failover(t *testing.T) {
+	cluster := newNodes(t, "")
+	pool, err := client.NewPool([]string{"a", "b"}, 1, cluster.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.down["a"] = true
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if err := pool.Push(ctx, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if length, err := pool.Len(ctx); err != nil || length != 4 {
+		t.Errorf("unexpected length %d %v", length, err)
+	}
+	// The failed Conn has been replaced.
+	if dials := cluster.count(cluster.dials, "a"); dials < 2 {
+		t.Errorf("the failed Conn is not reconnected, %d dials", dials)
+	}
+
+	// The node errors are not retried.
+	if _, err := pool.Get(ctx, 10); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected %s, got %v", client.ErrNotFound, err)
+	}
+}
+
+func TestPool_Redirect(t *testing.T) {
+	cluster := newNodes(t, "b")
+	pool, err := client.NewPool([]string{"a", "b"}, 1, cluster.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := pool.Push(ctx, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if length, err := pool.Len(ctx); err != nil || length != 3 {
+		t.Errorf("unexpected length %d %v", length, err)
+	}
+	// Only the first push has been redirected, the rest have been sent to the leader.
+	if messages := cluster.count(cluster.messages, "a"); messages > 2 {
+		t.Errorf("the follower got %d messages", messages)
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Placeholder is the argument of the Prepared template bound on every call.
+const Placeholder = "?"
+
+// ErrBind is returned by Prepared.Bind for the wrong number of the values or the value which
+// can not be sent in its place.
+var ErrBind = errors.New("invalid binding")
+
+// preparedArity is the minimum and the maximum number of the arguments of the commands which may
+// be prepared.
+var preparedArity = map[string][2]int{
+	CmdPush:    {1, 3},
+	CmdCommit:  {1, 1},
+	CmdGet:     {1, 4},
+	CmdGetByID: {1, 1},
+	CmdSet:     {3, 3},
+	CmdAccept:  {3, 3},
+	CmdCas:     {3, 3},
+	CmdDelete:  {1, 1},
+	CmdWatch:   {1, 1},
+	CmdPeek:    {1, 1},
+}
+
+// Prepared is the command template validated once and bound to the values on every call, it saves
+// the formatting of the command issued many times. The last argument may be bound to the value with
+// line breaks, it is sent as the length-prefixed payload like the Push one.
+type Prepared struct {
+	// parts are the fixed parts of the message around the placeholders.
+	parts []string
+	size  int
+	// payload reports whether the last argument is the placeholder.
+	payload bool
+}
+
+// NewPrepared validates the command and the number of its arguments, the Placeholder arguments are
+// bound by Bind and the others are sent as is.
+func NewPrepared(cmd string, args ...string) (*Prepared, error) {
+	arity, ok := preparedArity[cmd]
+	if !ok {
+		return nil, fmt.Errorf("%s can not be prepared", cmd)
+	}
+	if len(args) < arity[0] || len(args) > arity[1] {
+		return nil, fmt.Errorf("%s takes from %d to %d arguments, got %d", cmd, arity[0], arity[1], len(args))
+	}
+	p := &Prepared{}
+	fixed := cmd
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return nil, fmt.Errorf("%w: only the bound value may have line breaks", ErrBind)
+		}
+		if arg != Placeholder {
+			fixed += " " + quote(arg)
+			continue
+		}
+		p.parts = append(p.parts, fixed+" ")
+		fixed = ""
+	}
+	p.parts = append(p.parts, fixed)
+	for _, part := range p.parts {
+		p.size += len(part)
+	}
+	p.payload = args[len(args)-1] == Placeholder
+	return p, nil
+}
+
+// Bind returns the command with the placeholders replaced with the values in order.
+func (p *Prepared) Bind(vs ...string) (Request, error) {
+	if len(vs) != len(p.parts)-1 {
+		return nil, fmt.Errorf("%w: %d values for %d placeholders", ErrBind, len(vs), len(p.parts)-1)
+	}
+	size := p.size
+	for _, v := range vs {
+		// The quotes and the escapes are rare, they grow the builder once.
+		size += len(v) + 2
+	}
+	var b strings.Builder
+	b.Grow(size)
+	for i, v := range vs {
+		b.WriteString(p.parts[i])
+		if !strings.ContainsAny(v, "\r\n") {
+			b.WriteString(quote(v))
+			continue
+		}
+		if !p.payload || i != len(vs)-1 {
+			return nil, fmt.Errorf("%w: only the last value may have line breaks", ErrBind)
+		}
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(len(v)))
+		b.WriteString(payloadSeparator)
+		b.WriteString(v)
+	}
+	b.WriteString(p.parts[len(p.parts)-1])
+	return bound(b.String()), nil
+}
+
+// bound is the message of the Prepared command.
+type bound string
+
+func (b bound) String() string {
+	return string(b)
+}
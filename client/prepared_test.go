@@ -0,0 +1,70 @@
+package client_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tariel-x/stream/client"
+)
+
+func TestPrepared_Bind(t *testing.T) {
+	push, err := client.NewPrepared(client.CmdPush, client.Placeholder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := client.NewPrepared(client.CmdSet, client.Placeholder, "id", client.Placeholder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v", "a b", "", "$1", "multi\r\nline"} {
+		bound, err := push.Bind(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (&client.Push{V: v}).String(); bound.String() != expected {
+			t.Errorf("expected %q, got %q", expected, bound.String())
+		}
+		bound, err = set.Bind("3", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (&client.Set{N: 3, ID: "id", V: v}).String(); bound.String() != expected {
+			t.Errorf("expected %q, got %q", expected, bound.String())
+		}
+	}
+
+	if _, err := set.Bind("3"); !errors.Is(err, client.ErrBind) {
+		t.Errorf("the missing value must fail, got %v", err)
+	}
+	if _, err := set.Bind("3\n", "v"); !errors.Is(err, client.ErrBind) {
+		t.Errorf("the line break before the last value must fail, got %v", err)
+	}
+	if _, err := client.NewPrepared(client.CmdSet, client.Placeholder); err == nil {
+		t.Error("the wrong arity must fail")
+	}
+	if _, err := client.NewPrepared(client.CmdPull, client.Placeholder); err == nil {
+		t.Error("the command without the template must fail")
+	}
+}
+
+func BenchmarkPrepared(b *testing.B) {
+	set, err := client.NewPrepared(client.CmdSet, client.Placeholder, "id", client.Placeholder)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bound, err := set.Bind("3", "value")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = bound.String()
+	}
+}
+
+func BenchmarkFresh(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = (&client.Set{N: 3, ID: "id", V: "value"}).String()
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/tariel-x/stream
 
-go 1.12
+go 1.16
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
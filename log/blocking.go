@@ -0,0 +1,57 @@
+package log
+
+import "context"
+
+// SetBlocking appends the value at the next index like SetBatch. With the retention count it does not
+// drop the oldest value of the full log but waits until DeleteRange, Delete, the age retention or the new
+// policy makes room for it, or ctx is done.
+func (l *Log) SetBlocking(ctx context.Context, v string) (int, error) {
+	l.m.Lock()
+	for l.full() {
+		if l.closed {
+			l.m.Unlock()
+			return 0, ErrClosed
+		}
+		if l.freed == nil {
+			l.freed = make(chan struct{})
+		}
+		freed := l.freed
+		l.m.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-freed:
+		}
+		l.m.Lock()
+	}
+	defer l.m.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	n := 0
+	if l.last != nil {
+		n = l.last.n + 1
+	}
+	l.notify(l.set(n, v))
+	l.retain(l.now())
+	return n, nil
+}
+
+// full reports whether the log holds the retention count of values. The caller must hold the lock.
+func (l *Log) full() bool {
+	return l.retention.Count > 0 && l.count >= uint64(l.retention.Count)
+}
+
+// removed counts the removal of the values and wakes the blocked writers. The caller must hold the write lock.
+func (l *Log) removed() {
+	l.removals++
+	l.wake()
+}
+
+// wake releases the writers waiting in SetBlocking to check the room again. The caller must hold the write lock.
+func (l *Log) wake() {
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+}
@@ -0,0 +1,36 @@
+package log
+
+import (
+	"context"
+)
+
+// Compact drops the idempotency keys of the values removed with Delete and DeleteRange and returns
+// the number of the values removed since the last call. The removed items are unlinked right away,
+// so the indexes of the remaining ones are kept: the log stays sparse and the peers agree on the
+// indexes without remapping them.
+func (l *Log) Compact(ctx context.Context) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	present := make(map[int]struct{}, l.count)
+	for cursor := l.first; cursor != nil; cursor = cursor.next {
+		present[cursor.n] = struct{}{}
+	}
+	// The key of the value not set to the local log yet is kept.
+	last := -1
+	if l.last != nil {
+		last = l.last.n
+	}
+	// The order is copied, the slice trimmed from its head keeps the backing array.
+	order := make([]string, 0, len(l.keyOrder))
+	for _, key := range l.keyOrder {
+		if _, ok := present[l.keys[key]]; ok || l.keys[key] > last {
+			order = append(order, key)
+			continue
+		}
+		delete(l.keys, key)
+	}
+	l.keyOrder = order
+	reclaimed := l.tombstones
+	l.tombstones = 0
+	return reclaimed, nil
+}
@@ -5,19 +5,41 @@ import (
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/tariel-x/stream/stream"
 )
 
 type item struct {
 	n        int
+	id       string
 	v        string
+	at       time.Time // the time the item has been set, see SetRetention
 	next     *item
 	previous *item
 }
 
+// DefaultWaitBuffer is the default number of values a subscriber may lag behind the writer before it is dropped.
+const DefaultWaitBuffer = 1024
+
+// DefaultIdempotencyKeys is the number of the last idempotency keys remembered by the log.
+const DefaultIdempotencyKeys = 1024
+
+var ErrClosed = errors.New("log is closed")
+
+// entry is the copy of the item sent to the subscribers, the values may be replaced in place once the
+// lock is released.
+type entry struct {
+	n int
+	v string
+}
+
 type wait struct {
-	c      chan *item
-	count  uint64
-	border *item
+	c    chan entry
+	done <-chan struct{}
+	stop chan struct{}
+	// coalesce makes the full waiter lose its oldest queued item instead of being dropped.
+	coalesce bool
 }
 
 type Log struct {
@@ -27,6 +49,25 @@ type Log struct {
 	count       uint64
 	waitlist    map[uint64]wait
 	connections *uint64
+	closed      bool
+	keys        map[string]int
+	keyOrder    []string
+	ids         map[string]*item
+	// removals counts the Delete, DeleteRange, Truncate and Restore calls and the retention drops, the iteration
+	// resumes from the item pointer only if there were none.
+	removals uint64
+	// retention is the policy set with SetRetention, the items with the indexes below horizon have
+	// been dropped by it. trimmer stops the background trimming.
+	retention stream.RetentionPolicy
+	horizon   int
+	trimmer   chan struct{}
+	// now is the clock of the item timestamps.
+	now func() time.Time
+	// freed is closed when the values are removed, the new retention is set or the log is closed, it wakes
+	// the writers blocked in SetBlocking.
+	freed chan struct{}
+	// tombstones counts the values removed by Delete and DeleteRange since the last Compact.
+	tombstones int
 }
 
 func NewLog() (*Log, error) {
@@ -34,6 +75,9 @@ func NewLog() (*Log, error) {
 		m:           sync.RWMutex{},
 		waitlist:    map[uint64]wait{},
 		connections: new(uint64),
+		keys:        map[string]int{},
+		ids:         map[string]*item{},
+		now:         time.Now,
 	}
 	atomic.StoreUint64(l.connections, 0)
 	return l, nil
@@ -45,9 +89,8 @@ func (l *Log) removeWait(i uint64) {
 	delete(l.waitlist, i)
 }
 
+// addWait registers the waiter. The caller must hold the write lock.
 func (l *Log) addWait(w wait) uint64 {
-	l.m.Lock()
-	defer l.m.Unlock()
 	i := atomic.AddUint64(l.connections, 1)
 	l.waitlist[i] = w
 	return i
@@ -56,61 +99,199 @@ func (l *Log) addWait(w wait) uint64 {
 func (l *Log) Set(ctx context.Context, n int, v string) error {
 	l.m.Lock()
 	defer l.m.Unlock()
-	defer func() {
-		for _, w := range l.waitlist {
-			w.c <- l.last
+	l.notify(l.set(n, v))
+	l.retain(l.now())
+	return nil
+}
+
+// SetID sets the value with the Paxos ID.
+func (l *Log) SetID(ctx context.Context, n int, id, v string) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	new := l.set(n, v)
+	if id != "" {
+		new.id = id
+		l.ids[id] = new
+	}
+	l.notify(new)
+	l.retain(l.now())
+	return nil
+}
+
+// Metadata returns the value with the index and its Paxos ID, stream.ErrNotFound if there is no such value
+// or stream.ErrOutOfRange if it has been dropped by the retention.
+func (l *Log) Metadata(ctx context.Context, n int) (stream.EntryMeta, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	if n < l.horizon {
+		return stream.EntryMeta{}, stream.ErrOutOfRange
+	}
+	for cursor := l.first; cursor != nil && cursor.n <= n; cursor = cursor.next {
+		if cursor.n == n {
+			return stream.EntryMeta{N: n, ProposalN: n, ID: cursor.id, V: cursor.v}, nil
 		}
-	}()
+	}
+	return stream.EntryMeta{}, stream.ErrNotFound
+}
+
+// IndexAtTime returns the index of the first value set at or after the time. If there is none it is the
+// index the next appended value gets, so the subscription from it receives only the new values.
+func (l *Log) IndexAtTime(ctx context.Context, at time.Time) (int, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	for cursor := l.first; cursor != nil; cursor = cursor.next {
+		if !cursor.at.Before(at) {
+			return cursor.n, nil
+		}
+	}
+	if l.last == nil {
+		return l.horizon, nil
+	}
+	return l.last.n + 1, nil
+}
+
+// GetByID returns the value with the Paxos ID or stream.ErrNotFound.
+func (l *Log) GetByID(ctx context.Context, id string) (string, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	found, ok := l.ids[id]
+	if !ok {
+		return "", stream.ErrNotFound
+	}
+	return found.v, nil
+}
+
+// notify sends the item to all waiters. A waiter whose buffer is full is dropped or loses
+// its oldest queued item instead of blocking the writer. The caller must hold the write lock.
+func (l *Log) notify(set *item) {
+	new := entry{n: set.n, v: set.v}
+	for i, w := range l.waitlist {
+		select {
+		case w.c <- new:
+		case <-w.done:
+		default:
+			if !w.coalesce {
+				close(w.stop)
+				delete(l.waitlist, i)
+				continue
+			}
+			// Only the writer holding the lock sends, so the freed slot stays free.
+			select {
+			case <-w.c:
+			default:
+			}
+			w.c <- new
+		}
+	}
+}
+
+// SetBatch appends the values after the last item at once and returns index of the first value.
+func (l *Log) SetBatch(ctx context.Context, vs []string) (int, error) {
+	if len(vs) == 0 {
+		return 0, errors.New("empty batch")
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	base := 0
+	if l.last != nil {
+		base = l.last.n + 1
+	}
+	added := make([]*item, 0, len(vs))
+	for i, v := range vs {
+		added = append(added, l.set(base+i, v))
+	}
+	for _, new := range added {
+		l.notify(new)
+	}
+	l.retain(l.now())
+	return base, nil
+}
+
+// KeyIndex returns the index of the value pushed with the idempotency key if the key is among
+// the last DefaultIdempotencyKeys ones.
+func (l *Log) KeyIndex(ctx context.Context, key string) (int, bool, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	index, ok := l.keys[key]
+	return index, ok, nil
+}
+
+// SetKey remembers the index of the value pushed with the idempotency key, the oldest key is
+// forgotten after DefaultIdempotencyKeys ones.
+func (l *Log) SetKey(ctx context.Context, key string, n int) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if _, ok := l.keys[key]; !ok {
+		if len(l.keyOrder) >= DefaultIdempotencyKeys {
+			delete(l.keys, l.keyOrder[0])
+			l.keyOrder = l.keyOrder[1:]
+		}
+		l.keyOrder = append(l.keyOrder, key)
+	}
+	l.keys[key] = n
+	return nil
+}
+
+func (l *Log) set(n int, v string) *item {
 	l.count++
 	if l.first == nil || l.last == nil {
-		l.init(n, v)
-		return nil
+		return l.init(n, v)
 	}
 
 	// Search correct position.
 	cursor := l.last
-	if l.last == nil {
-	}
 	for cursor.previous != nil && cursor.n >= n {
 		cursor = cursor.previous
 	}
+	// Found element is the first and it is greater.
+	if cursor.previous == nil && cursor.n >= n {
+		new := l.insert(nil, cursor, n, v)
+		l.first = new
+		return new
+	}
 	// Found element is the last.
 	if l.last == cursor && cursor.next == nil {
-		l.append(n, v)
-		return nil
+		return l.append(n, v)
 	}
 	// Insert in the middle of the list.
-	l.insert(cursor, cursor.next, n, v)
-	return nil
+	return l.insert(cursor, cursor.next, n, v)
 }
 
-func (l *Log) init(n int, v string) {
+func (l *Log) init(n int, v string) *item {
 	new := &item{
 		n:        n,
 		v:        v,
+		at:       l.now(),
 		next:     nil,
 		previous: nil,
 	}
 	l.first = new
 	l.last = new
+	return new
 }
 
-func (l *Log) append(n int, v string) {
+func (l *Log) append(n int, v string) *item {
 	current := l.last
 	new := &item{
 		n:        n,
 		v:        v,
+		at:       l.now(),
 		next:     nil,
 		previous: current,
 	}
 	current.next = new
 	l.last = new
+	return new
 }
 
-func (l *Log) insert(left, right *item, n int, v string) {
+func (l *Log) insert(left, right *item, n int, v string) *item {
 	new := &item{
 		n:        n,
 		v:        v,
+		at:       l.now(),
 		next:     right,
 		previous: left,
 	}
@@ -120,6 +301,187 @@ func (l *Log) insert(left, right *item, n int, v string) {
 	if right != nil {
 		right.previous = new
 	}
+	return new
+}
+
+// Delete removes the item with index n. It returns stream.ErrOutOfRange if there is no such item.
+func (l *Log) Delete(ctx context.Context, n int) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	cursor := l.first
+	for cursor != nil && cursor.n != n {
+		cursor = cursor.next
+	}
+	if cursor == nil {
+		return stream.ErrOutOfRange
+	}
+	l.forget(cursor)
+	l.removed()
+	l.tombstones++
+	if cursor.previous != nil {
+		cursor.previous.next = cursor.next
+	} else {
+		l.first = cursor.next
+	}
+	if cursor.next != nil {
+		cursor.next.previous = cursor.previous
+	} else {
+		l.last = cursor.previous
+	}
+	l.count--
+	return nil
+}
+
+// DeleteRange removes the items with the indexes in [from, to) and returns their number. The range
+// beyond the log removes nothing, the indexes of the remaining items are kept.
+func (l *Log) DeleteRange(ctx context.Context, from, to int) (int, error) {
+	if from < 0 || from > to {
+		return 0, errors.New("invalid range")
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	deleted := 0
+	for cursor := l.first; cursor != nil && cursor.n < to; cursor = cursor.next {
+		if cursor.n < from {
+			continue
+		}
+		l.forget(cursor)
+		if cursor.previous != nil {
+			cursor.previous.next = cursor.next
+		} else {
+			l.first = cursor.next
+		}
+		if cursor.next != nil {
+			cursor.next.previous = cursor.previous
+		} else {
+			l.last = cursor.previous
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		l.count -= uint64(deleted)
+		l.tombstones += deleted
+		l.removed()
+	}
+	return deleted, nil
+}
+
+// CompareAndSet replaces the value with index n if it equals expected and reports whether it has been
+// replaced. It returns stream.ErrOutOfRange if there is no such item. The subscribers are not notified
+// about the replaced value.
+func (l *Log) CompareAndSet(ctx context.Context, n int, expected, new string) (bool, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	found := l.find(n)
+	if found == nil {
+		return false, stream.ErrOutOfRange
+	}
+	if found.v != expected {
+		return false, nil
+	}
+	found.v = new
+	return true, nil
+}
+
+// Swap exchanges the values with the indexes i and j together with their Paxos IDs, the set times stay
+// with the indexes. It returns stream.ErrOutOfRange leaving both values untouched if either is missing.
+// Like CompareAndSet it does not notify the subscribers.
+func (l *Log) Swap(ctx context.Context, i, j int) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	first, second := l.find(i), l.find(j)
+	if first == nil || second == nil {
+		return stream.ErrOutOfRange
+	}
+	first.v, second.v = second.v, first.v
+	first.id, second.id = second.id, first.id
+	for _, swapped := range []*item{first, second} {
+		if swapped.id != "" {
+			l.ids[swapped.id] = swapped
+		}
+	}
+	return nil
+}
+
+// Truncate drops all items except keepLast last ones.
+func (l *Log) Truncate(ctx context.Context, keepLast int) error {
+	if keepLast < 0 {
+		return errors.New("invalid keepLast")
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if uint64(keepLast) >= l.count {
+		return nil
+	}
+	l.removed()
+	if keepLast == 0 {
+		l.first, l.last, l.count = nil, nil, 0
+		l.ids = map[string]*item{}
+		return nil
+	}
+	cursor := l.last
+	for i := 1; i < keepLast; i++ {
+		cursor = cursor.previous
+	}
+	for dropped := l.first; dropped != cursor; dropped = dropped.next {
+		l.forget(dropped)
+	}
+	cursor.previous.next = nil
+	cursor.previous = nil
+	l.first = cursor
+	l.count = uint64(keepLast)
+	return nil
+}
+
+// forget removes the ID of the removed item. The caller must hold the write lock.
+func (l *Log) forget(removed *item) {
+	if removed.id != "" && l.ids[removed.id] == removed {
+		delete(l.ids, removed.id)
+	}
+}
+
+func (l *Log) Len(ctx context.Context) (int, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return int(l.count), nil
+}
+
+// First returns the index and the value of the oldest item or stream.ErrEmptyLog.
+func (l *Log) First(ctx context.Context) (int, string, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	if l.first == nil {
+		return 0, "", stream.ErrEmptyLog
+	}
+	return l.first.n, l.first.v, nil
+}
+
+// Last returns the index and the value of the newest item or stream.ErrEmptyLog.
+func (l *Log) Last(ctx context.Context) (int, string, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	if l.last == nil {
+		return 0, "", stream.ErrEmptyLog
+	}
+	return l.last.n, l.last.v, nil
+}
+
+// Tail returns up to k last values in the log order.
+func (l *Log) Tail(ctx context.Context, k int) ([]string, error) {
+	if k <= 0 {
+		return nil, errors.New("invalid k")
+	}
+	l.m.RLock()
+	defer l.m.RUnlock()
+	cursor := l.last
+	for i := 1; i < k && cursor != nil && cursor.previous != nil; i++ {
+		cursor = cursor.previous
+	}
+	var results []string
+	for ; cursor != nil; cursor = cursor.next {
+		results = append(results, cursor.v)
+	}
+	return results, nil
 }
 
 func (l *Log) Get(ctx context.Context, n int) ([]string, error) {
@@ -128,80 +490,286 @@ func (l *Log) Get(ctx context.Context, n int) ([]string, error) {
 	}
 	l.m.RLock()
 	defer l.m.RUnlock()
-	cursor := l.first
-	if cursor == nil {
-		return nil, nil
+	if n < l.horizon {
+		return nil, stream.ErrOutOfRange
 	}
-	for cursor.n < n {
+	cursor := l.first
+	for cursor != nil && cursor.n < n {
 		cursor = cursor.next
 	}
 	var results []string
-	for cursor != nil {
+	for ; cursor != nil; cursor = cursor.next {
 		select {
 		case <-ctx.Done():
 			return results, nil
 		default:
 		}
-		if cursor.n < n {
-			continue
-		}
 		results = append(results, cursor.v)
-		cursor = cursor.next
 	}
 
 	return results, nil
 }
 
-func (l *Log) Pull(ctx context.Context, n int) (chan string, error) {
+// WaitFor returns the value with index n, waiting until it is set if necessary.
+// It returns the ctx error if ctx is done first, ErrClosed if the log is closed and stream.ErrOutOfRange
+// if the value has been dropped by the retention.
+func (l *Log) WaitFor(ctx context.Context, n int) (string, error) {
+	if n < 0 {
+		return "", errors.New("invalid n")
+	}
+	for {
+		l.m.Lock()
+		if found := l.find(n); found != nil {
+			l.m.Unlock()
+			return found.v, nil
+		}
+		if l.closed {
+			l.m.Unlock()
+			return "", ErrClosed
+		}
+		if n < l.horizon {
+			l.m.Unlock()
+			return "", stream.ErrOutOfRange
+		}
+		w := wait{
+			c:    make(chan entry, DefaultWaitBuffer),
+			done: ctx.Done(),
+			stop: make(chan struct{}),
+		}
+		thiswait := l.addWait(w)
+		l.m.Unlock()
+
+		v, ok, err := waitItem(ctx, w, n)
+		l.removeWait(thiswait)
+		if err != nil || ok {
+			return v, err
+		}
+		// The waiter has been dropped, look for the value again.
+	}
+}
+
+func waitItem(ctx context.Context, w wait, n int) (string, bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-w.stop:
+			return "", false, nil
+		case new := <-w.c:
+			if new.n == n {
+				return new.v, true, nil
+			}
+		}
+	}
+}
+
+// find returns the item with index n or nil. The caller must hold the lock.
+func (l *Log) find(n int) *item {
+	for cursor := l.last; cursor != nil && cursor.n >= n; cursor = cursor.previous {
+		if cursor.n == n {
+			return cursor
+		}
+	}
+	return nil
+}
+
+// GetMany returns the values with the indexes ns in the same order.
+func (l *Log) GetMany(ctx context.Context, ns []int) ([]string, []bool, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	values := make([]string, len(ns))
+	found := make([]bool, len(ns))
+	for i, n := range ns {
+		if cursor := l.find(n); cursor != nil {
+			values[i], found[i] = cursor.v, true
+		}
+	}
+	return values, found, nil
+}
+
+// Range returns values with indexes in [from, to). Indexes beyond the log are ignored.
+func (l *Log) Range(ctx context.Context, from, to int) ([]string, error) {
+	if from < 0 || from > to {
+		return nil, errors.New("invalid range")
+	}
+	l.m.RLock()
+	defer l.m.RUnlock()
+	var results []string
+	for cursor := l.first; cursor != nil && cursor.n < to; cursor = cursor.next {
+		select {
+		case <-ctx.Done():
+			return results, nil
+		default:
+		}
+		if cursor.n >= from {
+			results = append(results, cursor.v)
+		}
+	}
+	return results, nil
+}
+
+// IterateChunk is the number of items Iterate copies under the lock at once.
+const IterateChunk = 256
+
+// Iterate calls fn for every item in the log order. The iteration stops when fn returns an error
+// or ctx is done. The items are copied under the lock by IterateChunk and fn is called without it,
+// so the slow fn does not block the writes. The items appended during the iteration are visited too,
+// the ones removed are skipped unless they have already been copied.
+func (l *Log) Iterate(ctx context.Context, fn func(index int, value string) error) error {
+	return l.IterateMeta(ctx, func(meta stream.EntryMeta) error {
+		return fn(meta.N, meta.V)
+	})
+}
+
+// IterateMeta is Iterate passing the values with their Paxos IDs like Metadata.
+func (l *Log) IterateMeta(ctx context.Context, fn func(meta stream.EntryMeta) error) error {
+	var last *item
+	var removals uint64
+	metas := make([]stream.EntryMeta, 0, IterateChunk)
+	for {
+		metas = metas[:0]
+		l.m.RLock()
+		cursor := l.resume(last, removals)
+		removals = l.removals
+		for ; cursor != nil && len(metas) < IterateChunk; cursor = cursor.next {
+			metas = append(metas, stream.EntryMeta{N: cursor.n, ProposalN: cursor.n, ID: cursor.id, V: cursor.v})
+			last = cursor
+		}
+		l.m.RUnlock()
+		if len(metas) == 0 {
+			return nil
+		}
+		for _, meta := range metas {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(meta); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resume returns the item following the last visited one or the first item if last is nil.
+// If any items have been removed since the removals count, it is the first item with the greater index.
+// The caller must hold the lock.
+func (l *Log) resume(last *item, removals uint64) *item {
+	if last == nil {
+		return l.first
+	}
+	if removals == l.removals {
+		return last.next
+	}
+	cursor := l.first
+	for cursor != nil && cursor.n <= last.n {
+		cursor = cursor.next
+	}
+	return cursor
+}
+
+// Sync does nothing, the in-memory log is never durable.
+func (l *Log) Sync(ctx context.Context) error {
+	return nil
+}
+
+// Close stops all subscriptions and rejects the new ones.
+func (l *Log) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.closed = true
+	l.wake()
+	if l.trimmer != nil {
+		close(l.trimmer)
+		l.trimmer = nil
+	}
+	for i, w := range l.waitlist {
+		close(w.stop)
+		delete(l.waitlist, i)
+	}
+	return nil
+}
+
+// Pull sends all values starting from n and then every newly set value to the returned unbuffered channel.
+// Up to buffer new values are queued for the subscriber, if it lags behind more it is dropped.
+// Zero buffer means DefaultWaitBuffer. The channel is closed by the log when ctx is done,
+// the subscriber is dropped or the log is closed.
+func (l *Log) Pull(ctx context.Context, n int, buffer int) (chan string, error) {
+	return l.subscribe(ctx, n, buffer, true, false)
+}
+
+// Follow is Pull which skips the values set before the call.
+func (l *Log) Follow(ctx context.Context, n int, buffer int) (chan string, error) {
+	return l.subscribe(ctx, n, buffer, false, false)
+}
+
+// Coalesce is Pull or Follow which never drops the lagging subscriber: when its buffer is full
+// the oldest queued value is skipped to make room for the new one.
+func (l *Log) Coalesce(ctx context.Context, n int, buffer int, follow bool) (chan string, error) {
+	return l.subscribe(ctx, n, buffer, !follow, true)
+}
+
+func (l *Log) subscribe(ctx context.Context, n int, buffer int, withHistory, coalesce bool) (chan string, error) {
 	if n < 0 {
 		return nil, errors.New("invalid n")
 	}
+	if buffer < 0 {
+		return nil, errors.New("invalid buffer")
+	}
+	if buffer == 0 {
+		buffer = DefaultWaitBuffer
+	}
+
+	// Copy the history and subscribe atomically, so no value is lost between them.
+	l.m.Lock()
+	if l.closed {
+		l.m.Unlock()
+		return nil, ErrClosed
+	}
 	w := wait{
-		c:      make(chan *item, l.count),
-		border: l.last,
+		c:        make(chan entry, buffer),
+		done:     ctx.Done(),
+		stop:     make(chan struct{}),
+		coalesce: coalesce,
+	}
+	var history []entry
+	for cursor := l.first; withHistory && cursor != nil; cursor = cursor.next {
+		if cursor.n >= n {
+			history = append(history, entry{n: cursor.n, v: cursor.v})
+		}
 	}
 	thiswait := l.addWait(w)
+	l.m.Unlock()
 
 	results := make(chan string)
 	go func() {
 		defer close(results)
-		defer close(w.c)
 		defer l.removeWait(thiswait)
 
-		l.m.RLock()
-		cursor := l.first
-		for cursor != nil && cursor.n < n {
-			cursor = cursor.next
-		}
-
 		alreadySent := map[int]struct{}{}
-		for cursor != nil && cursor.n <= w.border.n {
+		for _, cursor := range history {
 			select {
 			case <-ctx.Done():
 				return
-			default:
+			case results <- cursor.v:
 			}
-			if cursor.n < n {
-				continue
-			}
-			results <- cursor.v
 			alreadySent[cursor.n] = struct{}{}
-			cursor = cursor.next
 		}
-		l.m.RUnlock()
 
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case new, ok := <-w.c:
-				if !ok {
-					return
-				}
-				if _, ok := alreadySent[new.n]; ok {
+			case <-w.stop:
+				return
+			case new := <-w.c:
+				if _, ok := alreadySent[new.n]; ok || new.n < n {
 					continue
 				}
-				results <- new.v
+				select {
+				case <-ctx.Done():
+					return
+				case results <- new.v:
+				}
 			}
 		}
 	}()
@@ -1,8 +1,16 @@
 package log
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/tariel-x/stream/stream"
 )
 
 func TestLog_Set(t *testing.T) {
@@ -28,3 +36,845 @@ func TestLog_Set(t *testing.T) {
 		}
 	}
 }
+
+func TestLog_Delete(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 1, "b")
+	l.Set(ctx, 2, "c")
+
+	if err := l.Delete(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete(ctx, 1); err != stream.ErrOutOfRange {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+	if err := l.Delete(ctx, 5); err != stream.ErrOutOfRange {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+	if err := l.Delete(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a"}
+	actual, _ := l.Get(ctx, 0)
+	if len(actual) != len(expected) || actual[0] != expected[0] {
+		t.Errorf("%v != %v", actual, expected)
+	}
+}
+
+func TestLog_DeleteRange(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	for i, v := range []string{"a", "b", "c", "d", "e"} {
+		l.SetID(ctx, i, v, v)
+	}
+
+	if deleted, err := l.DeleteRange(ctx, 1, 3); err != nil || deleted != 2 {
+		t.Fatalf("unexpected %d %v", deleted, err)
+	}
+	if actual, _ := l.Get(ctx, 0); strings.Join(actual, "") != "ade" {
+		t.Errorf("unexpected values %v", actual)
+	}
+	// The remaining values keep their indexes.
+	if _, v, _ := l.Last(ctx); v != "e" {
+		t.Errorf("unexpected last %q", v)
+	}
+	if values, found, _ := l.GetMany(ctx, []int{1, 3}); found[0] || !found[1] || values[1] != "d" {
+		t.Errorf("unexpected %v %v", values, found)
+	}
+	if _, err := l.GetByID(ctx, "b"); err != stream.ErrNotFound {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+
+	// The range over the bounds is clamped.
+	if deleted, err := l.DeleteRange(ctx, 0, 100); err != nil || deleted != 3 {
+		t.Fatalf("unexpected %d %v", deleted, err)
+	}
+	if length, _ := l.Len(ctx); length != 0 {
+		t.Errorf("expected empty log, got %d values", length)
+	}
+	if _, _, err := l.First(ctx); err != stream.ErrEmptyLog {
+		t.Errorf("expected %s, got %v", stream.ErrEmptyLog, err)
+	}
+	if _, err := l.DeleteRange(ctx, 3, 2); err == nil {
+		t.Error("expected error for the reversed range")
+	}
+}
+
+func TestLog_Compact(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	for i, v := range []string{"a", "b", "c", "d", "e"} {
+		l.Set(ctx, i, v)
+		l.SetKey(ctx, v, i)
+	}
+	l.Delete(ctx, 0)
+	l.DeleteRange(ctx, 2, 4)
+
+	if reclaimed, err := l.Compact(ctx); err != nil || reclaimed != 3 {
+		t.Fatalf("unexpected %d %v", reclaimed, err)
+	}
+	// The surviving values keep their indexes.
+	if values, found, _ := l.GetMany(ctx, []int{1, 4}); !found[0] || !found[1] || values[0] != "b" || values[1] != "e" {
+		t.Errorf("unexpected %v %v", values, found)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": true, "c": false, "e": true} {
+		if _, ok, _ := l.KeyIndex(ctx, key); ok != expected {
+			t.Errorf("%s: expected the key kept %t", key, expected)
+		}
+	}
+	if reclaimed, _ := l.Compact(ctx); reclaimed != 0 {
+		t.Errorf("compacted again %d", reclaimed)
+	}
+}
+
+func TestLog_Tail(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	if results, _ := l.Tail(ctx, 1); len(results) != 0 {
+		t.Errorf("expected empty tail, got %v", results)
+	}
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 1, "b")
+	l.Set(ctx, 2, "c")
+
+	cases := []struct {
+		k        int
+		expected []string
+	}{
+		{1, []string{"c"}},
+		{2, []string{"b", "c"}},
+		{10, []string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		actual, _ := l.Tail(ctx, c.k)
+		if len(actual) != len(c.expected) {
+			t.Errorf("%d: %v != %v", c.k, actual, c.expected)
+			continue
+		}
+		for i := range c.expected {
+			if actual[i] != c.expected[i] {
+				t.Errorf("%d: %v != %v", c.k, actual, c.expected)
+			}
+		}
+	}
+}
+
+func TestLog_Range(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 1, "b")
+	l.Set(ctx, 2, "c")
+
+	cases := []struct {
+		from, to int
+		expected []string
+	}{
+		{0, 0, nil},
+		{1, 2, []string{"b"}},
+		{1, 10, []string{"b", "c"}},
+		{5, 10, nil},
+	}
+	for _, c := range cases {
+		actual, err := l.Range(ctx, c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(c.expected) {
+			t.Errorf("[%d, %d): %v != %v", c.from, c.to, actual, c.expected)
+			continue
+		}
+		for i := range c.expected {
+			if actual[i] != c.expected[i] {
+				t.Errorf("[%d, %d): %v != %v", c.from, c.to, actual, c.expected)
+			}
+		}
+	}
+}
+
+func TestLog_Follow(t *testing.T) {
+	l, _ := NewLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.Set(ctx, 0, "a")
+
+	results, err := l.Follow(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Set(ctx, 1, "b")
+	if v := <-results; v != "b" {
+		t.Errorf("expected b, got %s", v)
+	}
+}
+
+func TestLog_FollowSlowSubscriber(t *testing.T) {
+	l, _ := NewLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results, err := l.Follow(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody reads results, the writer must not block.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < DefaultWaitBuffer*2; i++ {
+			l.Set(ctx, i, "v")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer is blocked by the slow subscriber")
+	}
+
+	// The dropped subscription is closed after the buffered values.
+	for range results {
+	}
+}
+
+func TestLog_CoalesceSlowSubscriber(t *testing.T) {
+	l, _ := NewLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results, err := l.Coalesce(ctx, 0, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < DefaultWaitBuffer; i++ {
+			l.Set(ctx, i, strconv.Itoa(i))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer is blocked by the slow subscriber")
+	}
+
+	// The subscription is kept and ends with the newest values.
+	previous := -1
+	for previous != DefaultWaitBuffer-1 {
+		select {
+		case v := <-results:
+			n, _ := strconv.Atoi(v)
+			if n <= previous {
+				t.Fatalf("%d received after %d", n, previous)
+			}
+			previous = n
+		case <-time.After(time.Second):
+			t.Fatalf("the last value is not received, the previous one is %d", previous)
+		}
+	}
+}
+
+func TestLog_Iterate(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 2, "b")
+	l.Set(ctx, 5, "c")
+
+	var indexes []int
+	stop := errors.New("stop")
+	err := l.Iterate(ctx, func(index int, value string) error {
+		indexes = append(indexes, index)
+		if value == "b" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("expected %s, got %v", stop, err)
+	}
+	if len(indexes) != 2 || indexes[0] != 0 || indexes[1] != 2 {
+		t.Errorf("unexpected indexes %v", indexes)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.Iterate(cancelled, func(int, string) error { return nil }); err != context.Canceled {
+		t.Errorf("expected %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestLog_IterateMeta(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	l.SetID(ctx, 2, "id", "b")
+
+	var metas []stream.EntryMeta
+	if err := l.IterateMeta(ctx, func(meta stream.EntryMeta) error {
+		metas = append(metas, meta)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []stream.EntryMeta{{N: 0, ProposalN: 0, V: "a"}, {N: 2, ProposalN: 2, ID: "id", V: "b"}}
+	if len(metas) != len(expected) || metas[0] != expected[0] || metas[1] != expected[1] {
+		t.Errorf("expected %+v, got %+v", expected, metas)
+	}
+}
+
+func TestLog_IterateUnlocked(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	for i := 0; i < IterateChunk+2; i++ {
+		l.Set(ctx, i, strconv.Itoa(i))
+	}
+	var indexes []int
+	err := l.Iterate(ctx, func(index int, value string) error {
+		indexes = append(indexes, index)
+		if index == 0 {
+			// The writes are not blocked by fn, the removed items after the copied chunk are not visited.
+			l.Set(ctx, IterateChunk+5, "appended")
+			l.Truncate(ctx, 3)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != IterateChunk+3 || indexes[IterateChunk] != IterateChunk || indexes[IterateChunk+2] != IterateChunk+5 {
+		t.Errorf("unexpected %d indexes ending with %v", len(indexes), indexes[IterateChunk-1:])
+	}
+}
+
+func TestLog_PullClose(t *testing.T) {
+	l, _ := NewLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	l.Set(ctx, 0, "a")
+
+	results, err := l.Pull(ctx, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-results; v != "a" {
+		t.Errorf("expected a, got %s", v)
+	}
+	cancel()
+	if _, ok := <-results; ok {
+		t.Error("channel must be closed after ctx is done")
+	}
+
+	results, err = l.Pull(context.Background(), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-results
+	l.Close()
+	if _, ok := <-results; ok {
+		t.Error("channel must be closed after the log is closed")
+	}
+	if _, err := l.Pull(context.Background(), 0, 1); err != ErrClosed {
+		t.Errorf("expected %s, got %v", ErrClosed, err)
+	}
+}
+
+func TestLog_Truncate(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		keepLast int
+		expected []string
+	}{
+		{0, nil},
+		{2, []string{"b", "c"}},
+		{3, []string{"a", "b", "c"}},
+		{10, []string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		l, _ := NewLog()
+		l.Set(ctx, 0, "a")
+		l.Set(ctx, 1, "b")
+		l.Set(ctx, 2, "c")
+		if err := l.Truncate(ctx, c.keepLast); err != nil {
+			t.Fatal(err)
+		}
+		length, _ := l.Len(ctx)
+		if length != len(c.expected) {
+			t.Errorf("%d: expected length %d, got %d", c.keepLast, len(c.expected), length)
+		}
+		actual, _ := l.Tail(ctx, 10)
+		if len(actual) != len(c.expected) {
+			t.Errorf("%d: %v != %v", c.keepLast, actual, c.expected)
+			continue
+		}
+		for i := range c.expected {
+			if actual[i] != c.expected[i] {
+				t.Errorf("%d: %v != %v", c.keepLast, actual, c.expected)
+			}
+		}
+	}
+}
+
+func TestLog_SetKey(t *testing.T) {
+	ctx := context.Background()
+	l, _ := NewLog()
+	if _, ok, err := l.KeyIndex(ctx, "key"); err != nil || ok {
+		t.Fatalf("unexpected result %t %v", ok, err)
+	}
+	if err := l.SetKey(ctx, "key", 5); err != nil {
+		t.Fatal(err)
+	}
+	if index, ok, err := l.KeyIndex(ctx, "key"); err != nil || !ok || index != 5 {
+		t.Fatalf("unexpected result %d %t %v", index, ok, err)
+	}
+	if err := l.SetKey(ctx, "", 1); err == nil {
+		t.Error("expected the error for the empty key")
+	}
+
+	// The oldest keys are forgotten.
+	for i := 0; i < DefaultIdempotencyKeys; i++ {
+		l.SetKey(ctx, strconv.Itoa(i), i)
+	}
+	if _, ok, _ := l.KeyIndex(ctx, "key"); ok {
+		t.Error("expected the key to be evicted")
+	}
+}
+
+func TestLog_WaitFor(t *testing.T) {
+	ctx := context.Background()
+	l, _ := NewLog()
+	l.Set(ctx, 0, "a")
+	if v, err := l.WaitFor(ctx, 0); err != nil || v != "a" {
+		t.Errorf("unexpected result %q %v", v, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Set(ctx, 1, "b")
+		l.Set(ctx, 2, "c")
+	}()
+	if v, err := l.WaitFor(ctx, 2); err != nil || v != "c" {
+		t.Errorf("unexpected result %q %v", v, err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.WaitFor(timeout, 5); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestLog_FirstLast(t *testing.T) {
+	ctx := context.Background()
+	l, _ := NewLog()
+	if _, _, err := l.First(ctx); err != stream.ErrEmptyLog {
+		t.Errorf("expected %s, got %v", stream.ErrEmptyLog, err)
+	}
+	if _, _, err := l.Last(ctx); err != stream.ErrEmptyLog {
+		t.Errorf("expected %s, got %v", stream.ErrEmptyLog, err)
+	}
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 1, "b")
+	l.Set(ctx, 2, "c")
+	l.Truncate(ctx, 2)
+	if n, v, err := l.First(ctx); err != nil || n != 1 || v != "b" {
+		t.Errorf("unexpected first %d %q %v", n, v, err)
+	}
+	if n, v, err := l.Last(ctx); err != nil || n != 2 || v != "c" {
+		t.Errorf("unexpected last %d %q %v", n, v, err)
+	}
+}
+
+func TestLog_GetByID(t *testing.T) {
+	ctx := context.Background()
+	l, _ := NewLog()
+	l.SetID(ctx, 0, "id0", "a")
+	l.SetID(ctx, 1, "id1", "b")
+	l.SetID(ctx, 2, "id2", "c")
+	if v, err := l.GetByID(ctx, "id1"); err != nil || v != "b" {
+		t.Errorf("unexpected result %q %v", v, err)
+	}
+	if _, err := l.GetByID(ctx, "unknown"); err != stream.ErrNotFound {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+	l.Delete(ctx, 1)
+	l.Truncate(ctx, 1)
+	for _, id := range []string{"id0", "id1"} {
+		if _, err := l.GetByID(ctx, id); err != stream.ErrNotFound {
+			t.Errorf("%s: expected %s, got %v", id, stream.ErrNotFound, err)
+		}
+	}
+	if v, err := l.GetByID(ctx, "id2"); err != nil || v != "c" {
+		t.Errorf("unexpected result %q %v", v, err)
+	}
+}
+
+func TestLog_GetMany(t *testing.T) {
+	ctx := context.Background()
+	l, _ := NewLog()
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 1, "b")
+	l.Set(ctx, 3, "d")
+	values, found, err := l.GetMany(ctx, []int{3, 2, 0, 3, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedValues := []string{"d", "", "a", "d", ""}
+	expectedFound := []bool{true, false, true, true, false}
+	for i := range expectedValues {
+		if values[i] != expectedValues[i] || found[i] != expectedFound[i] {
+			t.Errorf("%d: %q %t != %q %t", i, values[i], found[i], expectedValues[i], expectedFound[i])
+		}
+	}
+}
+
+func TestLog_SnapshotRestore(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.SetID(ctx, 2, "id2", "c")
+	l.SetID(ctx, 0, "id0", "a b")
+	l.Set(ctx, 1, "line\nbreak")
+	l.SetID(ctx, 5, "id5", "")
+
+	var snapshot bytes.Buffer
+	if err := l.Snapshot(ctx, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _ := NewLog()
+	restored.Set(ctx, 7, "dropped")
+	if err := restored.Restore(ctx, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	values, _ := restored.Get(ctx, 0)
+	expected := []string{"a b", "line\nbreak", "c", ""}
+	if len(values) != len(expected) {
+		t.Fatalf("unexpected values %q", values)
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("%q != %q", values[i], expected[i])
+		}
+	}
+	if n, _, _ := restored.Last(ctx); n != 5 {
+		t.Errorf("unexpected last index %d", n)
+	}
+	for id, v := range map[string]string{"id0": "a b", "id2": "c", "id5": ""} {
+		if actual, err := restored.GetByID(ctx, id); err != nil || actual != v {
+			t.Errorf("%s: unexpected %q %v", id, actual, err)
+		}
+	}
+	if _, err := restored.GetByID(ctx, "id7"); err != stream.ErrNotFound {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+}
+
+func TestLog_RestoreInvalid(t *testing.T) {
+	ctx := context.Background()
+	l, _ := NewLog()
+	l.Set(ctx, 0, "kept")
+	if err := l.Restore(ctx, strings.NewReader("stream-snapshot 99\n")); !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("expected %s, got %v", ErrSnapshotVersion, err)
+	}
+	for _, snapshot := range []string{"", "garbage\n", "stream-snapshot 1\n{\"n\":"} {
+		if err := l.Restore(ctx, strings.NewReader(snapshot)); err == nil {
+			t.Errorf("%q: expected an error", snapshot)
+		}
+	}
+	if values, _ := l.Get(ctx, 0); len(values) != 1 || values[0] != "kept" {
+		t.Errorf("the log has been changed: %q", values)
+	}
+}
+
+func TestLog_CompareAndSet(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	if swapped, err := l.CompareAndSet(ctx, 0, "b", "c"); err != nil || swapped {
+		t.Errorf("mismatch must not swap: %t %v", swapped, err)
+	}
+	if swapped, err := l.CompareAndSet(ctx, 0, "a", "c"); err != nil || !swapped {
+		t.Errorf("match must swap: %t %v", swapped, err)
+	}
+	if values, _ := l.Get(ctx, 0); len(values) != 1 || values[0] != "c" {
+		t.Errorf("unexpected values %q", values)
+	}
+	if _, err := l.CompareAndSet(ctx, 1, "a", "c"); err != stream.ErrOutOfRange {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+}
+
+func TestLog_CompareAndSetRace(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	for round := 0; round < 100; round++ {
+		l.Set(ctx, round, "initial")
+		var wg sync.WaitGroup
+		swapped := make([]bool, 2)
+		for i := range swapped {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				swapped[i], _ = l.CompareAndSet(ctx, round, "initial", strconv.Itoa(i))
+			}(i)
+		}
+		wg.Wait()
+		if swapped[0] == swapped[1] {
+			t.Fatalf("round %d: exactly one CAS must succeed, got %v", round, swapped)
+		}
+	}
+}
+
+func TestLog_Swap(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	for i, v := range []string{"a", "b", "c"} {
+		l.SetID(ctx, i, "id-"+v, v)
+	}
+	if err := l.Swap(ctx, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := l.Get(ctx, 0); strings.Join(values, "") != "cba" {
+		t.Errorf("unexpected values %v", values)
+	}
+	// The values keep their ids.
+	if meta, err := l.Metadata(ctx, 0); err != nil || meta.ID != "id-c" {
+		t.Errorf("unexpected %+v %v", meta, err)
+	}
+	if v, err := l.GetByID(ctx, "id-a"); err != nil || v != "a" {
+		t.Errorf("unexpected %q %v", v, err)
+	}
+
+	// The failed swap changes nothing.
+	if err := l.Swap(ctx, 1, 5); err != stream.ErrOutOfRange {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+	if values, _ := l.Get(ctx, 0); strings.Join(values, "") != "cba" {
+		t.Errorf("unexpected values %v after the failed swap", values)
+	}
+}
+
+func TestLog_CompareAndSetPull(t *testing.T) {
+	l, _ := NewLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.Set(ctx, 0, "a")
+	results, err := l.Pull(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			l.CompareAndSet(ctx, 0, "a", "b")
+			l.CompareAndSet(ctx, 1, "c", "d")
+			l.CompareAndSet(ctx, 0, "b", "a")
+		}
+	}()
+	l.Set(ctx, 1, "c")
+	for i := 0; i < 2; i++ {
+		if v := <-results; v == "" {
+			t.Fatalf("unexpected empty value %d", i)
+		}
+	}
+	wg.Wait()
+}
+
+func TestLog_SwapRace(t *testing.T) {
+	l, _ := NewLog()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	l.Set(ctx, 1, "b")
+	// The subscriber reads the values swapped meanwhile.
+	pullCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results, err := l.Pull(pullCtx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			if v := <-results; v == "" {
+				t.Errorf("unexpected empty value %d", i)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			l.Swap(ctx, 0, 1)
+		}()
+		go func() {
+			defer wg.Done()
+			l.CompareAndSet(ctx, 0, "a", "a")
+		}()
+		if i == 50 {
+			l.Set(ctx, 2, "c")
+		}
+	}
+	wg.Wait()
+	// The even number of swaps restores the order.
+	if values, _ := l.Get(ctx, 0); strings.Join(values, "") != "abc" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestLog_RetentionCount(t *testing.T) {
+	l, _ := NewLog()
+	defer l.Close()
+	ctx := context.Background()
+	for i, v := range []string{"a", "b", "c", "d"} {
+		l.Set(ctx, i, v)
+	}
+	if err := l.SetRetention(stream.RetentionPolicy{Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	l.SetBatch(ctx, []string{"e"})
+
+	if results, err := l.Get(ctx, 3); err != nil || strings.Join(results, "") != "de" {
+		t.Errorf("unexpected %v %v", results, err)
+	}
+	if _, err := l.Get(ctx, 2); !errors.Is(err, stream.ErrOutOfRange) {
+		t.Errorf("expected %s for the dropped value, got %v", stream.ErrOutOfRange, err)
+	}
+	if _, err := l.WaitFor(ctx, 0); !errors.Is(err, stream.ErrOutOfRange) {
+		t.Errorf("expected %s for the dropped value, got %v", stream.ErrOutOfRange, err)
+	}
+	if length, _ := l.Len(ctx); length != 2 {
+		t.Errorf("expected 2 values, got %d", length)
+	}
+}
+
+func TestLog_Metadata(t *testing.T) {
+	l, _ := NewLog()
+	defer l.Close()
+	ctx := context.Background()
+	l.SetID(ctx, 2, "id", "a")
+	meta, err := l.Metadata(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (stream.EntryMeta{N: 2, ProposalN: 2, ID: "id", V: "a"}); meta != expected {
+		t.Errorf("expected %+v, got %+v", expected, meta)
+	}
+	if _, err := l.Metadata(ctx, 1); !errors.Is(err, stream.ErrNotFound) {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+}
+
+func TestLog_IndexAtTime(t *testing.T) {
+	l, _ := NewLog()
+	defer l.Close()
+	ctx := context.Background()
+	start := time.Unix(1000, 0)
+	if n, err := l.IndexAtTime(ctx, start); err != nil || n != 0 {
+		t.Errorf("unexpected index %d of the empty log: %v", n, err)
+	}
+	for i, v := range []string{"a", "b", "c"} {
+		l.now = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		l.Set(ctx, i, v)
+	}
+	for at, expected := range map[time.Duration]int{
+		-time.Second:            0,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		3 * time.Second:         3,
+	} {
+		if n, err := l.IndexAtTime(ctx, start.Add(at)); err != nil || n != expected {
+			t.Errorf("%s: expected %d, got %d %v", at, expected, n, err)
+		}
+	}
+}
+
+func TestLog_SetBlocking(t *testing.T) {
+	l, _ := NewLog()
+	defer l.Close()
+	ctx := context.Background()
+	if err := l.SetRetention(stream.RetentionPolicy{Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b"} {
+		if _, err := l.SetBlocking(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.SetBlocking(timeout, "c"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %s for the full log, got %v", context.DeadlineExceeded, err)
+	}
+
+	done := make(chan int)
+	go func() {
+		n, err := l.SetBlocking(ctx, "c")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- n
+	}()
+	select {
+	case <-done:
+		t.Fatal("the value is set to the full log")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := l.Delete(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-done; n != 2 {
+		t.Errorf("expected the index 2, got %d", n)
+	}
+	if results, err := l.Get(ctx, 0); err != nil || strings.Join(results, "") != "bc" {
+		t.Errorf("unexpected %v %v", results, err)
+	}
+
+	// The closed log releases the blocked writer.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Close()
+	}()
+	if _, err := l.SetBlocking(ctx, "d"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected %s, got %v", ErrClosed, err)
+	}
+}
+
+func TestLog_RetentionAge(t *testing.T) {
+	l, _ := NewLog()
+	defer l.Close()
+	ctx := context.Background()
+	l.Set(ctx, 0, "a")
+	if err := l.SetRetention(stream.RetentionPolicy{Age: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if length, _ := l.Len(ctx); length != 1 {
+		t.Fatalf("the fresh value has been dropped")
+	}
+
+	// The trimmer drops the value without the writes.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, _, err := l.First(ctx); errors.Is(err, stream.ErrEmptyLog) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the expired value has not been dropped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := l.Get(ctx, 0); !errors.Is(err, stream.ErrOutOfRange) {
+		t.Errorf("expected %s for the dropped value, got %v", stream.ErrOutOfRange, err)
+	}
+	// The new values are kept until they expire too.
+	l.Set(ctx, 1, "b")
+	if results, err := l.Get(ctx, 1); err != nil || len(results) != 1 || results[0] != "b" {
+		t.Errorf("unexpected %v %v", results, err)
+	}
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tariel-x/stream/stream"
+)
+
+// RetentionInterval is the longest period of the background trimming of the values older than
+// the retention age. The shorter ages are checked twice per age.
+const RetentionInterval = time.Second
+
+// minRetentionInterval keeps the trimmer of the tiny ages from spinning.
+const minRetentionInterval = time.Millisecond
+
+// SetRetention replaces the retention policy. The oldest values over the count are dropped on the
+// writes, the ones older than the age are dropped by the background trimmer as well. Get and WaitFor of
+// the dropped index return stream.ErrOutOfRange.
+func (l *Log) SetRetention(policy stream.RetentionPolicy) error {
+	if policy.Count < 0 || policy.Age < 0 {
+		return errors.New("invalid retention")
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.retention = policy
+	l.retain(l.now())
+	l.wake()
+	if policy.Age > 0 && l.trimmer == nil {
+		l.trimmer = make(chan struct{})
+		go l.trim(l.trimmer)
+	}
+	return nil
+}
+
+// trim drops the expired values until the stop is closed by Close.
+func (l *Log) trim(stop chan struct{}) {
+	for {
+		l.m.RLock()
+		interval := trimInterval(l.retention.Age)
+		l.m.RUnlock()
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			l.m.Lock()
+			l.retain(now)
+			l.m.Unlock()
+		}
+	}
+}
+
+func trimInterval(age time.Duration) time.Duration {
+	interval := age / 2
+	if age <= 0 || interval > RetentionInterval {
+		return RetentionInterval
+	}
+	if interval < minRetentionInterval {
+		return minRetentionInterval
+	}
+	return interval
+}
+
+// retain drops the oldest items while they are over the retention count or older than the retention
+// age. The caller must hold the write lock.
+func (l *Log) retain(now time.Time) {
+	dropped := false
+	for l.first != nil && l.expired(l.first, now) {
+		oldest := l.first
+		l.forget(oldest)
+		l.horizon = oldest.n + 1
+		l.first = oldest.next
+		if l.first != nil {
+			l.first.previous = nil
+		} else {
+			l.last = nil
+		}
+		l.count--
+		dropped = true
+	}
+	if dropped {
+		l.removed()
+	}
+}
+
+// expired reports whether the oldest item is to be dropped by the retention. The caller must hold the lock.
+func (l *Log) expired(oldest *item, now time.Time) bool {
+	if l.retention.Count > 0 && l.count > uint64(l.retention.Count) {
+		return true
+	}
+	return l.retention.Age > 0 && now.Sub(oldest.at) > l.retention.Age
+}
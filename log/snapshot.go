@@ -0,0 +1,99 @@
+package log
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SnapshotVersion is the version of the format written by Snapshot. Restore reads this and
+// all the earlier versions.
+const SnapshotVersion = 1
+
+// snapshotMagic starts the header line of the snapshot followed by the version: "stream-snapshot 1".
+const snapshotMagic = "stream-snapshot"
+
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+// snapshotEntry is the JSON line of the item in the snapshot of version 1.
+type snapshotEntry struct {
+	N  int    `json:"n"`
+	ID string `json:"id,omitempty"`
+	V  string `json:"v"`
+}
+
+// Snapshot writes all items with their Paxos IDs to w in the log order. The items are copied
+// under the lock, so the writes to the log are not blocked while w is written.
+// The idempotency keys are not included.
+func (l *Log) Snapshot(ctx context.Context, w io.Writer) error {
+	l.m.RLock()
+	entries := make([]snapshotEntry, 0, l.count)
+	for cursor := l.first; cursor != nil; cursor = cursor.next {
+		entries = append(entries, snapshotEntry{N: cursor.n, ID: cursor.id, V: cursor.v})
+	}
+	l.m.RUnlock()
+
+	buffered := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(buffered, "%s %d\n", snapshotMagic, SnapshotVersion); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(buffered)
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// Restore replaces the items of the log with the ones read from the snapshot. The log is left
+// intact if the snapshot is malformed. The active subscribers are not notified about the restored items.
+func (l *Log) Restore(ctx context.Context, r io.Reader) error {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	var version int
+	if _, err := fmt.Sscanf(strings.TrimSpace(header), snapshotMagic+" %d", &version); err != nil {
+		return fmt.Errorf("invalid snapshot header %q", header)
+	}
+	if version < 1 || version > SnapshotVersion {
+		return fmt.Errorf("%w %d", ErrSnapshotVersion, version)
+	}
+
+	// Build the new list aside, so the readers never see the partially restored log.
+	restored := &Log{ids: map[string]*item{}, now: l.now}
+	decoder := json.NewDecoder(buffered)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var entry snapshotEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read snapshot entry: %w", err)
+		}
+		new := restored.set(entry.N, entry.V)
+		if entry.ID != "" {
+			new.id = entry.ID
+			restored.ids[entry.ID] = new
+		}
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.first, l.last, l.count, l.ids = restored.first, restored.last, restored.count, restored.ids
+	l.keys, l.keyOrder = map[string]int{}, nil
+	l.horizon, l.tombstones = 0, 0
+	l.removed()
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 
@@ -19,12 +20,14 @@ import (
 
 var backgroundContext context.Context
 
+const shutdownTimeout = time.Second * 10
+
 func main() {
 	log.SetOutput(os.Stdout)
 
 	app := cli.NewApp()
 	app.Name = "Στρεαμ"
-	app.Version = "0.1"
+	app.Version = stream.Version
 	app.Usage = "Στρεαμ is distributed log made with Paxos"
 
 	app.Commands = []cli.Command{
@@ -42,6 +45,14 @@ func main() {
 					Name:  "listen, l",
 					Usage: "Listen interface:port",
 				},
+				cli.StringFlag{
+					Name:  "snapshot, s",
+					Usage: "Snapshot file written by SNAPSHOT and loaded on start",
+				},
+				cli.StringFlag{
+					Name:  "promises, p",
+					Usage: "File keeping the Paxos promises over the restarts",
+				},
 			},
 		},
 	}
@@ -85,17 +96,31 @@ func Run(c *cli.Context) error {
 		}
 	}
 
-	pxs, err := paxos.NewPaxos(nodes, listenAddress)
+	var options []paxos.Option
+	if path := c.String("promises"); path != "" {
+		store, err := paxos.NewFilePromiseStore(path)
+		if err != nil {
+			return err
+		}
+		options = append(options, paxos.WithPromiseStore(store))
+	}
+	pxs, err := paxos.NewPaxos(nodes, listenAddress, options...)
 	if err != nil {
 		return err
 	}
+	go pxs.RunHeartbeat(backgroundContext, paxos.DefaultHeartbeatInterval)
 
 	lg, err := storage.NewLog()
 	if err != nil {
 		return err
 	}
 
-	hndlr, err := stream.NewHandler(lg, pxs)
+	snapshotPath := c.String("snapshot")
+	if err := restoreSnapshot(lg, snapshotPath); err != nil {
+		return err
+	}
+
+	hndlr, err := stream.NewHandler(lg, pxs, stream.WithSnapshotPath(snapshotPath))
 	if err != nil {
 		return err
 	}
@@ -104,5 +129,31 @@ func Run(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return srv.Run(backgroundContext)
+	err = srv.Run(backgroundContext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if closeErr := hndlr.Close(ctx); closeErr != nil {
+		log.Println("error closing handler", closeErr)
+	}
+	if closeErr := lg.Close(); closeErr != nil {
+		log.Println("error closing log", closeErr)
+	}
+	return err
+}
+
+// restoreSnapshot loads the snapshot file into the log if it exists.
+func restoreSnapshot(lg *storage.Log, path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return lg.Restore(backgroundContext, f)
 }
@@ -0,0 +1,80 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// DefaultHeartbeatInterval is the period of the leader heartbeats and DefaultLeaseDuration is the time
+// the followers keep the leader after its last heartbeat.
+const (
+	DefaultHeartbeatInterval = 500 * time.Millisecond
+	DefaultLeaseDuration     = 3 * DefaultHeartbeatInterval
+)
+
+// ErrLeaseHeld is returned by Commit of the follower while the lease of the leader is valid.
+var ErrLeaseHeld = fmt.Errorf("%w: leader lease is held", ErrQuorumFailed)
+
+// WithLeaseDuration sets the time the followers keep the leader after its last heartbeat.
+func WithLeaseDuration(duration time.Duration) Option {
+	return func(p *paxos) {
+		p.leaseDuration = duration
+	}
+}
+
+// Heartbeat renews the lease of the leader on the other nodes. It does nothing on the follower.
+func (p *Paxos) Heartbeat() {
+	if atomic.LoadInt32(&p.leader) != 1 {
+		return
+	}
+	heartbeat := &client.Heartbeat{N: int(atomic.LoadUint64(p.n))}
+	for _, node := range p.nodes {
+		go node.Exec(heartbeat)
+	}
+}
+
+// RunHeartbeat sends the heartbeats every interval until ctx is done.
+func (p *Paxos) RunHeartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Heartbeat()
+		}
+	}
+}
+
+// Lease handles the heartbeat of the leader with the proposal n. The stale heartbeat is refused.
+// While the lease is valid the node refuses the proposals of the other nodes and does not start
+// the own rounds.
+func (p *Paxos) Lease(leader string, n int) bool {
+	if n < int(atomic.LoadUint64(p.n)) {
+		return false
+	}
+	p.leaseM.Lock()
+	defer p.leaseM.Unlock()
+	p.leaseHolder = leader
+	p.leaseDeadline = p.now().Add(p.leaseDuration)
+	atomic.StoreInt32(&p.leader, 0)
+	p.leaderAddr.Store(leader)
+	return true
+}
+
+// ElectionDue reports whether the node may start a new round: the lease of another node has expired.
+func (p *paxos) ElectionDue() bool {
+	return p.leaseAllows(p.name)
+}
+
+// leaseAllows reports whether the proposer may run a round.
+func (p *paxos) leaseAllows(proposer string) bool {
+	p.leaseM.Lock()
+	defer p.leaseM.Unlock()
+	return p.leaseHolder == "" || p.leaseHolder == proposer || !p.now().Before(p.leaseDeadline)
+}
@@ -0,0 +1,53 @@
+package paxos
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLease_SuppressesElection(t *testing.T) {
+	now := time.Unix(0, 0)
+	p, err := NewPaxos(nil, "self", WithLeaseDuration(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.now = func() time.Time { return now }
+	n := int(atomic.LoadUint64(p.n))
+
+	if !p.Lease("leader", n) {
+		t.Fatal("lease is refused")
+	}
+	// The heartbeats keep the lease while the election would be due without them.
+	for i := 0; i < 5; i++ {
+		now = now.Add(600 * time.Millisecond)
+		if p.ElectionDue() {
+			t.Fatalf("heartbeat %d: election is due", i)
+		}
+		if ok, _ := p.Prepare(n+10, "other"); ok {
+			t.Fatalf("heartbeat %d: proposal of another node is promised", i)
+		}
+		if !p.Lease("leader", n) {
+			t.Fatalf("heartbeat %d: lease is refused", i)
+		}
+	}
+	if _, err := p.Commit(context.Background(), "v", "id"); err != ErrLeaseHeld {
+		t.Errorf("expected %s, got %v", ErrLeaseHeld, err)
+	}
+	if addr, isSelf := p.Leader(); addr != "leader" || isSelf {
+		t.Errorf("unexpected leader %s %t", addr, isSelf)
+	}
+
+	// Without the heartbeats the lease expires.
+	now = now.Add(time.Second)
+	if !p.ElectionDue() {
+		t.Fatal("election is not due after the lease expired")
+	}
+	if ok, _ := p.Prepare(n+10, "other"); !ok {
+		t.Error("proposal is refused after the lease expired")
+	}
+	if p.Lease("leader", n) {
+		t.Error("stale heartbeat is accepted")
+	}
+}
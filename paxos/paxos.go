@@ -1,20 +1,24 @@
 package paxos
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"log"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
-
-	"github.com/satori/go.uuid"
+	"time"
 
 	"github.com/tariel-x/stream/client"
 	"github.com/tariel-x/stream/stream"
 )
 
 var (
-	ErrQuorumFailed = errors.New("quorum failed")
+	ErrQuorumFailed = stream.ErrQuorumFailed
 	ErrAlreadySet   = errors.New("already set by another node")
 )
 
@@ -28,15 +32,127 @@ type Paxos struct {
 	*paxos
 }
 
-func NewPaxos(nodes []string, name string) (*Paxos, error) {
-	wnpaxos, err := newPaxos(nodes, name)
+func NewPaxos(nodes []string, name string, options ...Option) (*Paxos, error) {
+	wnpaxos, err := newPaxos(nodes, name, options...)
 	return &Paxos{
 		paxos: wnpaxos,
 	}, err
 }
 
-func (p *Paxos) Prepare(n int) (bool, stream.AcceptMessage) {
-	accepted, acceptMessage := p.paxos.Prepare(n)
+func (p *Paxos) State() stream.PaxosState {
+	return stream.PaxosState{
+		N:      int(atomic.LoadUint64(p.n)),
+		Leader: atomic.LoadInt32(&p.leader) == 1,
+		Peers:  len(p.nodes),
+	}
+}
+
+// Leader returns the node which proposal was promised last.
+func (p *Paxos) Leader() (string, bool) {
+	if atomic.LoadInt32(&p.leader) == 1 {
+		return p.name, true
+	}
+	return p.leaderAddr.Load().(string), false
+}
+
+// ReadIndex asks the nodes for their committed indexes and returns the greatest one reported
+// by the quorum or known to the node. The values appended to the local logs only are not counted.
+func (p *Paxos) ReadIndex(ctx context.Context) (int, error) {
+	wg := &sync.WaitGroup{}
+	indexes := make(chan int, len(p.nodes))
+	for _, node := range p.nodes {
+		wg.Add(1)
+		go p.sendCommitted(node, wg, indexes)
+	}
+	go func() {
+		wg.Wait()
+		close(indexes)
+	}()
+	index := p.CommittedIndex()
+	for count := 0; count < p.minQuorum; count++ {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case n, ok := <-indexes:
+			if !ok {
+				return 0, ErrQuorumFailed
+			}
+			if n > index {
+				index = n
+			}
+		}
+	}
+	return index, nil
+}
+
+// QuorumReachable pings the nodes and reports whether the quorum of them answers. The node without
+// peers is the quorum itself.
+func (p *Paxos) QuorumReachable() (bool, string) {
+	if len(p.nodes) == 0 {
+		return true, ""
+	}
+	wg := &sync.WaitGroup{}
+	var reachable int32
+	for _, node := range p.nodes {
+		wg.Add(1)
+		go func(nodeClient *client.Client) {
+			defer wg.Done()
+			response, err := nodeClient.QueryOne(&client.Ping{})
+			if err == nil && response.Message == client.CmdPong {
+				atomic.AddInt32(&reachable, 1)
+			}
+		}(node)
+	}
+	wg.Wait()
+	if int(reachable) >= p.minQuorum {
+		return true, ""
+	}
+	return false, fmt.Sprintf("%d of %d peers reachable, the quorum needs %d", reachable, len(p.nodes), p.minQuorum)
+}
+
+// sendCommitted sends the highest index chosen by the quorum known to the node or -1.
+// Nothing is sent if the node is not available.
+func (p *paxos) sendCommitted(nodeClient *client.Client, wg *sync.WaitGroup, indexes chan int) {
+	defer wg.Done()
+	response, err := nodeClient.QueryOne(&client.Committed{})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := response.Err(); err != nil {
+		log.Println(err)
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(response.Message))
+	if err != nil {
+		log.Println("can not parse reply", err)
+		return
+	}
+	indexes <- n
+}
+
+// Set marks the value chosen by another proposer as committed.
+func (p *Paxos) Set(n int, id string) {
+	p.paxos.Set(id)
+	p.observeCommitted(uint64(n))
+}
+
+// SetMinN raises N of the node above n, so the next proposals of the node are strictly greater and it
+// promises nothing up to n to the other proposers. N never decreases, so the floor holds until restart.
+func (p *Paxos) SetMinN(n int) {
+	if n < 0 {
+		return
+	}
+	p.observe(uint64(n) + 1)
+}
+
+// CommittedIndex returns the highest index chosen by the quorum.
+func (p *Paxos) CommittedIndex() int {
+	return int(atomic.LoadInt64(&p.committed))
+}
+
+func (p *Paxos) Prepare(n int, proposer string) (bool, stream.AcceptMessage) {
+	accepted, acceptMessage := p.paxos.Prepare(n, proposer)
 	if acceptMessage == nil {
 		return accepted, nil
 	}
@@ -52,9 +168,25 @@ type paxos struct {
 	n          *uint64
 	setted     map[string]struct{}
 	settedM    sync.RWMutex
+	leader     int32
+	committed  int64
+	name       string
+	leaderAddr atomic.Value
+	proposals  ProposalNumberGen
+	// failures is the number of the failed rounds in a row.
+	failures int32
+
+	leaseM        sync.Mutex
+	leaseHolder   string
+	leaseDeadline time.Time
+	leaseDuration time.Duration
+	now           func() time.Time
+
+	// promises keeps the acceptor state over the restarts, see WithPromiseStore.
+	promises PromiseStore
 }
 
-func newPaxos(nodes []string, name string) (*paxos, error) {
+func newPaxos(nodes []string, name string, options ...Option) (*paxos, error) {
 	clients := []*client.Client{}
 	for _, node := range nodes {
 		client, err := client.New(node, nil)
@@ -74,8 +206,22 @@ func newPaxos(nodes []string, name string) (*paxos, error) {
 		setted:    map[string]struct{}{},
 		settedM:   sync.RWMutex{},
 		acceptedM: sync.RWMutex{},
+		name:      name,
+		committed: -1,
+		proposals: NewJitteredProposals(nodeID(nodes, name), len(nodes)+1, mathrand.NewSource(time.Now().UnixNano())),
+
+		// The lease is created by the first heartbeat.
+		leaseDuration: DefaultLeaseDuration,
+		now:           time.Now,
 	}
+	for _, option := range options {
+		option(p)
+	}
+	p.leaderAddr.Store("")
 	atomic.StoreUint64(p.n, p.randInc())
+	if err := p.restore(); err != nil {
+		return nil, err
+	}
 	return p, nil
 }
 
@@ -108,16 +254,14 @@ func (p *paxos) getSetted(id string) bool {
 	return ok
 }
 
-func (p *paxos) Commit(v string) ([]stream.AcceptMessage, error) {
+func (p *paxos) Commit(ctx context.Context, v, id string) ([]stream.AcceptMessage, error) {
 	var acceptedMessages []stream.AcceptMessage
 	var acceptMessage *AcceptMessage
 	var err error
 
-	id := uuid.NewV4().String()
-
 	//TODO: if the foreign value is commited by the origin node - skip value.
 	for acceptMessage == nil || (acceptMessage != nil && acceptMessage.id != id) {
-		acceptMessage, err = p.commit(v, id)
+		acceptMessage, err = p.commit(ctx, v, id)
 		// If the initial value has already set then just return (-1, nil)
 		// If the foreign value has already set then just skip and return to the origin value.
 		if err == ErrAlreadySet && acceptMessage != nil {
@@ -126,8 +270,9 @@ func (p *paxos) Commit(v string) ([]stream.AcceptMessage, error) {
 			}
 			continue
 		}
+		// Values accepted before the failure are returned as well, they are already chosen.
 		if err != nil && err != ErrAlreadySet {
-			return nil, err
+			return acceptedMessages, err
 		}
 		// Inc N counter to make the next proposition.
 		atomic.AddUint64(p.n, 1)
@@ -145,56 +290,63 @@ func (p *paxos) randInc() uint64 {
 	return uint64(b[0]) + 2
 }
 
-func (p *paxos) commit(v, id string) (*AcceptMessage, error) {
-	var acceptMessage *AcceptMessage
-	var err error
+// retry chooses N for the next round and waits the delay of the generator or until ctx is done.
+func (p *paxos) retry(ctx context.Context) {
+	round := atomic.AddInt32(&p.failures, 1)
+	n, delay := p.proposals.Next(atomic.LoadUint64(p.n), int(round))
+	p.observe(n)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
 
-commitCycle:
-	for {
-	promisePhase:
-		for {
-			acceptMessage, err = p.prepare(atomic.LoadUint64(p.n), v, id)
-			switch err {
-			case nil:
-				break promisePhase
-			case ErrQuorumFailed:
-				atomic.AddUint64(p.n, p.randInc()) //TODO: set max proposed N in quorum + 1
-			default:
-				return nil, err
-			}
-		}
+// commit makes one Paxos round. On quorum failure N is increased for the next round.
+func (p *paxos) commit(ctx context.Context, v, id string) (*AcceptMessage, error) {
+	if !p.ElectionDue() {
+		return nil, ErrLeaseHeld
+	}
+	acceptMessage, err := p.prepare(atomic.LoadUint64(p.n), v, id)
+	if err == ErrQuorumFailed {
+		// N is already raised to the max promised N in the quorum.
+		p.retry(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		v, id = acceptMessage.v, acceptMessage.id
-		// If the returned from the node elder proposed message is already set than skip it.
-		if p.getSetted(acceptMessage.id) {
-			return acceptMessage, ErrAlreadySet
-		}
-		// Accept phase
-		err = p.accept(acceptMessage)
-		switch err {
-		case nil:
-			break commitCycle
-		case ErrQuorumFailed:
-			atomic.AddUint64(p.n, p.randInc()) //TODO: set max proposed N in quorum + 1
-		default:
-			return nil, err
-		}
+	// If the returned from the node elder proposed message is already set than skip it.
+	if p.getSetted(acceptMessage.id) {
+		return acceptMessage, ErrAlreadySet
 	}
+	// Accept phase
+	err = p.accept(acceptMessage)
+	if err == ErrQuorumFailed {
+		p.retry(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt32(&p.failures, 0)
 	// If the returned from the node elder proposed message is already set than skip it.
 	if p.getSetted(acceptMessage.id) {
 		return acceptMessage, ErrAlreadySet
 	}
-	p.Set(id)
+	p.Set(acceptMessage.id)
+	p.observeCommitted(acceptMessage.n)
 	return acceptMessage, p.set(acceptMessage)
 }
 
 //Prepare returns true if proposed N is more than last known N.
 //If some value is accepted but not set, it would be also returned.
-func (p *paxos) Prepare(n int) (bool, *AcceptMessage) {
-	if n > int(atomic.LoadUint64(p.n)) {
+func (p *paxos) Prepare(n int, proposer string) (bool, *AcceptMessage) {
+	// The promises are compared and persisted in order, otherwise the lower one could be saved last.
+	p.acceptedM.Lock()
+	defer p.acceptedM.Unlock()
+	if n > int(atomic.LoadUint64(p.n)) && p.leaseAllows(proposer) {
 		var msg *AcceptMessage
-		p.acceptedM.Lock()
-		defer p.acceptedM.Unlock()
 		if p.acceptedV != nil {
 			msg = &AcceptMessage{
 				n:  atomic.LoadUint64(p.n),
@@ -202,25 +354,37 @@ func (p *paxos) Prepare(n int) (bool, *AcceptMessage) {
 				v:  *p.acceptedV,
 			}
 		}
+		// The promise not persisted is not given.
+		if err := p.persist(n, nil); err != nil {
+			return false, nil
+		}
 		atomic.StoreUint64(p.n, uint64(n))
 		p.acceptedV = nil
 		p.acceptedID = nil
+		// Another node has taken over the proposals.
+		atomic.StoreInt32(&p.leader, 0)
+		p.leaderAddr.Store(proposer)
 		return true, msg
 	}
 	return false, nil
 }
 
-func (p *paxos) Accept(n int, v, id string) bool {
-	if n >= int(atomic.LoadUint64(p.n)) {
-		p.acceptedM.Lock()
-		defer p.acceptedM.Unlock()
-		atomic.StoreUint64(p.n, uint64(n))
-		p.acceptedV = &v
-		p.acceptedID = &id
-		return true
-
+// Accept accepts the proposal not less than the promised one. It returns the promised N
+// the proposal has been compared with.
+func (p *paxos) Accept(n int, v, id string) (bool, int) {
+	p.acceptedM.Lock()
+	defer p.acceptedM.Unlock()
+	promised := int(atomic.LoadUint64(p.n))
+	if n < promised {
+		return false, promised
 	}
-	return false
+	if err := p.persist(n, &AcceptMessage{n: uint64(n), id: id, v: v}); err != nil {
+		return false, promised
+	}
+	atomic.StoreUint64(p.n, uint64(n))
+	p.acceptedV = &v
+	p.acceptedID = &id
+	return true, promised
 }
 
 func (p *paxos) prepare(n uint64, v, id string) (*AcceptMessage, error) {
@@ -245,11 +409,14 @@ func (p *paxos) prepare(n uint64, v, id string) (*AcceptMessage, error) {
 	for promise := range promises {
 		if !promise.Promise {
 			rejection = true
-			break
+			// Outbid the proposal promised by the node in the next round.
+			p.observe(uint64(promise.N))
+			continue
 		}
 		count++
 		if promise.Previous && promise.N < int(n) {
 			if promise.N > maxPrevPromisedN {
+				maxPrevPromisedN = promise.N
 				acceptMessage.v = promise.V
 				acceptMessage.id = promise.ID
 			}
@@ -260,9 +427,31 @@ func (p *paxos) prepare(n uint64, v, id string) (*AcceptMessage, error) {
 		return nil, ErrQuorumFailed
 	}
 
+	atomic.StoreInt32(&p.leader, 1)
+	p.leaderAddr.Store(p.name)
 	return acceptMessage, nil
 }
 
+// observeCommitted raises the committed index to n.
+func (p *paxos) observeCommitted(n uint64) {
+	for {
+		current := atomic.LoadInt64(&p.committed)
+		if int64(n) <= current || atomic.CompareAndSwapInt64(&p.committed, current, int64(n)) {
+			return
+		}
+	}
+}
+
+// observe raises N to the proposal seen in the cluster.
+func (p *paxos) observe(n uint64) {
+	for {
+		current := atomic.LoadUint64(p.n)
+		if n <= current || atomic.CompareAndSwapUint64(p.n, current, n) {
+			return
+		}
+	}
+}
+
 func (p *paxos) sendPrepare(nodeClient *client.Client, wg *sync.WaitGroup, promises chan client.Promise, n uint64) {
 	defer wg.Done()
 
@@ -282,6 +471,8 @@ func (p *paxos) sendPrepare(nodeClient *client.Client, wg *sync.WaitGroup, promi
 	}
 }
 
+// accept sends the message to the nodes. The round returns at the first rejection without waiting
+// for the rest of the nodes: the proposal is preempted by a higher one which is outbid in the next round.
 func (p *paxos) accept(message *AcceptMessage) error {
 	wg := &sync.WaitGroup{}
 	accepts := make(chan client.Accepted, len(p.nodes))
@@ -289,21 +480,22 @@ func (p *paxos) accept(message *AcceptMessage) error {
 		wg.Add(1)
 		go p.sendAccept(node, wg, accepts, message.n, message.v, message.id)
 	}
+	// The channel is buffered for every node, so the late answers do not block the senders.
+	go func() {
+		wg.Wait()
+		close(accepts)
+	}()
 
-	wg.Wait()
-	close(accepts)
 	count := 0
-	rejection := false
-
 	for accept := range accepts {
 		if !accept.Accepted {
-			rejection = true
-			break
+			p.observe(uint64(accept.N))
+			return ErrQuorumFailed
 		}
 		count++
 	}
 
-	if count < p.minQuorum || rejection {
+	if count < p.minQuorum {
 		return ErrQuorumFailed
 	}
 	return nil
@@ -0,0 +1,189 @@
+package paxos
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPaxos_AcceptReturnsPromisedN(t *testing.T) {
+	p, err := NewPaxos(nil, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int(atomic.LoadUint64(p.n)) + 5
+	if ok, promised := p.Accept(n, "v", "id"); !ok || promised > n {
+		t.Fatalf("unexpected %t %d", ok, promised)
+	}
+	if ok, promised := p.Accept(n-1, "v", "id"); ok || promised != n {
+		t.Errorf("expected the rejection with %d, got %t %d", n, ok, promised)
+	}
+}
+
+// peer answers every request with the line until the test ends.
+func peer(t *testing.T, line string) string {
+	t.Helper()
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					conn.Write([]byte(line + "\n"))
+				}
+			}()
+		}
+	}()
+	return socket.Addr().String()
+}
+
+func TestPaxos_ReadIndexCommitted(t *testing.T) {
+	p, err := NewPaxos([]string{peer(t, "3"), peer(t, "7")}, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if index, err := p.ReadIndex(ctx); err != nil || index != 7 {
+		t.Errorf("expected 7, got %d %v", index, err)
+	}
+	p.Set(9, "id")
+	if index, err := p.ReadIndex(ctx); err != nil || index != 9 {
+		t.Errorf("the index committed by the node must count, got %d %v", index, err)
+	}
+}
+
+func TestPaxos_SetMinN(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	prepared := make(chan string, 1)
+	go func() {
+		conn, err := socket.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+			prepared <- line
+		}
+	}()
+
+	p, err := NewPaxos([]string{socket.Addr().String()}, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetMinN(1000)
+	if ok, _ := p.Prepare(1000, "other"); ok {
+		t.Error("the proposal up to the floor is promised")
+	}
+	// The peer never answers, the round fails after the PREPARE.
+	p.Commit(context.Background(), "v", "id")
+	var n int
+	if _, err := fmt.Sscanf(<-prepared, "PREPARE %d", &n); err != nil || n <= 1000 {
+		t.Errorf("the proposal %d is not above the floor: %v", n, err)
+	}
+	// The lower floor keeps N.
+	p.SetMinN(10)
+	if state := p.State(); state.N <= 1000 {
+		t.Errorf("N is lowered to %d", state.N)
+	}
+}
+
+// slowProposals waits an hour before every next round.
+type slowProposals struct{}
+
+func (g *slowProposals) Next(seen uint64, round int) (uint64, time.Duration) {
+	return seen + 1, time.Hour
+}
+
+func TestPaxos_CommitBackoffCancelled(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The closed peer fails the quorum at once.
+	socket.Close()
+	p, err := NewPaxos([]string{socket.Addr().String()}, "self", WithProposalNumberGen(&slowProposals{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Commit(ctx, "v", "id")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrQuorumFailed) {
+			t.Errorf("expected %s, got %v", ErrQuorumFailed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backoff ignores the cancelled context")
+	}
+}
+
+// ponger answers PONG to every connection until the listener is closed.
+func ponger(t *testing.T) net.Listener {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					fmt.Fprint(conn, "PONG\n")
+				}
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestPaxos_QuorumReachable(t *testing.T) {
+	first, second := ponger(t), ponger(t)
+	defer first.Close()
+	p, err := NewPaxos([]string{first.Addr().String(), second.Addr().String()}, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, reason := p.QuorumReachable(); !ok {
+		t.Errorf("the quorum is not reachable: %s", reason)
+	}
+
+	second.Close()
+	if ok, reason := p.QuorumReachable(); ok || reason != "1 of 2 peers reachable, the quorum needs 2" {
+		t.Errorf("unexpected %t %q", ok, reason)
+	}
+
+	single, err := NewPaxos(nil, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := single.QuorumReachable(); !ok {
+		t.Error("the single node is degraded")
+	}
+}
@@ -0,0 +1,73 @@
+package paxos
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProposalNumberGen chooses the proposal number for the next Paxos round after the failed one.
+type ProposalNumberGen interface {
+	// Next returns the proposal number greater than seen for the retry round, the rounds are
+	// counted from 1, and the delay before the round.
+	Next(seen uint64, round int) (uint64, time.Duration)
+}
+
+// Option configures the Paxos.
+type Option func(*paxos)
+
+// WithProposalNumberGen replaces the default JitteredProposals.
+func WithProposalNumberGen(gen ProposalNumberGen) Option {
+	return func(p *paxos) {
+		p.proposals = gen
+	}
+}
+
+const (
+	// maxJitterShift limits the growth of the proposal number jump and the delay.
+	maxJitterShift = 8
+	// DefaultRetryDelay is the delay range of the first retry, it doubles for every next one.
+	DefaultRetryDelay = time.Millisecond
+)
+
+// JitteredProposals makes the proposal numbers unique for the node, the number modulo the cluster size
+// is the node ID. Both the jump over the seen number and the delay are random and their range doubles
+// with every failed round, so the competing proposers get out of step instead of preempting each other.
+type JitteredProposals struct {
+	nodeID uint64
+	nodes  uint64
+	delay  time.Duration
+
+	m    sync.Mutex
+	rand *rand.Rand
+}
+
+// NewJitteredProposals creates the generator for the node nodeID of nodes ones.
+func NewJitteredProposals(nodeID, nodes int, src rand.Source) *JitteredProposals {
+	return &JitteredProposals{
+		nodeID: uint64(nodeID),
+		nodes:  uint64(nodes),
+		delay:  DefaultRetryDelay,
+		rand:   rand.New(src),
+	}
+}
+
+func (g *JitteredProposals) Next(seen uint64, round int) (uint64, time.Duration) {
+	shift := uint(round)
+	if shift > maxJitterShift {
+		shift = maxJitterShift
+	}
+	g.m.Lock()
+	defer g.m.Unlock()
+	step := 1 + uint64(g.rand.Int63n(1<<shift))
+	delay := time.Duration(g.rand.Int63n(int64(g.delay) << shift))
+	return (seen/g.nodes+step)*g.nodes + g.nodeID, delay
+}
+
+// nodeID returns the position of the node in the sorted cluster.
+func nodeID(nodes []string, name string) int {
+	all := append([]string{name}, nodes...)
+	sort.Strings(all)
+	return sort.SearchStrings(all, name)
+}
@@ -0,0 +1,94 @@
+package paxos
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestJitteredProposals_Unique(t *testing.T) {
+	a := NewJitteredProposals(0, 3, rand.NewSource(1))
+	b := NewJitteredProposals(1, 3, rand.NewSource(1))
+	for round := 1; round < 20; round++ {
+		na, _ := a.Next(100, round)
+		nb, _ := b.Next(100, round)
+		if na <= 100 || nb <= 100 {
+			t.Fatalf("round %d: %d and %d must be greater than seen", round, na, nb)
+		}
+		if na%3 != 0 || nb%3 != 1 {
+			t.Fatalf("round %d: %d and %d have wrong node suffix", round, na, nb)
+		}
+	}
+}
+
+func TestNodeID(t *testing.T) {
+	if id := nodeID([]string{"c:1", "a:1"}, "b:1"); id != 1 {
+		t.Errorf("expected 1, got %d", id)
+	}
+}
+
+// incrementProposals is the naive generator taking the next number without delay.
+type incrementProposals struct{}
+
+func (g *incrementProposals) Next(seen uint64, round int) (uint64, time.Duration) {
+	return seen + 1, 0
+}
+
+type proposer struct {
+	gen    ProposalNumberGen
+	n      uint64
+	accept bool
+	wait   int
+	round  int
+}
+
+// duel simulates two proposers with the single acceptor standing for the quorum. Every phase takes
+// a tick and the proposers act in the alternating order, the second one starts a tick later. It returns
+// the tick when a value is chosen or -1.
+func duel(a, b ProposalNumberGen, ticks int) int {
+	promised := uint64(0)
+	proposers := []*proposer{{gen: a, n: 1}, {gen: b, n: 2, wait: 1}}
+	for tick := 0; tick < ticks; tick++ {
+		order := proposers
+		if tick%2 == 1 {
+			order = []*proposer{proposers[1], proposers[0]}
+		}
+		for _, p := range order {
+			if p.wait > 0 {
+				p.wait--
+				continue
+			}
+			if !p.accept && p.n > promised {
+				promised = p.n
+				p.accept = true
+				continue
+			}
+			if p.accept && p.n >= promised {
+				return tick
+			}
+			p.round++
+			seen := p.n
+			if promised > seen {
+				seen = promised
+			}
+			var delay time.Duration
+			p.n, delay = p.gen.Next(seen, p.round)
+			p.wait = int(delay / DefaultRetryDelay)
+			p.accept = false
+		}
+	}
+	return -1
+}
+
+func TestDuel(t *testing.T) {
+	if tick := duel(&incrementProposals{}, &incrementProposals{}, 1000); tick != -1 {
+		t.Fatalf("the naive proposers are expected to livelock, chosen at %d", tick)
+	}
+	for seed := int64(0); seed < 100; seed++ {
+		a := NewJitteredProposals(0, 2, rand.NewSource(seed))
+		b := NewJitteredProposals(1, 2, rand.NewSource(seed+1000))
+		if tick := duel(a, b, 100); tick == -1 {
+			t.Errorf("seed %d: no value chosen in 100 ticks", seed)
+		}
+	}
+}
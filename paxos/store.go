@@ -0,0 +1,168 @@
+package paxos
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tariel-x/stream/stream"
+)
+
+// PromiseStore keeps the promised proposal and the accepted value of the acceptor over the restarts.
+// Prepare and Accept save them before answering, the failed save rejects the proposal.
+type PromiseStore interface {
+	SavePromise(n int) error
+	// LoadPromise returns zero if nothing has been promised.
+	LoadPromise() (int, error)
+	// SaveAccepted saves the accepted value, nil clears it.
+	SaveAccepted(msg stream.AcceptMessage) error
+	// LoadAccepted returns nil if there is no accepted value.
+	LoadAccepted() (stream.AcceptMessage, error)
+}
+
+// WithPromiseStore sets the store of the acceptor state, the state is loaded on start. Without the
+// store the node forgets its promises on restart.
+func WithPromiseStore(store PromiseStore) Option {
+	return func(p *paxos) {
+		p.promises = store
+	}
+}
+
+// restore loads the acceptor state from the store, the loaded promise is kept if it is greater than
+// the initial proposal number.
+func (p *paxos) restore() error {
+	if p.promises == nil {
+		return nil
+	}
+	promised, err := p.promises.LoadPromise()
+	if err != nil {
+		return err
+	}
+	accepted, err := p.promises.LoadAccepted()
+	if err != nil {
+		return err
+	}
+	if uint64(promised) > atomic.LoadUint64(p.n) {
+		atomic.StoreUint64(p.n, uint64(promised))
+	}
+	if accepted != nil {
+		v, id := accepted.V(), accepted.ID()
+		p.acceptedV, p.acceptedID = &v, &id
+	}
+	return nil
+}
+
+// persist saves the promise and the accepted value if the store is set.
+func (p *paxos) persist(n int, accepted stream.AcceptMessage) error {
+	if p.promises == nil {
+		return nil
+	}
+	if err := p.promises.SavePromise(n); err != nil {
+		return err
+	}
+	return p.promises.SaveAccepted(accepted)
+}
+
+// promiseState is the content of the FilePromiseStore file.
+type promiseState struct {
+	Promise  int            `json:"promise"`
+	Accepted *acceptedState `json:"accepted,omitempty"`
+}
+
+type acceptedState struct {
+	N  int    `json:"n"`
+	ID string `json:"id"`
+	V  string `json:"v"`
+}
+
+// FilePromiseStore is the PromiseStore keeping the state in the JSON file. The file is written to
+// a temporary one first and renamed, so the previous state is kept if the write fails.
+type FilePromiseStore struct {
+	path string
+
+	m     sync.Mutex
+	state promiseState
+}
+
+// NewFilePromiseStore opens the store of the path, the missing file means the empty state.
+func NewFilePromiseStore(path string) (*FilePromiseStore, error) {
+	s := &FilePromiseStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FilePromiseStore) SavePromise(n int) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	state := s.state
+	state.Promise = n
+	return s.write(state)
+}
+
+func (s *FilePromiseStore) LoadPromise() (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.state.Promise, nil
+}
+
+func (s *FilePromiseStore) SaveAccepted(msg stream.AcceptMessage) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	state := s.state
+	state.Accepted = nil
+	if msg != nil {
+		state.Accepted = &acceptedState{N: msg.N(), ID: msg.ID(), V: msg.V()}
+	}
+	return s.write(state)
+}
+
+func (s *FilePromiseStore) LoadAccepted() (stream.AcceptMessage, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.state.Accepted == nil {
+		return nil, nil
+	}
+	accepted := s.state.Accepted
+	return &AcceptMessage{n: uint64(accepted.N), id: accepted.ID, v: accepted.V}, nil
+}
+
+// write replaces the file with the state and keeps the state once it is synced.
+func (s *FilePromiseStore) write(state promiseState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary.Name(), s.path); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
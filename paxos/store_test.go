@@ -0,0 +1,143 @@
+package paxos
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tariel-x/stream/stream"
+)
+
+// memoryPromiseStore is the PromiseStore double surviving the restart of the Paxos.
+type memoryPromiseStore struct {
+	promise  int
+	accepted stream.AcceptMessage
+	err      error
+}
+
+func (s *memoryPromiseStore) SavePromise(n int) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.promise = n
+	return nil
+}
+
+func (s *memoryPromiseStore) LoadPromise() (int, error) {
+	return s.promise, nil
+}
+
+func (s *memoryPromiseStore) SaveAccepted(msg stream.AcceptMessage) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.accepted = msg
+	return nil
+}
+
+func (s *memoryPromiseStore) LoadAccepted() (stream.AcceptMessage, error) {
+	return s.accepted, nil
+}
+
+func TestPaxos_PromiseStoreRestart(t *testing.T) {
+	store := &memoryPromiseStore{}
+	p, err := NewPaxos(nil, "self", WithPromiseStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proposal is above the initial one of the restarted node.
+	n := int(atomic.LoadUint64(p.n)) + 1<<20
+	if ok, _ := p.Prepare(n, "proposer"); !ok {
+		t.Fatal("the proposal is rejected")
+	}
+	if ok, _ := p.Accept(n, "v", "id"); !ok {
+		t.Fatal("the value is not accepted")
+	}
+
+	// The restarted node keeps the promise and the accepted value.
+	restarted, err := NewPaxos(nil, "self", WithPromiseStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := restarted.Prepare(n-1, "proposer"); ok {
+		t.Error("the lower proposal is promised after the restart")
+	}
+	if ok, promised := restarted.Accept(n-1, "w", "other"); ok || promised != n {
+		t.Errorf("expected the rejection with %d, got %t %d", n, ok, promised)
+	}
+	ok, previous := restarted.Prepare(n+1, "proposer")
+	if !ok || previous == nil || previous.V() != "v" || previous.ID() != "id" {
+		t.Errorf("unexpected %t %+v", ok, previous)
+	}
+
+	// The promise failed to persist is not given.
+	store.err = errors.New("disk is full")
+	if ok, _ := restarted.Prepare(n+10, "proposer"); ok {
+		t.Error("the proposal is promised without the store")
+	}
+	if ok, _ := restarted.Accept(n+10, "v", "id"); ok {
+		t.Error("the value is accepted without the store")
+	}
+}
+
+func TestFilePromiseStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promises.json")
+	store, err := NewFilePromiseStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promise, _ := store.LoadPromise(); promise != 0 {
+		t.Errorf("unexpected promise %d of the new store", promise)
+	}
+	if accepted, _ := store.LoadAccepted(); accepted != nil {
+		t.Errorf("unexpected accepted %+v of the new store", accepted)
+	}
+	if err := store.SavePromise(42); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveAccepted(&AcceptMessage{n: 42, id: "id", v: "a b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFilePromiseStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promise, err := reopened.LoadPromise(); err != nil || promise != 42 {
+		t.Errorf("unexpected %d %v", promise, err)
+	}
+	accepted, err := reopened.LoadAccepted()
+	if err != nil || accepted == nil || accepted.N() != 42 || accepted.ID() != "id" || accepted.V() != "a b" {
+		t.Fatalf("unexpected %+v %v", accepted, err)
+	}
+	if err := reopened.SaveAccepted(nil); err != nil {
+		t.Fatal(err)
+	}
+	if accepted, _ := reopened.LoadAccepted(); accepted != nil {
+		t.Errorf("the cleared value is loaded %+v", accepted)
+	}
+}
+
+func TestPaxos_PromiseStoreConcurrentPrepare(t *testing.T) {
+	store := &memoryPromiseStore{}
+	p, err := NewPaxos(nil, "self", WithPromiseStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int(atomic.LoadUint64(p.n)) + 1<<20
+	var wg sync.WaitGroup
+	for i := 100; i > 0; i-- {
+		wg.Add(1)
+		go func(proposal int) {
+			defer wg.Done()
+			p.Prepare(proposal, "proposer")
+		}(n + i)
+	}
+	wg.Wait()
+	// The lower promise saved last would let the restarted node promise below the highest one.
+	if promised := int(atomic.LoadUint64(p.n)); promised != n+100 || store.promise != promised {
+		t.Errorf("expected the promise %d, got %d with %d saved", n+100, promised, store.promise)
+	}
+}
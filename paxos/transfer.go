@@ -0,0 +1,70 @@
+package paxos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tariel-x/stream/client"
+	"github.com/tariel-x/stream/stream"
+)
+
+var (
+	// ErrNotLeader is returned by TransferLeadership of the follower.
+	ErrNotLeader = fmt.Errorf("%w: the node is not the leader", stream.ErrIncorrectCmd)
+	// ErrUnknownPeer is returned by TransferLeadership to the address which is not a peer.
+	ErrUnknownPeer = fmt.Errorf("%w: unknown peer", stream.ErrIncorrectCmd)
+	// ErrTargetBehind is returned by TransferLeadership if the target has not committed every value
+	// committed by the node yet, the transfer may be retried later.
+	ErrTargetBehind = fmt.Errorf("%w: the target has not caught up", stream.ErrIncorrectCmd)
+)
+
+// TransferLeadership hands the leadership over to the peer with the address. The node stops being the
+// leader and points the writes to the target right away, so they are redirected during the transfer.
+// The target must have committed every value the node has, otherwise the node stays the leader. The node
+// stops the heartbeats and keeps the target as the lease holder, so it does not compete with the target,
+// which wins the next round once the lease of the node lapses on the other peers.
+func (p *Paxos) TransferLeadership(target string) error {
+	var peer *client.Client
+	for _, node := range p.nodes {
+		if node.Address == target {
+			peer = node
+		}
+	}
+	if peer == nil {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, target)
+	}
+	if !atomic.CompareAndSwapInt32(&p.leader, 1, 0) {
+		return ErrNotLeader
+	}
+	p.leaderAddr.Store(target)
+
+	committed, err := p.committedOf(peer)
+	if err != nil || committed < p.CommittedIndex() {
+		atomic.StoreInt32(&p.leader, 1)
+		p.leaderAddr.Store(p.name)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s has committed %d of %d", ErrTargetBehind, target, committed, p.CommittedIndex())
+	}
+
+	p.leaseM.Lock()
+	defer p.leaseM.Unlock()
+	p.leaseHolder = target
+	p.leaseDeadline = p.now().Add(p.leaseDuration)
+	return nil
+}
+
+// committedOf asks the node for its committed index.
+func (p *paxos) committedOf(node *client.Client) (int, error) {
+	response, err := node.QueryOne(&client.Committed{})
+	if err != nil {
+		return 0, err
+	}
+	if err := response.Err(); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(response.Message))
+}
@@ -0,0 +1,70 @@
+package paxos
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// committedPeer answers every connection with the committed index stored in committed.
+func committedPeer(t *testing.T, committed *int32) net.Listener {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					fmt.Fprintf(conn, "%d\n", atomic.LoadInt32(committed))
+				}
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestPaxos_TransferLeadership(t *testing.T) {
+	committed := int32(1)
+	peer := committedPeer(t, &committed)
+	defer peer.Close()
+	target := peer.Addr().String()
+	p, err := NewPaxos([]string{target}, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.TransferLeadership(target); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expected %s, got %v", ErrNotLeader, err)
+	}
+
+	atomic.StoreInt32(&p.leader, 1)
+	p.observeCommitted(3)
+	if err := p.TransferLeadership("127.0.0.1:1"); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("expected %s, got %v", ErrUnknownPeer, err)
+	}
+	if err := p.TransferLeadership(target); !errors.Is(err, ErrTargetBehind) {
+		t.Errorf("expected %s, got %v", ErrTargetBehind, err)
+	}
+	if _, isSelf := p.Leader(); !isSelf {
+		t.Error("the node has stepped down to the target behind")
+	}
+
+	atomic.StoreInt32(&committed, 3)
+	if err := p.TransferLeadership(target); err != nil {
+		t.Fatal(err)
+	}
+	if addr, isSelf := p.Leader(); isSelf || addr != target {
+		t.Errorf("expected the target leader, got %s %t", addr, isSelf)
+	}
+	if p.ElectionDue() {
+		t.Error("the node competes with the target")
+	}
+}
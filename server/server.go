@@ -3,10 +3,14 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	"github.com/tariel-x/stream/client"
 	"github.com/tariel-x/stream/stream"
@@ -15,17 +19,61 @@ import (
 type Server struct {
 	listenAddress string
 	handler       *stream.Handler
+	transport     Transport
+}
+
+// Transport listens for the connections of the clients on the address. The server reads the
+// newline-delimited messages from the accepted connections whatever the transport is.
+type Transport func(address string) (net.Listener, error)
+
+// TCPTransport listens on the plain TCP address.
+func TCPTransport(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// TLSTransport listens on the TCP address and accepts the TLS connections with the config.
+func TLSTransport(config *tls.Config) Transport {
+	return func(address string) (net.Listener, error) {
+		return tls.Listen("tcp", address, config)
+	}
+}
+
+// ListenerTransport serves the connections of the listener created before, the address is ignored.
+// Run closes the listener.
+func ListenerTransport(listener net.Listener) Transport {
+	return func(string) (net.Listener, error) {
+		return listener, nil
+	}
 }
 
 func NewServer(listenAddress string, handler *stream.Handler) (*Server, error) {
+	return NewTransportServer(listenAddress, handler, TCPTransport)
+}
+
+// NewTransportServer creates the server accepting the connections of the transport.
+func NewTransportServer(listenAddress string, handler *stream.Handler, transport Transport) (*Server, error) {
+	if transport == nil {
+		return nil, errors.New("nil transport")
+	}
 	return &Server{
 		listenAddress: listenAddress,
 		handler:       handler,
+		transport:     transport,
 	}, nil
 }
 
+// NewTLSServer creates the server accepting TLS connections. If the config verifies the client
+// certificates, the common name of the verified certificate is the identity of the requests,
+// see stream.IdentityOf.
+func NewTLSServer(listenAddress string, handler *stream.Handler, config *tls.Config) (*Server, error) {
+	if config == nil {
+		return nil, errors.New("nil TLS config")
+	}
+	return NewTransportServer(listenAddress, handler, TLSTransport(config))
+}
+
 func (server *Server) Run(ctx context.Context) error {
-	socket, err := net.Listen("tcp", server.listenAddress)
+	socket, err := server.transport(server.listenAddress)
 	if err != nil {
 		return err
 	}
@@ -65,9 +113,10 @@ func (server *Server) Run(ctx context.Context) error {
 }
 
 type Request struct {
-	message string
-	address string
-	name    string
+	message  string
+	address  string
+	name     string
+	identity string
 }
 
 func (r *Request) Message() string {
@@ -85,6 +134,26 @@ func (r *Request) Name() string {
 	return r.address
 }
 
+// Identity returns the common name of the verified TLS client certificate, it is empty for the plain
+// connections.
+func (r *Request) Identity() string {
+	return r.identity
+}
+
+// identityOf returns the common name of the verified client certificate of the TLS connection.
+// The handshake must be complete.
+func identityOf(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return ""
+	}
+	return chains[0][0].Subject.CommonName
+}
+
 func makeRequest(input, address string) (*Request, error) {
 	message := strings.TrimSpace(input)
 	return &Request{
@@ -93,21 +162,48 @@ func makeRequest(input, address string) (*Request, error) {
 	}, nil
 }
 
+// line is the response line or the request to flush the lines written before.
+type line struct {
+	message string
+	flush   bool
+}
+
 type Response struct {
-	messages chan string
+	lines  chan line
+	failed int32
 }
 
 func NewResponse() *Response {
-	return &Response{messages: make(chan string)}
+	return &Response{lines: make(chan line)}
 }
 
 func (r *Response) Push(message string) {
-	r.messages <- message
+	r.lines <- line{message: message}
 }
 
+// Flush makes the server write the buffered lines to the connection. The error reports the failed
+// write of the lines before.
+func (r *Response) Flush() error {
+	r.lines <- line{flush: true}
+	return r.Probe()
+}
+
+// Probe reports the client gone after the failed write, so the idle subscribers of the live
+// connections are kept.
+func (r *Response) Probe() error {
+	if atomic.LoadInt32(&r.failed) == 1 {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+// accept serves the requests of the connection one by one until the client closes it. The response
+// of a request is written whole before the next line is read, the one-shot clients close their writing
+// side after the request, see client.Connection.
 func (server *Server) accept(parent context.Context, conn net.Conn, errc chan error) {
 	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
+	defer server.handler.EndSession(conn.RemoteAddr().String())
 
 	closeListen := func() {
 		if err := conn.Close(); err != nil {
@@ -117,55 +213,126 @@ func (server *Server) accept(parent context.Context, conn net.Conn, errc chan er
 	}
 	defer closeListen()
 
-	rawinput, err := bufio.NewReader(conn).ReadString('\n')
+	reader := bufio.NewReader(conn)
+	for server.serve(ctx, conn, reader, errc) {
+	}
+}
+
+// serve reads the request from the connection and writes its response. It returns false if
+// the connection must be closed.
+func (server *Server) serve(ctx context.Context, conn net.Conn, reader *bufio.Reader, errc chan error) bool {
+	limit := server.handler.MaxMessageSize()
+	rawinput, err := readLine(reader, limit)
+	if errors.Is(err, stream.ErrMessageTooLarge) {
+		reject(conn, err)
+		return false
+	}
+	if err == io.EOF && rawinput == "" {
+		return false
+	}
 	if err != nil {
 		if _, err := conn.Write([]byte(err.Error() + "\n")); err != nil {
 			errc <- err
-			return
+			return false
 		}
 		errc <- err
-		return
+		return false
 	}
 
 	input, meta, err := server.extractMeta(rawinput)
 	if err != nil {
 		if _, err := conn.Write([]byte(err.Error() + "\n")); err != nil {
 			errc <- err
-			return
+			return false
 		}
 		errc <- err
-		return
+		return false
 	}
 	request, err := makeRequest(input, conn.RemoteAddr().String())
 	if err != nil {
 		if _, err := conn.Write([]byte(err.Error() + "\n")); err != nil {
 			log.Printf("error parsing query from %s: %s", conn.RemoteAddr().String(), err)
-			return
+			return false
 		}
-		return
+		return false
 	}
 	if name, ok := meta[client.MetaKeyName]; ok {
 		request.name = name
 	}
+	// The first read has completed the TLS handshake.
+	request.identity = identityOf(conn)
+	if size, ok := stream.PayloadSize(request.message); ok {
+		if size > limit-len(request.message) {
+			reject(conn, stream.ErrMessageTooLarge)
+			return false
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Printf("error reading payload from %s: %s", request.Name(), err)
+			return false
+		}
+		request.message += stream.PayloadSeparator + string(payload)
+	}
 
 	log.Printf("this <- %s %s\n", request.Name(), request.Message())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	response := NewResponse()
 	go func() {
-		defer close(response.messages)
-		if err = server.handler.Process(ctx, request, response); err != nil {
-			if _, err := conn.Write([]byte(err.Error() + "\n")); err != nil {
-				log.Println("error executing query", err)
-				return
-			}
-			return
+		defer close(response.lines)
+		if err := server.handler.Process(ctx, request, response); err != nil {
+			log.Printf("error executing query from %s: %s", request.Name(), err)
 		}
 	}()
-	for message := range response.messages {
-		log.Printf("this -> %s %s", request.Name(), message)
-		if _, err := conn.Write([]byte(message + "\n")); err != nil {
+	// The lines are buffered until the handler flushes them or the response is complete.
+	writer := bufio.NewWriter(conn)
+	for line := range response.lines {
+		var err error
+		if line.flush {
+			err = writer.Flush()
+		} else {
+			log.Printf("this -> %s %s", request.Name(), line.message)
+			_, err = writer.WriteString(line.message + "\n")
+		}
+		if err != nil {
 			log.Println("error writing to client", err)
-			return
+			atomic.StoreInt32(&response.failed, 1)
+			cancel()
+			// Unblock the handler until it notices the cancellation.
+			for range response.lines {
+			}
+			return false
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Println("error writing to client", err)
+		return false
+	}
+	return true
+}
+
+// readLine reads the line up to the limit of bytes and the line ending, the longer line is not
+// buffered whole and fails with stream.ErrMessageTooLarge.
+func readLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit+len("\r\n") {
+			return "", stream.ErrMessageTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
 		}
+		return string(line), err
+	}
+}
+
+// reject writes the error frame, the connection is closed after it.
+func reject(conn net.Conn, err error) {
+	frame := fmt.Sprintf("%s %s %s\n", client.CmdErr, stream.ErrorCode(err), err)
+	if _, err := conn.Write([]byte(frame)); err != nil {
+		log.Println("error writing to client", err)
 	}
 }
 
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+	"github.com/tariel-x/stream/log"
+	"github.com/tariel-x/stream/paxos"
+	"github.com/tariel-x/stream/stream"
+)
+
+// runServer starts the server on the free local port and returns its address.
+func runServer(t *testing.T, options ...stream.Option) string {
+	t.Helper()
+	l, err := log.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	px, err := paxos.NewPaxos(nil, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(l, px, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := socket.Addr().String()
+
+	server, err := NewTransportServer(address, h, ListenerTransport(socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.Run(ctx)
+	return address
+}
+
+// dial waits for the server started by runServer to listen.
+func dial(t *testing.T, address string) net.Conn {
+	t.Helper()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			return conn
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func query(t *testing.T, address, message string) string {
+	t.Helper()
+	conn := dial(t, address)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestServer_MaxMessageSize(t *testing.T) {
+	address := runServer(t, stream.WithMaxMessageSize(64))
+	tooLarge := client.CmdErr + " " + stream.ErrorCode(stream.ErrMessageTooLarge)
+
+	cases := []struct {
+		name    string
+		message string
+	}{
+		{name: "long line", message: "PUSH " + strings.Repeat("a", 4096) + "\n"},
+		{name: "huge payload", message: "PUSH $9223372036854775807\n"},
+		{name: "payload over limit", message: "PUSH $100\n" + strings.Repeat("a", 100)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := query(t, address, tc.message); !strings.HasPrefix(got, tooLarge) {
+				t.Errorf("got %q, want %q", got, tooLarge)
+			}
+		})
+	}
+
+	if got := query(t, address, "LEN\n"); got != "0" {
+		t.Errorf("LEN after rejections = %q, want 0", got)
+	}
+}
+
+func TestServer_Session(t *testing.T) {
+	address := runServer(t, stream.WithLogFactory(func(name string) (stream.Log, error) {
+		return log.NewLog()
+	}))
+	conn := dial(t, address)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, step := range []struct{ message, expected string }{
+		{(&client.Use{Stream: "s"}).String(), client.CmdOK},
+		{(&client.PushBatch{V: []string{"a"}}).String(), client.CmdOK + " 0"},
+		{client.CmdLen, "1"},
+	} {
+		if _, err := conn.Write([]byte(step.message + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(line); got != step.expected {
+			t.Errorf("%s: got %q, want %q", step.message, got, step.expected)
+		}
+	}
+
+	// The one-shot client gets the response of another stream and the end of it.
+	nodeClient, err := client.New(address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := nodeClient.QueryMany(&client.Len{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || strings.TrimSpace(responses[0].Message) != "0" {
+		t.Errorf("unexpected %v", responses)
+	}
+}
+
+func TestServer_Client(t *testing.T) {
+	address := runServer(t, stream.WithLogFactory(func(name string) (stream.Log, error) {
+		return log.NewLog()
+	}))
+	nodeClient, err := client.New(address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every message is sent over a new connection, the name keeps them in the same stream.
+	nodeClient.SetName("s")
+	conn := client.NewConn(client.NewTCPTransport(nodeClient))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	values := []string{"a", "b c", "d\ne"}
+	for _, v := range values {
+		if err := conn.Push(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if length, err := conn.Len(ctx); err != nil || length != len(values) {
+		t.Errorf("unexpected length %d %v", length, err)
+	}
+	if v, err := conn.Get(ctx, 2); err != nil || v != values[2] {
+		t.Errorf("unexpected value %q %v", v, err)
+	}
+
+	pullCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	pulled, err := conn.Pull(pullCtx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if got := <-pulled; got != v {
+			t.Errorf("pulled %q, want %q", got, v)
+		}
+	}
+}
+
+func TestServer_PartialReads(t *testing.T) {
+	address := runServer(t, stream.WithLogFactory(func(name string) (stream.Log, error) {
+		return log.NewLog()
+	}))
+	conn := dial(t, address)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// The message and its payload arrive in pieces.
+	for _, piece := range []string{"PU", "SH $3", "\na", "b", "c" + client.CmdLen, "\n"} {
+		if _, err := conn.Write([]byte(piece)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{client.CmdOK, "1"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(line); !strings.HasPrefix(got, expected) {
+			t.Errorf("got %q, want %q", got, expected)
+		}
+	}
+}
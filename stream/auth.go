@@ -0,0 +1,42 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+)
+
+// Authorizer decides whether the client may execute the command.
+type Authorizer interface {
+	// Allow returns an error if the command is forbidden for the request.
+	Allow(ctx context.Context, cmd string, req ServerRequest) error
+}
+
+// AllowAll permits every command.
+type AllowAll struct{}
+
+func (a *AllowAll) Allow(ctx context.Context, cmd string, req ServerRequest) error {
+	return nil
+}
+
+// IdentifiedRequest is the ServerRequest carrying the identity verified by the transport, such as
+// the subject of the mutual TLS client certificate. Unlike Name() the identity cannot be set by the client.
+type IdentifiedRequest interface {
+	ServerRequest
+	Identity() string
+}
+
+// IdentityOf returns the verified identity of the request or the empty string if the transport
+// does not provide one.
+func IdentityOf(req ServerRequest) string {
+	if identified, ok := req.(IdentifiedRequest); ok {
+		return identified.Identity()
+	}
+	return ""
+}
+
+func (h *Handler) authorize(ctx context.Context, cmd string, message ServerRequest) error {
+	if err := h.authorizer.Allow(ctx, cmd, message); err != nil {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, err)
+	}
+	return nil
+}
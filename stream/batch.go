@@ -0,0 +1,75 @@
+package stream
+
+import (
+	"fmt"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// unbatchedCmds may not be executed in BATCH: they stream the values until canceled.
+var unbatchedCmds = map[string]struct{}{
+	client.CmdBatch: {},
+	client.CmdPull:  {},
+	client.CmdWatch: {},
+}
+
+// subRequest is the command of BATCH sent with the connection of the batch.
+type subRequest struct {
+	ServerRequest
+	message string
+}
+
+func (r *subRequest) Message() string {
+	return r.message
+}
+
+func (r *subRequest) Identity() string {
+	return IdentityOf(r.ServerRequest)
+}
+
+// collector keeps the lines pushed by the command of the batch.
+type collector struct {
+	lines []string
+}
+
+func (c *collector) Push(message string) {
+	c.lines = append(c.lines, message)
+}
+
+// Batch executes every command through the middlewares like a separate message and pushes its lines
+// after the "BATCH <i> <k>" header with the number of lines k. A failed command does not stop the rest,
+// with ATOMIC the commands after it are answered with ErrAborted without execution. Nothing is rolled back.
+func (h *Handler) Batch(request *BatchRequest, response ServerResponse) error {
+	var failed bool
+	for i, command := range request.commands {
+		result := &collector{}
+		var err error
+		switch {
+		case failed:
+			err = ErrAborted
+			pushError(result, err)
+		case h.unbatched(command):
+			err = ErrIncorrectCmd
+			pushError(result, err)
+		default:
+			err = h.process(request.ctx, &subRequest{ServerRequest: request.source, message: command}, result)
+		}
+		failed = failed || (err != nil && request.atomic)
+		response.Push(fmt.Sprintf("%s %d %d", client.CmdBatch, i, len(result.lines)))
+		for _, line := range result.lines {
+			response.Push(line)
+		}
+	}
+	return nil
+}
+
+// unbatched reports whether the command may not be executed in BATCH. The malformed command
+// is executed to fail the usual way.
+func (h *Handler) unbatched(command string) bool {
+	parsed, err := parseRawMessage(command, h.aliases)
+	if err != nil {
+		return false
+	}
+	_, ok := unbatchedCmds[parsed.cmd]
+	return ok
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+)
+
+// Checksum computes the checksum of the value stored with it, see WithChecksums.
+type Checksum func([]byte) uint32
+
+// checksumSize is the length of the hex checksum preceding the stored value.
+const checksumSize = 8
+
+// checksumCodec is the Codec storing the hex checksum before the value and verifying it on the reads,
+// the mismatch fails the read with ErrCorruptEntry.
+type checksumCodec struct {
+	checksum Checksum
+}
+
+func (c checksumCodec) Encode(v []byte) ([]byte, error) {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, c.checksum(v))
+	encoded := make([]byte, checksumSize, checksumSize+len(v))
+	hex.Encode(encoded, sum)
+	return append(encoded, v...), nil
+}
+
+func (c checksumCodec) Decode(v []byte) ([]byte, error) {
+	if len(v) < checksumSize {
+		return nil, ErrCorruptEntry
+	}
+	sum := make([]byte, 4)
+	if _, err := hex.Decode(sum, v[:checksumSize]); err != nil {
+		return nil, ErrCorruptEntry
+	}
+	value := v[checksumSize:]
+	if binary.BigEndian.Uint32(sum) != c.checksum(value) {
+		return nil, ErrCorruptEntry
+	}
+	return value, nil
+}
+
+// chainCodec encodes the values with the outer codec and then with the inner one, the reads go the
+// other way, so the checksums cover the values as they are stored.
+type chainCodec struct {
+	outer, inner Codec
+}
+
+func (c chainCodec) Encode(v []byte) ([]byte, error) {
+	encoded, err := c.outer.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.inner.Encode(encoded)
+}
+
+func (c chainCodec) Decode(v []byte) ([]byte, error) {
+	decoded, err := c.inner.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.outer.Decode(decoded)
+}
+
+// CRC32 is the default Checksum, the IEEE CRC-32 of the value.
+func CRC32(v []byte) uint32 {
+	return crc32.ChecksumIEEE(v)
+}
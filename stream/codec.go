@@ -0,0 +1,272 @@
+package stream
+
+import (
+	"context"
+	"encoding/base64"
+)
+
+// Codec transforms the values at rest, e.g. encrypts or compresses them. The values are encoded
+// before they are set to the log and decoded when they are read back, the clients and the peers
+// always see the original values. CompareAndSet compares the encoded values, so the codec used with
+// it must encode the same value the same way.
+type Codec interface {
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+// Base64Codec is the example Codec storing the values in the standard base64 encoding.
+type Base64Codec struct{}
+
+func (Base64Codec) Encode(v []byte) ([]byte, error) {
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(v)))
+	base64.StdEncoding.Encode(encoded, v)
+	return encoded, nil
+}
+
+func (Base64Codec) Decode(v []byte) ([]byte, error) {
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(v)))
+	n, err := base64.StdEncoding.Decode(decoded, v)
+	if err != nil {
+		return nil, err
+	}
+	return decoded[:n], nil
+}
+
+// encoded wraps the log with the codec set by WithCodec and the checksums set by WithChecksums, without
+// them the log is returned as is.
+func (h *Handler) encoded(lg Log) Log {
+	codec := h.codec
+	if h.checksum != nil {
+		checksums := checksumCodec{checksum: h.checksum}
+		if codec == nil {
+			codec = checksums
+		} else {
+			codec = chainCodec{outer: codec, inner: checksums}
+		}
+	}
+	if codec == nil || lg == nil {
+		return lg
+	}
+	return &codecLog{Log: lg, codec: codec}
+}
+
+// codecLog is the Log encoding the values on the writes and decoding them on the reads. The methods
+// not dealing with the values are passed to the underlying log, the snapshots keep the encoded values.
+type codecLog struct {
+	Log
+	codec Codec
+}
+
+func (l *codecLog) encode(v string) (string, error) {
+	encoded, err := l.codec.Encode([]byte(v))
+	return string(encoded), err
+}
+
+func (l *codecLog) decode(v string) (string, error) {
+	decoded, err := l.codec.Decode([]byte(v))
+	return string(decoded), err
+}
+
+func (l *codecLog) decodeAll(vs []string, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	decoded := make([]string, len(vs))
+	for i, v := range vs {
+		if decoded[i], err = l.decode(v); err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+// decodeChan decodes the values of the subscription. The value failed to decode closes the
+// subscription, the rest of the values are discarded until the log closes the channel.
+func (l *codecLog) decodeChan(ctx context.Context, results chan string) chan string {
+	decoded := make(chan string, cap(results))
+	go func() {
+		defer close(decoded)
+		l.forward(ctx, results, decoded)
+		for range results {
+		}
+	}()
+	return decoded
+}
+
+// forward sends the decoded values until the one fails to decode or ctx is done.
+func (l *codecLog) forward(ctx context.Context, results <-chan string, decoded chan<- string) {
+	for result := range results {
+		v, err := l.decode(result)
+		if err != nil {
+			return
+		}
+		select {
+		case decoded <- v:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *codecLog) Set(ctx context.Context, n int, v string) error {
+	encoded, err := l.encode(v)
+	if err != nil {
+		return err
+	}
+	return l.Log.Set(ctx, n, encoded)
+}
+
+func (l *codecLog) SetID(ctx context.Context, n int, id, v string) error {
+	encoded, err := l.encode(v)
+	if err != nil {
+		return err
+	}
+	return l.Log.SetID(ctx, n, id, encoded)
+}
+
+func (l *codecLog) SetBatch(ctx context.Context, vs []string) (int, error) {
+	encoded := make([]string, len(vs))
+	for i, v := range vs {
+		var err error
+		if encoded[i], err = l.encode(v); err != nil {
+			return 0, err
+		}
+	}
+	return l.Log.SetBatch(ctx, encoded)
+}
+
+func (l *codecLog) SetBlocking(ctx context.Context, v string) (int, error) {
+	encoded, err := l.encode(v)
+	if err != nil {
+		return 0, err
+	}
+	return l.Log.SetBlocking(ctx, encoded)
+}
+
+func (l *codecLog) CompareAndSet(ctx context.Context, n int, expected, new string) (bool, error) {
+	encodedExpected, err := l.encode(expected)
+	if err != nil {
+		return false, err
+	}
+	encodedNew, err := l.encode(new)
+	if err != nil {
+		return false, err
+	}
+	return l.Log.CompareAndSet(ctx, n, encodedExpected, encodedNew)
+}
+
+func (l *codecLog) GetMany(ctx context.Context, ns []int) ([]string, []bool, error) {
+	vs, found, err := l.Log.GetMany(ctx, ns)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range vs {
+		if !found[i] {
+			continue
+		}
+		if vs[i], err = l.decode(vs[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return vs, found, nil
+}
+
+func (l *codecLog) GetByID(ctx context.Context, id string) (string, error) {
+	v, err := l.Log.GetByID(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return l.decode(v)
+}
+
+func (l *codecLog) Get(ctx context.Context, n int) ([]string, error) {
+	return l.decodeAll(l.Log.Get(ctx, n))
+}
+
+func (l *codecLog) Tail(ctx context.Context, n int) ([]string, error) {
+	return l.decodeAll(l.Log.Tail(ctx, n))
+}
+
+func (l *codecLog) Range(ctx context.Context, from, to int) ([]string, error) {
+	return l.decodeAll(l.Log.Range(ctx, from, to))
+}
+
+func (l *codecLog) Pull(ctx context.Context, n, buffer int) (chan string, error) {
+	results, err := l.Log.Pull(ctx, n, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return l.decodeChan(ctx, results), nil
+}
+
+func (l *codecLog) Follow(ctx context.Context, n, buffer int) (chan string, error) {
+	results, err := l.Log.Follow(ctx, n, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return l.decodeChan(ctx, results), nil
+}
+
+func (l *codecLog) Coalesce(ctx context.Context, n, buffer int, follow bool) (chan string, error) {
+	results, err := l.Log.Coalesce(ctx, n, buffer, follow)
+	if err != nil {
+		return nil, err
+	}
+	return l.decodeChan(ctx, results), nil
+}
+
+func (l *codecLog) Iterate(ctx context.Context, fn func(index int, value string) error) error {
+	return l.Log.Iterate(ctx, func(index int, value string) error {
+		v, err := l.decode(value)
+		if err != nil {
+			return err
+		}
+		return fn(index, v)
+	})
+}
+
+func (l *codecLog) IterateMeta(ctx context.Context, fn func(meta EntryMeta) error) error {
+	return l.Log.IterateMeta(ctx, func(meta EntryMeta) error {
+		v, err := l.decode(meta.V)
+		if err != nil {
+			return err
+		}
+		meta.V = v
+		return fn(meta)
+	})
+}
+
+func (l *codecLog) Metadata(ctx context.Context, n int) (EntryMeta, error) {
+	meta, err := l.Log.Metadata(ctx, n)
+	if err != nil {
+		return meta, err
+	}
+	meta.V, err = l.decode(meta.V)
+	return meta, err
+}
+
+func (l *codecLog) WaitFor(ctx context.Context, n int) (string, error) {
+	v, err := l.Log.WaitFor(ctx, n)
+	if err != nil {
+		return "", err
+	}
+	return l.decode(v)
+}
+
+func (l *codecLog) First(ctx context.Context) (int, string, error) {
+	n, v, err := l.Log.First(ctx)
+	if err != nil {
+		return n, "", err
+	}
+	v, err = l.decode(v)
+	return n, v, err
+}
+
+func (l *codecLog) Last(ctx context.Context) (int, string, error) {
+	n, v, err := l.Log.Last(ctx)
+	if err != nil {
+		return n, "", err
+	}
+	v, err = l.decode(v)
+	return n, v, err
+}
@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// MaxBatchSize is the maximal number of values in the single compressed PULL line and
+// BatchLinger is the maximal time the first value of the batch waits for the others.
+const (
+	MaxBatchSize = 1024
+	BatchLinger  = 5 * time.Millisecond
+)
+
+// pushBatches pushes the values arrived within BatchLinger as a single compressed line,
+// see client.EncodeBatch for the format.
+func pushBatches(ctx context.Context, results chan string, response ServerResponse, idle *idleWatch, sub *subscription) error {
+	var buf bytes.Buffer
+	for {
+		var batch []string
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case result, ok := <-results:
+			if !ok {
+				return nil
+			}
+			batch = append(batch, result)
+		case <-idle.C():
+			if err := idle.expired(); err != nil {
+				return err
+			}
+			continue
+		}
+		linger := time.NewTimer(BatchLinger)
+	collect:
+		for len(batch) < MaxBatchSize {
+			select {
+			case <-ctx.Done():
+				linger.Stop()
+				return ctx.Err()
+			case result, ok := <-results:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, result)
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+		buf.Reset()
+		if err := client.EncodeBatch(&buf, batch); err != nil {
+			return err
+		}
+		response.Push(buf.String())
+		if err := flush(response); err != nil {
+			return err
+		}
+		sub.pushed(len(batch))
+		idle.active()
+	}
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// categoryNames name the rate limit categories in CONFIG.
+var categoryNames = map[Category]string{
+	CategoryRead:  "read",
+	CategoryWrite: "write",
+	CategoryPaxos: "paxos",
+}
+
+// Config pushes the "key=value" line for every option set with NewHandler. The codec and the
+// snapshot path are reported as set only, the deployments may restrict the command with the Authorizer.
+func (h *Handler) Config(request Request, response ServerResponse) error {
+	if err := request.validate(client.CmdConfig, 0, 0); err != nil {
+		return err
+	}
+	push := func(key string, value interface{}) {
+		response.Push(fmt.Sprintf("%s=%v", key, value))
+	}
+	push(client.ConfigMaxMessageSize, h.maxMessageSize)
+	push(client.ConfigMaxValueSize, h.maxValueSize)
+	push(client.ConfigMaxSubscribers, h.maxSubscribers)
+	push(client.ConfigIdleTimeout, h.idleTimeout)
+	push(client.ConfigCommitAttempts, h.commitAttempts)
+	policy := h.slowPolicy
+	if policy == "" {
+		policy = SlowDrop
+	}
+	push(client.ConfigSlowPolicy, policy)
+	for _, category := range []Category{CategoryRead, CategoryWrite, CategoryPaxos} {
+		limit := client.ConfigOff
+		if limiter, ok := h.limiters[category]; ok {
+			limit = fmt.Sprintf("%g/%g", limiter.rate, limiter.burst)
+		}
+		push(client.ConfigRateLimit+categoryNames[category], limit)
+	}
+	push(client.ConfigLogRedaction, h.redactLogs)
+	push(client.ConfigPanicRecovery, h.recoverPanics)
+	push(client.ConfigNamedStreams, h.logFactory != nil)
+	push(client.ConfigCodec, h.codec != nil)
+	push(client.ConfigChecksums, h.checksum != nil)
+	dedup := client.ConfigOff
+	if h.dedup != nil {
+		dedup = fmt.Sprintf("%d/%s", h.dedup.size, h.dedup.window)
+	}
+	push(client.ConfigPaxosDedup, dedup)
+	push(client.ConfigDeadLetter, h.deadLetters != nil)
+	push(client.ConfigReadReplica, h.replica)
+	push(client.ConfigUTF8Validation, h.utf8Only)
+	compatible := make([]string, 0, len(h.compatible))
+	for cmd := range h.compatible {
+		compatible = append(compatible, cmd)
+	}
+	sort.Strings(compatible)
+	push(client.ConfigForwardCompatible, strings.Join(compatible, ","))
+	snapshotPath := ""
+	if h.snapshotPath != "" {
+		snapshotPath = client.ConfigRedacted
+	}
+	push(client.ConfigSnapshotPath, snapshotPath)
+	return nil
+}
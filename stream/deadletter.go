@@ -0,0 +1,16 @@
+package stream
+
+import "context"
+
+// DeadLetter receives the write failed to process, e.g. the PUSH the log has failed to store, so
+// the operator can keep it for the retry or the inspection. It runs in its own goroutine after the
+// error has been pushed to the client, ctx is the one of the request and may be already done.
+type DeadLetter func(ctx context.Context, req ServerRequest, err error)
+
+// deadLetter passes the failed write command to the hook set with WithDeadLetter without waiting for it.
+func (h *Handler) deadLetter(ctx context.Context, message ServerRequest, cmd string, err error) {
+	if h.deadLetters == nil || cmd == "" || CommandCategory(cmd) != CategoryWrite {
+		return
+	}
+	go h.deadLetters(ctx, message, err)
+}
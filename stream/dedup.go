@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultPaxosDedupSize is the number of the last Paxos messages remembered by WithPaxosDedup.
+const DefaultPaxosDedupSize = 256
+
+// DefaultPaxosDedupWindow is the time the response to the Paxos message is reused by WithPaxosDedup.
+const DefaultPaxosDedupWindow = time.Second
+
+// dedupKey identifies the Paxos message: the proposal number and the value ID for ACCEPT, the proposer
+// for PREPARE.
+type dedupKey struct {
+	cmd string
+	n   int
+	id  string
+}
+
+// dedupEntry is the response to the Paxos message remembered at the time.
+type dedupEntry struct {
+	key      dedupKey
+	response []string
+	at       time.Time
+}
+
+// paxosDedup is the LRU of the responses to the last Paxos messages. The message retried by the network
+// within the window is answered with the remembered response without calling the Paxos again.
+type paxosDedup struct {
+	size   int
+	window time.Duration
+	now    func() time.Time
+
+	m       sync.Mutex
+	order   *list.List
+	entries map[dedupKey]*list.Element
+}
+
+func newPaxosDedup(size int, window time.Duration) *paxosDedup {
+	return &paxosDedup{
+		size:    size,
+		window:  window,
+		now:     time.Now,
+		order:   list.New(),
+		entries: map[dedupKey]*list.Element{},
+	}
+}
+
+// answer pushes the remembered response to the message seen within the window, otherwise it runs fn
+// and remembers the lines it pushes. The nil dedup always runs fn.
+func (d *paxosDedup) answer(key dedupKey, response ServerResponse, fn func(ServerResponse)) {
+	if d == nil {
+		fn(response)
+		return
+	}
+	if lines, ok := d.get(key); ok {
+		for _, line := range lines {
+			response.Push(line)
+		}
+		return
+	}
+	recorder := &recordingResponse{ServerResponse: response}
+	fn(recorder)
+	d.put(key, recorder.lines)
+}
+
+func (d *paxosDedup) get(key dedupKey) ([]string, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	element, ok := d.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*dedupEntry)
+	if d.now().Sub(entry.at) > d.window {
+		d.order.Remove(element)
+		delete(d.entries, key)
+		return nil, false
+	}
+	d.order.MoveToFront(element)
+	return entry.response, true
+}
+
+func (d *paxosDedup) put(key dedupKey, response []string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if element, ok := d.entries[key]; ok {
+		d.order.Remove(element)
+	}
+	d.entries[key] = d.order.PushFront(&dedupEntry{key: key, response: response, at: d.now()})
+	for d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+}
+
+// recordingResponse remembers the pushed lines.
+type recordingResponse struct {
+	ServerResponse
+	lines []string
+}
+
+func (r *recordingResponse) Push(message string) {
+	r.lines = append(r.lines, message)
+	r.ServerResponse.Push(message)
+}
@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"sync/atomic"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// Drain makes the node read-only: the writes fail with ErrReadOnly until UNDRAIN. DRAIN is
+// an administrative command, deployments should allow it to the operators only with the Authorizer.
+func (h *Handler) Drain(response ServerResponse) error {
+	atomic.StoreInt32(&h.drained, 1)
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// Undrain restores the writes.
+func (h *Handler) Undrain(response ServerResponse) error {
+	atomic.StoreInt32(&h.drained, 0)
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// Drained reports whether the node is read-only.
+func (h *Handler) Drained() bool {
+	return atomic.LoadInt32(&h.drained) == 1
+}
+
+// checkDrained rejects the writes of the drained node. SET is rejected as well, so the node
+// does not apply the values chosen by the quorum until UNDRAIN.
+func (h *Handler) checkDrained(cmd string) error {
+	if !h.Drained() {
+		return nil
+	}
+	if CommandCategory(cmd) == CategoryWrite || cmd == client.CmdSet {
+		return ErrReadOnly
+	}
+	return nil
+}
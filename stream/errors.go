@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/tariel-x/stream/client"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrUnknownCmd, client.CodeUnknownCmd},
+	{ErrIncorrectCmd, client.CodeIncorrectCmd},
+	{ErrOutOfRange, client.CodeOutOfRange},
+	{strconv.ErrSyntax, client.CodeIncorrectCmd},
+	{strconv.ErrRange, client.CodeIncorrectCmd},
+	{ErrShuttingDown, client.CodeShuttingDown},
+	{ErrUnauthorized, client.CodeUnauthorized},
+	{ErrInternal, client.CodeInternalError},
+	{context.DeadlineExceeded, client.CodeTimeout},
+	{context.Canceled, client.CodeCanceled},
+	{ErrMessageTooLarge, client.CodeMessageTooLarge},
+	{ErrQuorumFailed, client.CodeQuorumFailed},
+	{ErrRateLimited, client.CodeRateLimited},
+	{ErrEmptyLog, client.CodeEmptyLog},
+	{ErrMissingValue, client.CodeMissingValue},
+	{ErrReadOnly, client.CodeReadOnly},
+	{ErrValueTooLarge, client.CodeValueTooLarge},
+	{ErrNotFound, client.CodeNotFound},
+	{ErrOverflow, client.CodeOverflow},
+	{ErrIdleTimeout, client.CodeIdleTimeout},
+	{ErrAborted, client.CodeAborted},
+	{ErrCorruptEntry, client.CodeCorruptEntry},
+	{ErrTooManySubscribers, client.CodeTooManySubscribers},
+	{ErrInvalidEncoding, client.CodeInvalidEncoding},
+}
+
+// ArgError is the invalid argument ArgIndex of the command. The underlying error such as
+// *strconv.NumError is available with errors.Is and errors.As.
+type ArgError struct {
+	Cmd        string
+	ArgIndex   int
+	Raw        string
+	Underlying error
+}
+
+func (e *ArgError) Error() string {
+	switch {
+	case errors.Is(e.Underlying, strconv.ErrSyntax):
+		return fmt.Sprintf("argument %d of %s is not an integer: %q", e.ArgIndex, e.Cmd, e.Raw)
+	case errors.Is(e.Underlying, strconv.ErrRange):
+		return fmt.Sprintf("argument %d of %s is out of range: %q", e.ArgIndex, e.Cmd, e.Raw)
+	default:
+		return fmt.Sprintf("invalid argument %d of %s %q: %s", e.ArgIndex, e.Cmd, e.Raw, e.Underlying)
+	}
+}
+
+func (e *ArgError) Unwrap() error {
+	return e.Underlying
+}
+
+// PartialWriteError is returned by Log.SetBatch failed after the first Written values have been set.
+type PartialWriteError struct {
+	Written int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("%d values written: %s", e.Written, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the machine-readable code of the error.
+func ErrorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return client.CodeInternalError
+}
+
+// pushError pushes the error frame in the encoding of the response.
+func pushError(response ServerResponse, err error) {
+	if r, ok := response.(*jsonResponse); ok {
+		r.pushError(err)
+		return
+	}
+	response.Push(errorResponse(err))
+}
+
+func errorResponse(err error) string {
+	return fmt.Sprintf("%s %s %s", client.CmdErr, ErrorCode(err), err.Error())
+}
@@ -0,0 +1,71 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// exportEntry is the NDJSON line of EXPORT.
+type exportEntry struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+type ExportRequest struct {
+	Request
+	csv bool
+}
+
+// NewExportRequest parses EXPORT [NDJSON|CSV], NDJSON is the default.
+func NewExportRequest(request Request) (*ExportRequest, error) {
+	if err := request.validate(client.CmdExport, 0, 1); err != nil {
+		return nil, err
+	}
+	export := &ExportRequest{Request: request}
+	if len(request.args) == 0 {
+		return export, nil
+	}
+	switch {
+	case strings.EqualFold(request.args[0], client.ExportNDJSON):
+	case strings.EqualFold(request.args[0], client.ExportCSV):
+		export.csv = true
+	default:
+		return nil, ErrIncorrectCmd
+	}
+	return export, nil
+}
+
+// Export pushes every value of the local log with its index and Paxos ID as the JSON object per line,
+// or as the CSV record after the "index,id,value" header. The lines are framed like the values, so the
+// CSV records of the values with line breaks stay whole. The values and their IDs are read in one pass
+// with IterateMeta, so the values removed during the export are skipped like with Iterate.
+func (h *Handler) Export(request *ExportRequest, response ServerResponse) error {
+	var buffer bytes.Buffer
+	var records *csv.Writer
+	if request.csv {
+		records = csv.NewWriter(&buffer)
+		response.Push("index,id,value")
+	}
+	return request.log.IterateMeta(request.ctx, func(meta EntryMeta) error {
+		buffer.Reset()
+		if records != nil {
+			if err := records.Write([]string{strconv.Itoa(meta.N), meta.ID, meta.V}); err != nil {
+				return err
+			}
+			records.Flush()
+			if err := records.Error(); err != nil {
+				return err
+			}
+		} else if err := json.NewEncoder(&buffer).Encode(exportEntry{Index: meta.N, ID: meta.ID, Value: meta.V}); err != nil {
+			return err
+		}
+		response.Push(client.FrameValue(strings.TrimSuffix(buffer.String(), "\n")))
+		return nil
+	})
+}
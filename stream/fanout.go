@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultFanoutBuffer is the number of values queued for the FOLLOW subscriber of the shared
+// subscription if PULL sets no buffer.
+const DefaultFanoutBuffer = 1024
+
+// fanoutKey identifies the shared subscription: the FOLLOW subscribers of the same stream and index get
+// the same values. The stream is keyed by the name, the Log implementation may be not comparable.
+type fanoutKey struct {
+	stream string
+	n      int
+}
+
+// fanouts are the shared subscriptions of the FOLLOW subscribers.
+type fanouts struct {
+	m      sync.Mutex
+	shared map[fanoutKey]*fanout
+}
+
+// fanout is the single Log.Follow subscription broadcasting every value to its subscribers. Like
+// the log it drops the subscriber whose buffer is full instead of waiting for it.
+type fanout struct {
+	cancel      context.CancelFunc
+	subscribers map[chan string]struct{}
+}
+
+// follow subscribes to the new values of the log of the stream from the index n with the shared
+// subscription. The channel is closed when ctx is done, the subscriber is dropped or the log closes
+// the subscription.
+func (f *fanouts) follow(ctx context.Context, stream string, lg Log, n, buffer int) (chan string, error) {
+	if buffer == 0 {
+		buffer = DefaultFanoutBuffer
+	}
+	key := fanoutKey{stream: stream, n: n}
+	subscriber := make(chan string, buffer)
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	shared, ok := f.shared[key]
+	if !ok {
+		followCtx, cancel := context.WithCancel(context.Background())
+		results, err := lg.Follow(followCtx, n, 0)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		shared = &fanout{cancel: cancel, subscribers: map[chan string]struct{}{}}
+		f.shared[key] = shared
+		go f.broadcast(key, shared, results)
+	}
+	shared.subscribers[subscriber] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		f.leave(key, shared, subscriber)
+	}()
+	return subscriber, nil
+}
+
+// broadcast sends the values of the shared subscription to the subscribers until the log closes it.
+func (f *fanouts) broadcast(key fanoutKey, shared *fanout, results chan string) {
+	for result := range results {
+		f.m.Lock()
+		for subscriber := range shared.subscribers {
+			select {
+			case subscriber <- result:
+			default:
+				delete(shared.subscribers, subscriber)
+				close(subscriber)
+			}
+		}
+		f.m.Unlock()
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	for subscriber := range shared.subscribers {
+		close(subscriber)
+	}
+	shared.subscribers = nil
+	if f.shared[key] == shared {
+		delete(f.shared, key)
+	}
+	shared.cancel()
+}
+
+// leave removes the subscriber, the last one stops the shared subscription.
+func (f *fanouts) leave(key fanoutKey, shared *fanout, subscriber chan string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if _, ok := shared.subscribers[subscriber]; ok {
+		delete(shared.subscribers, subscriber)
+		close(subscriber)
+	}
+	if len(shared.subscribers) == 0 && f.shared[key] == shared {
+		delete(f.shared, key)
+		shared.cancel()
+	}
+}
@@ -0,0 +1,81 @@
+package stream
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// filters are the built-in predicates of SUBF selected by the keyword.
+var filters = map[string]func(v, pattern string) bool{
+	client.FilterPrefix:   strings.HasPrefix,
+	client.FilterSuffix:   strings.HasSuffix,
+	client.FilterContains: strings.Contains,
+}
+
+// NewSubscribeFilterRequest parses SUBF <n> [PREFIX|SUFFIX|CONTAINS] <pattern> into the PULL forwarding
+// only the matching values, the prefix filter is the default.
+func NewSubscribeFilterRequest(request Request) (*PullRequest, error) {
+	if err := request.validate(client.CmdSubscribeFilter, 2, 3); err != nil {
+		return nil, err
+	}
+	n, err := request.indexArg(0)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseFilter(request.args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &PullRequest{Request: request, n: n, filter: filter}, nil
+}
+
+// parseFilter parses [PREFIX|SUFFIX|CONTAINS] <pattern> into the predicate of the values.
+func parseFilter(args []string) (func(v string) bool, error) {
+	match, pattern := filters[client.FilterPrefix], args[0]
+	if len(args) == 2 {
+		var ok bool
+		if match, ok = filters[strings.ToUpper(args[0])]; !ok {
+			return nil, ErrIncorrectCmd
+		}
+		pattern = args[1]
+	}
+	return func(v string) bool {
+		return match(v, pattern)
+	}, nil
+}
+
+type CountIfRequest struct {
+	Request
+	filter func(v string) bool
+}
+
+// NewCountIfRequest parses COUNTIF [PREFIX|SUFFIX|CONTAINS] <pattern> with the filters of SUBF.
+func NewCountIfRequest(request Request) (*CountIfRequest, error) {
+	if err := request.validate(client.CmdCountIf, 1, 2); err != nil {
+		return nil, err
+	}
+	filter, err := parseFilter(request.args)
+	if err != nil {
+		return nil, err
+	}
+	return &CountIfRequest{Request: request, filter: filter}, nil
+}
+
+// CountIf answers the number of the values of the local log matching the filter, the client saves
+// pulling all of them to count.
+func (h *Handler) CountIf(request *CountIfRequest, response ServerResponse) error {
+	count := 0
+	err := request.log.Iterate(request.ctx, func(index int, value string) error {
+		if request.filter(value) {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	response.Push(strconv.Itoa(count))
+	return nil
+}
@@ -0,0 +1,29 @@
+package stream
+
+// Flusher is the ServerResponse buffering the pushed lines. PULL flushes it after every value and
+// keepalive, so the subscriber gets them without waiting for more lines. The error means the client is gone.
+type Flusher interface {
+	Flush() error
+}
+
+// Closer is the ServerResponse told that the response is complete. Process closes it after the last
+// line including the error frame.
+type Closer interface {
+	Close() error
+}
+
+// flush flushes the response buffering the lines, the other responses deliver every line at once.
+func flush(response ServerResponse) error {
+	if flusher, ok := response.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// closeResponse signals the end of the response able to take it.
+func closeResponse(response ServerResponse) error {
+	if closer, ok := response.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
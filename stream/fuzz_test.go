@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package stream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tariel-x/stream/client"
+)
+
+func FuzzParseRawMessage(f *testing.F) {
+	for _, seed := range []string{
+		"", "\n", "   ", "PUSH a", `PUSH "a b" key DURABLE`, "PUSH $3\r\na\nb", "PUSH $3 timeout=20\r\nabc",
+		`PUSH "wait timeout=now"`, "WATCH 5 timeout=100", `{"cmd":"push","args":["a"]}`, "BATCH 1 $3\r\nLEN",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, message string) {
+		parsed, err := parseRawMessage(message, DefaultAliases)
+		if err != nil {
+			if parsed != nil {
+				t.Errorf("%q: the request with the error %v", message, err)
+			}
+		} else if _, ok := availableCmds[parsed.cmd]; !ok {
+			t.Errorf("%q: unknown command %q", message, parsed.cmd)
+		}
+		if strings.Trim(message, " \t\r\n") == "" && err != ErrIncorrectCmd {
+			t.Errorf("%q: expected %s, got %v", message, ErrIncorrectCmd, err)
+		}
+
+		// Any value survives the client encoding.
+		parsed, err = parseRawMessage((&client.Push{V: message}).String(), nil)
+		if err != nil {
+			t.Fatalf("%q: %s", message, err)
+		}
+		request, err := NewPushRequest(*parsed)
+		if err != nil || request.v != message {
+			t.Errorf("%q: unexpected %+v %v", message, request, err)
+		}
+	})
+}
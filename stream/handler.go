@@ -3,26 +3,94 @@ package stream
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/tariel-x/stream/client"
 )
 
 var (
-	ErrUnknownCmd   = errors.New("unknown cmd")
-	ErrIncorrectCmd = errors.New("incorrect cmd")
+	ErrUnknownCmd      = errors.New("unknown cmd")
+	ErrIncorrectCmd    = errors.New("incorrect cmd")
+	ErrOutOfRange      = errors.New("out of range")
+	ErrShuttingDown    = errors.New("shutting down")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrInternal        = errors.New("internal error")
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrQuorumFailed    = errors.New("quorum failed")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrEmptyLog        = errors.New("empty log")
+	// ErrMissingValue is returned for PUSH and COMMIT without the value. The empty value is
+	// a regular one and must be quoted: PUSH "".
+	ErrMissingValue  = errors.New("missing value")
+	ErrReadOnly      = errors.New("read only")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrNotFound      = errors.New("not found")
+	ErrOverflow      = errors.New("subscriber is too slow")
+	ErrIdleTimeout   = errors.New("subscriber is idle")
+	ErrAborted       = errors.New("aborted after the failed command")
+	ErrCorruptEntry  = errors.New("checksum mismatch of the stored value")
+	// ErrTooManySubscribers rejects PULL and WATCH over the limit set with WithMaxSubscribers.
+	ErrTooManySubscribers = errors.New("too many subscribers")
+	// ErrInvalidEncoding rejects the value which is not valid UTF-8, see WithUTF8Validation.
+	ErrInvalidEncoding = errors.New("value is not valid UTF-8")
 
 	ResponseOK = "ok"
 
 	availableCmds = map[string]struct{}{
-		client.CmdPush:    {},
-		client.CmdPull:    {},
-		client.CmdGet:     {},
-		client.CmdStatus:  {},
-		client.CmdPrepare: {},
-		client.CmdAccept:  {},
-		client.CmdSet:     {},
+		client.CmdPush:            {},
+		client.CmdPull:            {},
+		client.CmdGet:             {},
+		client.CmdStatus:          {},
+		client.CmdPrepare:         {},
+		client.CmdAccept:          {},
+		client.CmdSet:             {},
+		client.CmdDelete:          {},
+		client.CmdLen:             {},
+		client.CmdPeek:            {},
+		client.CmdPing:            {},
+		client.CmdPushBatch:       {},
+		client.CmdRange:           {},
+		client.CmdDump:            {},
+		client.CmdCommit:          {},
+		client.CmdTruncate:        {},
+		client.CmdWatch:           {},
+		client.CmdFirst:           {},
+		client.CmdLast:            {},
+		client.CmdCommitted:       {},
+		client.CmdUse:             {},
+		client.CmdDrain:           {},
+		client.CmdUndrain:         {},
+		client.CmdGetByID:         {},
+		client.CmdMget:            {},
+		client.CmdHeartbeat:       {},
+		client.CmdSnapshot:        {},
+		client.CmdHello:           {},
+		client.CmdCas:             {},
+		client.CmdFlush:           {},
+		client.CmdBatch:           {},
+		client.CmdSubscribers:     {},
+		client.CmdRetention:       {},
+		client.CmdDeleteRange:     {},
+		client.CmdBumpN:           {},
+		client.CmdInspect:         {},
+		client.CmdExport:          {},
+		client.CmdHealth:          {},
+		client.CmdStepDown:        {},
+		client.CmdReplay:          {},
+		client.CmdWindow:          {},
+		client.CmdCompact:         {},
+		client.CmdSubscribeFilter: {},
+		client.CmdConfig:          {},
+		client.CmdUnsubscribe:     {},
+		client.CmdSwap:            {},
+		client.CmdCountIf:         {},
 	}
 )
 
@@ -38,8 +106,72 @@ type ServerResponse interface {
 
 type Log interface {
 	Set(context.Context, int, string) error
+	// SetID sets the value chosen by Paxos with its ID, see GetByID.
+	SetID(ctx context.Context, n int, id, v string) error
+	// GetMany returns the values with the indexes in the same order, found reports whether
+	// the value with the index exists.
+	GetMany(ctx context.Context, ns []int) (vs []string, found []bool, err error)
+	// GetByID returns the value with the Paxos ID or ErrNotFound.
+	GetByID(context.Context, string) (string, error)
 	Get(context.Context, int) ([]string, error)
-	Pull(context.Context, int) (chan string, error)
+	// Pull streams values from the index with the given buffer size, zero means the default size.
+	// The channel is closed when ctx is done.
+	Pull(context.Context, int, int) (chan string, error)
+	Follow(context.Context, int, int) (chan string, error)
+	// Coalesce is Pull or Follow which skips the oldest queued values of the lagging subscriber
+	// instead of closing the channel.
+	Coalesce(ctx context.Context, n, buffer int, follow bool) (chan string, error)
+	Delete(context.Context, int) error
+	// DeleteRange removes the values with the indexes in [from, to) and returns their number.
+	DeleteRange(ctx context.Context, from, to int) (deleted int, err error)
+	// Compact drops what the log keeps for the values removed since the last call and returns their
+	// number, the indexes of the remaining values are kept.
+	Compact(ctx context.Context) (reclaimed int, err error)
+	Len(context.Context) (int, error)
+	Tail(context.Context, int) ([]string, error)
+	// SetBatch appends the values and returns the index of the first one. The log failed midway returns
+	// *PartialWriteError with the number of the values set.
+	SetBatch(context.Context, []string) (int, error)
+	// SetBlocking appends the value like SetBatch, but the log full up to the retention count waits
+	// for the room instead of dropping the oldest value.
+	SetBlocking(ctx context.Context, v string) (int, error)
+	// KeyIndex returns the index of the value pushed with the idempotency key if the key has been
+	// seen recently.
+	KeyIndex(ctx context.Context, key string) (index int, ok bool, err error)
+	// SetKey remembers the index of the value pushed with the idempotency key.
+	SetKey(ctx context.Context, key string, n int) error
+	Range(context.Context, int, int) ([]string, error)
+	Iterate(context.Context, func(index int, value string) error) error
+	// IterateMeta is Iterate passing the values together with their Paxos IDs like Metadata.
+	IterateMeta(ctx context.Context, fn func(meta EntryMeta) error) error
+	// CompareAndSet replaces the value with the index if it equals the expected one, it returns
+	// ErrOutOfRange if there is no such value.
+	CompareAndSet(ctx context.Context, n int, expected, new string) (bool, error)
+	// Swap exchanges the values with the indexes i and j at once, it returns ErrOutOfRange without
+	// changing anything if either is missing.
+	Swap(ctx context.Context, i, j int) error
+	// Truncate drops all values except the given number of the last ones.
+	Truncate(context.Context, int) error
+	// SetRetention replaces the policy the log drops the oldest values with.
+	SetRetention(policy RetentionPolicy) error
+	// IndexAtTime returns the index of the first value set at or after the time, the index of the next
+	// value if there is none.
+	IndexAtTime(ctx context.Context, at time.Time) (int, error)
+	// Metadata returns the value with the index together with its Paxos ID, ErrNotFound if there is no
+	// such value.
+	Metadata(ctx context.Context, n int) (EntryMeta, error)
+	// WaitFor blocks until the value with the index is set and returns it.
+	WaitFor(context.Context, int) (string, error)
+	// First and Last return the index and the value of the oldest and the newest item.
+	// They return ErrEmptyLog if there are no items.
+	First(context.Context) (int, string, error)
+	Last(context.Context) (int, string, error)
+	// Sync makes the values set before durable.
+	Sync(context.Context) error
+	// Snapshot writes the values with their IDs in the versioned format, Restore replaces the values
+	// with the ones read from the snapshot.
+	Snapshot(context.Context, io.Writer) error
+	Restore(context.Context, io.Reader) error
 }
 
 type AcceptMessage interface {
@@ -49,42 +181,325 @@ type AcceptMessage interface {
 }
 
 type Paxos interface {
-	Commit(string) ([]AcceptMessage, error)
-	Prepare(n int) (bool, AcceptMessage)
-	Accept(n int, v, id string) bool
-	Set(id string)
+	// Commit runs the Paxos rounds for the value v with the proposal id. The retries of the failed
+	// commit pass the same id, so the value is chosen once. On quorum failure the next round N is
+	// already chosen and the Paxos has waited before it until ctx is done.
+	Commit(ctx context.Context, v, id string) ([]AcceptMessage, error)
+	// ReadIndex returns the index of the last value committed in the cluster confirmed by the quorum,
+	// -1 if there are no values.
+	ReadIndex(context.Context) (int, error)
+	// Prepare handles the proposal n of the proposer node.
+	Prepare(n int, proposer string) (bool, AcceptMessage)
+	// Accept handles the proposal n, it returns the promised N the proposal has been compared with.
+	Accept(n int, v, id string) (accepted bool, promised int)
+	// Set marks the value n chosen by the quorum as committed.
+	Set(n int, id string)
+	// Lease handles the heartbeat of the leader with the proposal n, it returns false for the stale one.
+	Lease(leader string, n int) bool
+	// CommittedIndex returns the highest index known to be chosen by the quorum, -1 if there is none.
+	CommittedIndex() int
+	// SetMinN makes the next proposals of the node strictly greater than n.
+	SetMinN(n int)
+	// QuorumReachable reports whether the node can reach the quorum of the peers now, the reason tells
+	// why it can not.
+	QuorumReachable() (ok bool, reason string)
+	// TransferLeadership hands the leadership over to the peer once it has caught up, the writes are
+	// redirected to the target since then.
+	TransferLeadership(target string) error
+	State() PaxosState
+	// Leader returns the address of the known leader. The address is empty if the leader is unknown.
+	Leader() (addr string, isSelf bool)
 }
 
+// PaxosState is the snapshot of the node consensus state.
+type PaxosState struct {
+	// N is the highest proposal number seen by the node.
+	N int
+	// Leader is true if the last proposal of the node won the quorum and was not overridden since.
+	Leader bool
+	// Peers is the number of the other nodes of the cluster.
+	Peers int
+}
+
+// Handler executes the messages of the node. Process is safe to call from many goroutines, the
+// configuration is fixed by NewHandler and the state shared by the requests is guarded by its own
+// locks. The Log, Paxos and the values of the options must be safe for the concurrent use as well.
 type Handler struct {
-	paxos Paxos
-	log   Log
+	paxos      Paxos
+	log        Log
+	logFactory LogFactory
+	logs       map[string]Log
+	logsM      sync.Mutex
+	sessions   sessions
+	metrics    Metrics
+	logger     Logger
+	authorizer Authorizer
+	limiters   map[Category]*rateLimiter
+
+	recoverPanics  bool
+	redactLogs     bool
+	maxMessageSize int
+	maxValueSize   int
+	utf8Only       bool
+	snapshotPath   string
+	slowPolicy     SlowSubscriberPolicy
+	aliases        map[string]string
+	idleTimeout    time.Duration
+	commitAttempts int
+	codec          Codec
+	checksum       Checksum
+	validID        IDValidator
+	compatible     map[string]struct{}
+	dedup          *paxosDedup
+	deadLetters    DeadLetter
+	maxSubscribers int64
+	replica        bool
+
+	subscriptions subscriptions
+	keys          keyLocks
+	latencies     latencies
+	fanouts       fanouts
+	drained       int32
+	// subscribers counts the live PULL and WATCH, see WithMaxSubscribers.
+	subscribers int64
+
+	middlewares []Middleware
+	process     ProcessFunc
+
+	closing  bool
+	closingM sync.Mutex
+	inflight sync.WaitGroup
 }
 
-func NewHandler(log Log, paxos Paxos) (*Handler, error) {
-	return &Handler{
-		log:   log,
-		paxos: paxos,
-	}, nil
+// LogFactory creates the log of the named stream.
+type LogFactory func(name string) (Log, error)
+
+func NewHandler(log Log, paxos Paxos, options ...Option) (*Handler, error) {
+	h := &Handler{
+		log:           log,
+		paxos:         paxos,
+		metrics:       &nopMetrics{},
+		logger:        &nopLogger{},
+		authorizer:    &AllowAll{},
+		limiters:      map[Category]*rateLimiter{},
+		logs:          map[string]Log{},
+		sessions:      sessions{streams: map[string]string{}},
+		subscriptions: subscriptions{active: map[uint64]*subscription{}},
+		keys:          keyLocks{held: map[string]chan struct{}{}},
+		latencies:     latencies{rings: map[string]*latencyRing{}},
+		fanouts:       fanouts{shared: map[fanoutKey]*fanout{}},
+		aliases:       DefaultAliases,
+
+		recoverPanics:  true,
+		maxMessageSize: DefaultMaxMessageSize,
+		commitAttempts: DefaultCommitAttempts,
+	}
+	for _, option := range options {
+		option(h)
+	}
+	h.log = h.encoded(h.log)
+	h.process = chain(h.execute, h.middlewares)
+	return h, nil
+}
+
+// MaxMessageSize returns the limit of the raw message length set with WithMaxMessageSize, the server
+// reads no more than this from the connection.
+func (h *Handler) MaxMessageSize() int {
+	return h.maxMessageSize
+}
+
+// Close stops accepting new PUSH and PULL requests and waits for the in-flight ones
+// until they finish or ctx is done.
+func (h *Handler) Close(ctx context.Context) error {
+	h.closingM.Lock()
+	h.closing = true
+	h.closingM.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.inflight.Wait()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// begin registers an in-flight request unless the handler is closing.
+func (h *Handler) begin() error {
+	h.closingM.Lock()
+	defer h.closingM.Unlock()
+	if h.closing {
+		return ErrShuttingDown
+	}
+	h.inflight.Add(1)
+	return nil
 }
 
 type Request struct {
 	ctx  context.Context
+	name string
 	cmd  string
 	args []string
+	// log is the stream of the request, streamName is its name or empty for the log of the node.
+	log        Log
+	streamName string
+	address    string
+	// maxValueSize limits the length of every value, zero means no limit.
+	maxValueSize int
+	// utf8Only rejects the values which are not valid UTF-8.
+	utf8Only bool
+	// validID checks the value ids, nil means DefaultIDValidator.
+	validID IDValidator
+	// timeout limits the command duration, zero means no limit.
+	timeout time.Duration
+	// source is the message of the request.
+	source ServerRequest
 }
 
+// Process executes the message through the middlewares. If the execution fails the error is also
+// pushed to the response as "ERR <code> <message>" frame. The "trace:<id>" prefix of the message
+// is stripped before the middlewares and the ID is available with TraceIDFromContext. The response
+// implementing Closer is closed after the last line.
 func (h *Handler) Process(ctx context.Context, message ServerRequest, response ServerResponse) error {
-	parsed, err := parseRawMessage(message.Message())
+	if id, rest, ok := extractTraceID(message.Message()); ok {
+		ctx = WithTraceID(ctx, id)
+		message = &tracedRequest{ServerRequest: message, message: rest}
+	}
+	err := h.process(ctx, message, response)
+	if closeErr := closeResponse(response); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (h *Handler) execute(ctx context.Context, message ServerRequest, response ServerResponse) error {
+	start := time.Now()
+	if isJSON(message.Message()) {
+		response = &jsonResponse{ServerResponse: response}
+	}
+	h.logger.Debug("received", "address", message.Address(), "name", message.Name(), "message", h.loggedMessage(message.Message()))
+	cmd := ""
+	parsed, err := h.parse(ctx, message)
+	if errors.Is(err, ErrUnknownCmd) {
+		if unknown, ok := h.unsupported(message.Message()); ok {
+			h.logger.Info("unsupported", "cmd", unknown, "address", message.Address())
+			pushUnsupported(response, unknown)
+			return nil
+		}
+	}
+	if err == nil {
+		cmd = parsed.cmd
+		err = h.limit(cmd, message)
+	}
+	if err == nil {
+		err = h.authorize(ctx, cmd, message)
+	}
+	if err == nil {
+		err = h.checkDrained(cmd)
+	}
+	if err == nil {
+		err = h.checkReplica(cmd)
+	}
+	if err == nil && parsed.timeout > 0 {
+		// The inherited deadline is kept if it is earlier.
+		var cancel context.CancelFunc
+		parsed.ctx, cancel = context.WithTimeout(parsed.ctx, parsed.timeout)
+		defer cancel()
+	}
+	if err == nil {
+		err = h.safeDispatch(parsed, response)
+	}
+	if id := TraceIDFromContext(ctx); err != nil && id != "" {
+		err = fmt.Errorf("trace %s: %w", id, err)
+	}
+	dur := time.Since(start)
+	h.observe(message, cmd, dur, err)
+	h.latencies.observe(cmd, dur)
+	if err != nil {
+		h.logger.Error("failed", "cmd", cmd, "address", message.Address(), "duration", dur, "error", err)
+		pushError(response, err)
+		h.deadLetter(ctx, message, cmd, err)
+	} else {
+		h.logger.Info("done", "cmd", cmd, "address", message.Address(), "duration", dur)
+	}
+	return err
+}
+
+func (h *Handler) parse(ctx context.Context, message ServerRequest) (*Request, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(message.Message()) > h.maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	parsed, err := parseRawMessage(message.Message(), h.aliases)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	parsed.ctx = ctx
+	parsed.name = message.Name()
+	parsed.address = message.Address()
+	parsed.maxValueSize = h.maxValueSize
+	parsed.utf8Only = h.utf8Only
+	parsed.validID = h.validID
+	parsed.source = message
+	if h.logFactory != nil {
+		parsed.streamName = h.streamName(message)
+	}
+	parsed.log, err = h.logOf(parsed.streamName)
+	if err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// logOf returns the log of the named stream creating it on the first use.
+// Without the LogFactory all requests share the log passed to NewHandler.
+func (h *Handler) logOf(name string) (Log, error) {
+	if h.logFactory == nil {
+		return h.log, nil
+	}
+	h.logsM.Lock()
+	defer h.logsM.Unlock()
+	if lg, ok := h.logs[name]; ok {
+		return lg, nil
+	}
+	lg, err := h.logFactory(name)
+	if err != nil {
+		return nil, err
+	}
+	lg = h.encoded(lg)
+	h.logs[name] = lg
+	return lg, nil
+}
+
+// safeDispatch converts a panic in the command handler into ErrInternal unless the recovery is disabled.
+func (h *Handler) safeDispatch(parsed *Request, response ServerResponse) (err error) {
+	if h.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				h.logger.Error("panic", "cmd", parsed.cmd, "panic", r, "stack", string(debug.Stack()))
+				err = fmt.Errorf("%w: %v", ErrInternal, r)
+			}
+		}()
+	}
+	return h.dispatch(parsed, response)
+}
+
+func (h *Handler) dispatch(parsed *Request, response ServerResponse) error {
 	switch parsed.cmd {
 	case client.CmdPush:
 		request, err := NewPushRequest(*parsed)
 		if err != nil {
 			return err
 		}
+		if h.redirect(response) {
+			return nil
+		}
 		return h.Push(request, response)
 	case client.CmdGet:
 		request, err := NewGetRequest(*parsed)
@@ -99,7 +514,11 @@ func (h *Handler) Process(ctx context.Context, message ServerRequest, response S
 		}
 		return h.Pull(*request, response)
 	case client.CmdStatus:
-		return h.Status(response)
+		request, err := NewStatusRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Status(request, response)
 	case client.CmdSet:
 		request, err := NewSetRequest(*parsed)
 		if err != nil {
@@ -118,92 +537,575 @@ func (h *Handler) Process(ctx context.Context, message ServerRequest, response S
 			return err
 		}
 		return h.Accept(request, response)
+	case client.CmdDelete:
+		request, err := NewDeleteRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Delete(request, response)
+	case client.CmdLen:
+		return h.Len(*parsed, response)
+	case client.CmdPushBatch:
+		request, err := NewPushBatchRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		if h.redirect(response) {
+			return nil
+		}
+		return h.PushBatch(request, response)
+	case client.CmdRange:
+		request, err := NewRangeRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Range(request, response)
+	case client.CmdCommit:
+		request, err := NewCommitRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		if h.redirect(response) {
+			return nil
+		}
+		return h.Commit(request, response)
+	case client.CmdTruncate:
+		request, err := NewTruncateRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Truncate(request, response)
+	case client.CmdDump:
+		return h.Dump(*parsed, response)
+	case client.CmdPing:
+		return h.Ping(response)
+	case client.CmdPeek:
+		request, err := NewPeekRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Peek(request, response)
+	case client.CmdWatch:
+		request, err := NewWatchRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Watch(request, response)
+	case client.CmdFirst:
+		return h.First(*parsed, response)
+	case client.CmdLast:
+		return h.Last(*parsed, response)
+	case client.CmdCommitted:
+		return h.Committed(response)
+	case client.CmdUse:
+		request, err := NewUseRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Use(request, response)
+	case client.CmdDrain:
+		return h.Drain(response)
+	case client.CmdUndrain:
+		return h.Undrain(response)
+	case client.CmdGetByID:
+		request, err := NewGetByIDRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.GetByID(request, response)
+	case client.CmdMget:
+		request, err := NewMgetRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Mget(request, response)
+	case client.CmdHeartbeat:
+		request, err := NewHeartbeatRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Heartbeat(request, response)
+	case client.CmdSnapshot:
+		return h.Snapshot(*parsed, response)
+	case client.CmdHello:
+		return h.Hello(*parsed, response)
+	case client.CmdCas:
+		request, err := NewCasRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Cas(request, response)
+	case client.CmdFlush:
+		return h.Flush(*parsed, response)
+	case client.CmdBatch:
+		request, err := NewBatchRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Batch(request, response)
+	case client.CmdSubscribers:
+		return h.Subscribers(*parsed, response)
+	case client.CmdRetention:
+		request, err := NewRetentionRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Retention(request, response)
+	case client.CmdDeleteRange:
+		request, err := NewDeleteRangeRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.DeleteRange(request, response)
+	case client.CmdBumpN:
+		request, err := NewBumpNRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.BumpN(request, response)
+	case client.CmdInspect:
+		request, err := NewInspectRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Inspect(request, response)
+	case client.CmdExport:
+		request, err := NewExportRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Export(request, response)
+	case client.CmdHealth:
+		if err := parsed.validate(client.CmdHealth, 0, 0); err != nil {
+			return err
+		}
+		return h.Health(response)
+	case client.CmdStepDown:
+		request, err := NewStepDownRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.StepDown(request, response)
+	case client.CmdReplay:
+		request, err := NewReplayRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Replay(request, response)
+	case client.CmdWindow:
+		request, err := NewWindowRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Window(request, response)
+	case client.CmdCompact:
+		return h.Compact(*parsed, response)
+	case client.CmdSubscribeFilter:
+		request, err := NewSubscribeFilterRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Pull(*request, response)
+	case client.CmdConfig:
+		return h.Config(*parsed, response)
+	case client.CmdUnsubscribe:
+		request, err := NewUnsubscribeRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Unsubscribe(request, response)
+	case client.CmdSwap:
+		request, err := NewSwapRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.Swap(request, response)
+	case client.CmdCountIf:
+		request, err := NewCountIfRequest(*parsed)
+		if err != nil {
+			return err
+		}
+		return h.CountIf(request, response)
 	default:
 		return ErrUnknownCmd
 	}
 }
 
-func parseRawMessage(message string) (*Request, error) {
-	parsed := strings.SplitN(message, " ", 2)
-	if len(parsed) == 0 {
+// DefaultAliases are the short names of the commands for the interactive sessions.
+var DefaultAliases = map[string]string{
+	"P": client.CmdPush,
+	"G": client.CmdGet,
+	"S": client.CmdStatus,
+}
+
+// parseRawMessage tokenizes the message resolving the command aliases, the canonical names
+// always take precedence.
+func parseRawMessage(message string, aliases map[string]string) (*Request, error) {
+	var timeout time.Duration
+	var tokens []string
+	var err error
+	if isJSON(message) {
+		tokens, timeout, err = tokenizeJSON(message)
+	} else {
+		tokens, timeout, err = tokenizeText(message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
 		return nil, ErrIncorrectCmd
 	}
 
-	cmd, rawArgs := parsed[0], ""
-	if len(parsed) == 2 {
-		rawArgs = parsed[1]
+	// Commands are case-insensitive, arguments are kept as is.
+	cmd, args := strings.ToUpper(tokens[0]), tokens[1:]
+	if _, ok := availableCmds[cmd]; !ok && aliases[cmd] != "" {
+		cmd = aliases[cmd]
 	}
-
 	if _, ok := availableCmds[cmd]; !ok {
-		return nil, ErrIncorrectCmd
+		return nil, ErrUnknownCmd
 	}
-	args := strings.Split(rawArgs, " ")
 	return &Request{
-		cmd:  cmd,
-		args: args,
+		cmd:     cmd,
+		args:    args,
+		timeout: timeout,
 	}, nil
 }
 
+// TimeoutSuffix starts the optional last word of the header line limiting the command duration
+// in milliseconds: "WATCH 5 timeout=100".
+const TimeoutSuffix = "timeout="
+
+// splitTimeout strips the timeout suffix from the words of the header line. The quoted word is
+// the value, it is never the suffix.
+func splitTimeout(words []word) ([]word, time.Duration, error) {
+	if len(words) == 0 {
+		return words, 0, nil
+	}
+	last := words[len(words)-1]
+	if last.quoted || !strings.HasPrefix(strings.ToLower(last.text), TimeoutSuffix) {
+		return words, 0, nil
+	}
+	ms, err := strconv.Atoi(last.text[len(TimeoutSuffix):])
+	if err != nil || ms <= 0 {
+		return nil, 0, ErrIncorrectCmd
+	}
+	return words[:len(words)-1], time.Duration(ms) * time.Millisecond, nil
+}
+
+// PayloadSeparator separates the header line from the length-prefixed payload.
+const PayloadSeparator = "\r\n"
+
+// PayloadSize returns the payload length if the last unquoted word of the header before
+// the timeout suffix is $<len>.
+func PayloadSize(header string) (int, bool) {
+	words, err := tokenizeWords(header)
+	if err != nil {
+		return 0, false
+	}
+	if words, _, err = splitTimeout(words); err != nil {
+		return 0, false
+	}
+	return payloadSize(words)
+}
+
+func payloadSize(words []word) (int, bool) {
+	if len(words) < 2 {
+		return 0, false
+	}
+	last := words[len(words)-1]
+	if last.quoted || !strings.HasPrefix(last.text, "$") {
+		return 0, false
+	}
+	size, err := strconv.Atoi(last.text[1:])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// tokenizeText tokenizes the text messages like "PUSH $5 timeout=100\r\nhello" and strips the timeout
+// suffix. The last header word $<len> is replaced by the payload of exactly len bytes, so the value
+// may contain any characters.
+func tokenizeText(message string) ([]string, time.Duration, error) {
+	header, payload, framed := message, "", false
+	if i := strings.Index(message, PayloadSeparator); i != -1 {
+		header, payload, framed = message[:i], message[i+len(PayloadSeparator):], true
+	}
+	words, err := tokenizeWords(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	words, timeout, err := splitTimeout(words)
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens := make([]string, len(words))
+	for i, w := range words {
+		tokens[i] = w.text
+	}
+	if framed {
+		size, ok := payloadSize(words)
+		if !ok || size != len(payload) {
+			return nil, 0, ErrIncorrectCmd
+		}
+		tokens[len(tokens)-1] = payload
+	}
+	return tokens, timeout, nil
+}
+
+// isSpace reports whether the byte separates the tokens. The line breaks are separators as well,
+// so the blank line has no tokens.
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// word is the token of the header line, quoted is set if any part of it was quoted.
+type word struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeWords splits message by runs of spaces and tabs. Double quotes group several words into
+// a single token, inside the quotes \" and \\ are unescaped. The message is scanned by bytes, so
+// the invalid UTF-8 is kept as is.
+func tokenizeWords(message string) ([]word, error) {
+	var words []word
+	var token strings.Builder
+	inToken, quoted, escaped, wasQuoted := false, false, false, false
+	for i := 0; i < len(message); i++ {
+		b := message[i]
+		switch {
+		case escaped:
+			token.WriteByte(b)
+			escaped = false
+		case quoted && b == '\\':
+			escaped = true
+		case b == '"':
+			quoted = !quoted
+			inToken, wasQuoted = true, true
+		case isSpace(b) && !quoted:
+			if inToken {
+				words = append(words, word{text: token.String(), quoted: wasQuoted})
+			}
+			token.Reset()
+			inToken, wasQuoted = false, false
+		default:
+			token.WriteByte(b)
+			inToken = true
+		}
+	}
+	if quoted {
+		return nil, ErrIncorrectCmd
+	}
+	if inToken {
+		words = append(words, word{text: token.String(), quoted: wasQuoted})
+	}
+	return words, nil
+}
+
+// noLimit disables the upper bound of the arguments number.
+const noLimit = -1
+
+// checkValues returns ErrValueTooLarge if any value exceeds the limit and ErrInvalidEncoding if any
+// value is not valid UTF-8 while WithUTF8Validation is on.
+func (r Request) checkValues(vs ...string) error {
+	for _, v := range vs {
+		if r.maxValueSize > 0 && len(v) > r.maxValueSize {
+			return ErrValueTooLarge
+		}
+		if r.utf8Only && !utf8.ValidString(v) {
+			return ErrInvalidEncoding
+		}
+	}
+	return nil
+}
+
+// indexArg parses the argument i as the log index, decimal or hexadecimal with the 0x prefix. Unlike
+// the base prefixes of strconv the leading zeros keep the decimal index decimal.
+func (r Request) indexArg(i int) (int, error) {
+	raw := r.args[i]
+	if len(raw) < 2 || raw[0] != '0' || (raw[1] != 'x' && raw[1] != 'X') {
+		return r.intArg(i)
+	}
+	n, err := strconv.ParseUint(raw[2:], 16, strconv.IntSize-1)
+	if err != nil {
+		return 0, &ArgError{Cmd: r.cmd, ArgIndex: i, Raw: raw, Underlying: err}
+	}
+	return int(n), nil
+}
+
+// intArg parses the argument i as an integer, the failure is returned as *ArgError.
+func (r Request) intArg(i int) (int, error) {
+	n, err := strconv.Atoi(r.args[i])
+	if err != nil {
+		return 0, &ArgError{Cmd: r.cmd, ArgIndex: i, Raw: r.args[i], Underlying: err}
+	}
+	return n, nil
+}
+
+// validate checks that the request is the cmd command and has from min to max arguments.
+func (r Request) validate(cmd string, min, max int) error {
+	if r.cmd != cmd {
+		return ErrIncorrectCmd
+	}
+	if len(r.args) < min || (max != noLimit && len(r.args) > max) {
+		return ErrIncorrectCmd
+	}
+	return nil
+}
+
 type GetRequest struct {
 	Request
-	n int
+	n            int
+	linearizable bool
+	// fallback is pushed for the missing index if hasFallback is set.
+	fallback    string
+	hasFallback bool
 }
 
 func NewGetRequest(request Request) (*GetRequest, error) {
-	if request.cmd != client.CmdGet {
-		return nil, ErrIncorrectCmd
-	}
-	if len(request.args) == 0 {
-		return nil, ErrIncorrectCmd
+	if err := request.validate(client.CmdGet, 1, 4); err != nil {
+		return nil, err
 	}
-	n, err := strconv.Atoi(request.args[0])
+	n, err := request.indexArg(0)
 	if err != nil {
 		return nil, err
 	}
-	return &GetRequest{
+	get := &GetRequest{
 		Request: request,
 		n:       n,
-	}, nil
+	}
+	args := request.args[1:]
+	if len(args) > 0 && strings.EqualFold(args[0], client.GetLinearizable) {
+		get.linearizable = true
+		args = args[1:]
+	}
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && strings.EqualFold(args[0], client.GetDefault):
+		if err := request.checkValues(args[1]); err != nil {
+			return nil, err
+		}
+		get.fallback, get.hasFallback = args[1], true
+	default:
+		return nil, ErrIncorrectCmd
+	}
+	return get, nil
 }
 
 type PullRequest struct {
 	Request
-	n int
+	n      int
+	buffer int
+	follow bool
+	gzip   bool
+	// policy is empty for the Handler default.
+	policy SlowSubscriberPolicy
+	// window is the initial credit of the subscription, zero means no flow control.
+	window int
+	// filter selects the values pushed by SUBF, nil pushes every value.
+	filter func(v string) bool
+	// announce makes PULL push the subscription ID first, see UNSUB.
+	announce bool
 }
 
 func NewPullRequest(request Request) (*PullRequest, error) {
-	if request.cmd != client.CmdPull {
-		return nil, ErrIncorrectCmd
-	}
-	if len(request.args) == 0 {
-		return nil, ErrIncorrectCmd
+	if err := request.validate(client.CmdPull, 1, 8); err != nil {
+		return nil, err
 	}
-	n, err := strconv.Atoi(request.args[0])
+	n, err := request.indexArg(0)
 	if err != nil {
 		return nil, err
 	}
-	return &PullRequest{
+	pull := &PullRequest{
 		Request: request,
 		n:       n,
-	}, nil
+	}
+	// Optional arguments are the buffer size, the FOLLOW, ID, GZIP and policy keywords and WINDOW with
+	// the credit in this order.
+	args := request.args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.EqualFold(arg, client.CmdWindow) && i+1 < len(args) {
+			pull.window, err = strconv.Atoi(args[i+1])
+			if err != nil || pull.window <= 0 {
+				return nil, ErrIncorrectCmd
+			}
+			i++
+			continue
+		}
+		if strings.EqualFold(arg, client.PullFollow) {
+			pull.follow = true
+			continue
+		}
+		if strings.EqualFold(arg, client.PullID) {
+			pull.announce = true
+			continue
+		}
+		if strings.EqualFold(arg, client.PullGzip) {
+			pull.gzip = true
+			continue
+		}
+		if strings.EqualFold(arg, client.PullDrop) || strings.EqualFold(arg, client.PullCoalesce) {
+			pull.policy = SlowSubscriberPolicy(strings.ToUpper(arg))
+			continue
+		}
+		if i != 0 {
+			return nil, ErrIncorrectCmd
+		}
+		// The argument is neither a keyword nor the buffer size.
+		pull.buffer, err = strconv.Atoi(arg)
+		if err != nil || pull.buffer <= 0 {
+			return nil, ErrIncorrectCmd
+		}
+	}
+	// The batches are not counted against the credit.
+	if pull.gzip && pull.window > 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return pull, nil
 }
 
 type PushRequest struct {
 	Request
-	v string
+	v       string
+	key     string
+	durable bool
+	block   bool
 }
 
 func NewPushRequest(request Request) (*PushRequest, error) {
-	if request.cmd != client.CmdPush {
-		return nil, ErrIncorrectCmd
+	if request.cmd == client.CmdPush && len(request.args) == 0 {
+		return nil, ErrMissingValue
 	}
-	if len(request.args) == 0 {
-		return nil, ErrIncorrectCmd
+	if err := request.validate(client.CmdPush, 1, 3); err != nil {
+		return nil, err
+	}
+	if err := request.checkValues(request.args[0]); err != nil {
+		return nil, err
 	}
-	return &PushRequest{
+	push := &PushRequest{
 		Request: request,
 		v:       request.args[0],
-	}, nil
+	}
+	// The optional arguments are the idempotency key and the DURABLE and BLOCK keywords in this order.
+	rest := request.args[1:]
+	if len(rest) > 0 && strings.EqualFold(rest[len(rest)-1], client.PushBlock) {
+		push.block = true
+		rest = rest[:len(rest)-1]
+	}
+	if len(rest) > 0 && strings.EqualFold(rest[len(rest)-1], client.PushDurable) {
+		push.durable = true
+		rest = rest[:len(rest)-1]
+	}
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 1 && !push.block:
+		push.key = rest[0]
+	default:
+		return nil, ErrIncorrectCmd
+	}
+	return push, nil
 }
 
 type PrepareRequest struct {
@@ -212,13 +1114,10 @@ type PrepareRequest struct {
 }
 
 func NewPrepareRequest(request Request) (*PrepareRequest, error) {
-	if request.cmd != client.CmdPrepare {
-		return nil, ErrIncorrectCmd
-	}
-	if len(request.args) == 0 {
-		return nil, ErrIncorrectCmd
+	if err := request.validate(client.CmdPrepare, 1, 1); err != nil {
+		return nil, err
 	}
-	n, err := strconv.Atoi(request.args[0])
+	n, err := request.intArg(0)
 	if err != nil {
 		return nil, err
 	}
@@ -236,13 +1135,16 @@ type AcceptRequest struct {
 }
 
 func NewAcceptRequest(request Request) (*AcceptRequest, error) {
-	if request.cmd != client.CmdAccept {
-		return nil, ErrIncorrectCmd
+	if err := request.validate(client.CmdAccept, 3, 3); err != nil {
+		return nil, err
 	}
-	if len(request.args) != 3 {
-		return nil, ErrIncorrectCmd
+	if err := request.checkID(request.args[1]); err != nil {
+		return nil, err
+	}
+	if err := request.checkValues(request.args[2]); err != nil {
+		return nil, err
 	}
-	n, err := strconv.Atoi(request.args[0])
+	n, err := request.intArg(0)
 	if err != nil {
 		return nil, err
 	}
@@ -262,13 +1164,16 @@ type SetRequest struct {
 }
 
 func NewSetRequest(request Request) (*SetRequest, error) {
-	if request.cmd != client.CmdSet {
-		return nil, ErrIncorrectCmd
+	if err := request.validate(client.CmdSet, 3, 3); err != nil {
+		return nil, err
 	}
-	if len(request.args) != 3 {
-		return nil, ErrIncorrectCmd
+	if err := request.checkID(request.args[1]); err != nil {
+		return nil, err
 	}
-	n, err := strconv.Atoi(request.args[0])
+	if err := request.checkValues(request.args[2]); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
 	if err != nil {
 		return nil, err
 	}
@@ -279,3 +1184,412 @@ func NewSetRequest(request Request) (*SetRequest, error) {
 		v:       request.args[2],
 	}, nil
 }
+
+type StepDownRequest struct {
+	Request
+	target string
+}
+
+func NewStepDownRequest(request Request) (*StepDownRequest, error) {
+	if err := request.validate(client.CmdStepDown, 1, 1); err != nil {
+		return nil, err
+	}
+	return &StepDownRequest{Request: request, target: request.args[0]}, nil
+}
+
+type DeleteRequest struct {
+	Request
+	n int
+}
+
+func NewDeleteRequest(request Request) (*DeleteRequest, error) {
+	if err := request.validate(client.CmdDelete, 1, 1); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteRequest{
+		Request: request,
+		n:       n,
+	}, nil
+}
+
+type DeleteRangeRequest struct {
+	Request
+	from, to int
+}
+
+func NewDeleteRangeRequest(request Request) (*DeleteRangeRequest, error) {
+	if err := request.validate(client.CmdDeleteRange, 2, 2); err != nil {
+		return nil, err
+	}
+	from, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	to, err := request.intArg(1)
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || from > to {
+		return nil, ErrIncorrectCmd
+	}
+	return &DeleteRangeRequest{
+		Request: request,
+		from:    from,
+		to:      to,
+	}, nil
+}
+
+type PeekRequest struct {
+	Request
+	k int
+}
+
+func NewPeekRequest(request Request) (*PeekRequest, error) {
+	if err := request.validate(client.CmdPeek, 0, 1); err != nil {
+		return nil, err
+	}
+	k := 1
+	if len(request.args) > 0 {
+		var err error
+		k, err = request.intArg(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if k <= 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return &PeekRequest{
+		Request: request,
+		k:       k,
+	}, nil
+}
+
+type PushBatchRequest struct {
+	Request
+	vs []string
+}
+
+func NewPushBatchRequest(request Request) (*PushBatchRequest, error) {
+	if err := request.validate(client.CmdPushBatch, 2, noLimit); err != nil {
+		return nil, err
+	}
+	count, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	if count != len(request.args)-1 {
+		return nil, ErrIncorrectCmd
+	}
+	if err := request.checkValues(request.args[1:]...); err != nil {
+		return nil, err
+	}
+	return &PushBatchRequest{
+		Request: request,
+		vs:      request.args[1:],
+	}, nil
+}
+
+type RangeRequest struct {
+	Request
+	from int
+	to   int
+}
+
+func NewRangeRequest(request Request) (*RangeRequest, error) {
+	if err := request.validate(client.CmdRange, 2, 2); err != nil {
+		return nil, err
+	}
+	from, err := request.indexArg(0)
+	if err != nil {
+		return nil, err
+	}
+	to, err := request.indexArg(1)
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || to < 0 || from > to {
+		return nil, ErrIncorrectCmd
+	}
+	return &RangeRequest{
+		Request: request,
+		from:    from,
+		to:      to,
+	}, nil
+}
+
+type CommitRequest struct {
+	Request
+	v string
+}
+
+func NewCommitRequest(request Request) (*CommitRequest, error) {
+	if request.cmd == client.CmdCommit && len(request.args) == 0 {
+		return nil, ErrMissingValue
+	}
+	if err := request.validate(client.CmdCommit, 1, 1); err != nil {
+		return nil, err
+	}
+	if err := request.checkValues(request.args[0]); err != nil {
+		return nil, err
+	}
+	return &CommitRequest{
+		Request: request,
+		v:       request.args[0],
+	}, nil
+}
+
+type TruncateRequest struct {
+	Request
+	keepLast int
+}
+
+func NewTruncateRequest(request Request) (*TruncateRequest, error) {
+	if err := request.validate(client.CmdTruncate, 0, 1); err != nil {
+		return nil, err
+	}
+	keepLast := 0
+	if len(request.args) == 1 {
+		var err error
+		keepLast, err = request.intArg(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keepLast < 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return &TruncateRequest{
+		Request:  request,
+		keepLast: keepLast,
+	}, nil
+}
+
+type BumpNRequest struct {
+	Request
+	n int
+}
+
+func NewBumpNRequest(request Request) (*BumpNRequest, error) {
+	if err := request.validate(client.CmdBumpN, 1, 1); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return &BumpNRequest{
+		Request: request,
+		n:       n,
+	}, nil
+}
+
+type StatusRequest struct {
+	Request
+	verbose bool
+	// latency asks for the latency stats instead of the state, reset clears them after.
+	latency bool
+	reset   bool
+}
+
+func NewStatusRequest(request Request) (*StatusRequest, error) {
+	if err := request.validate(client.CmdStatus, 0, 2); err != nil {
+		return nil, err
+	}
+	status := &StatusRequest{Request: request}
+	if len(request.args) == 0 {
+		return status, nil
+	}
+	switch {
+	case len(request.args) == 1 && strings.EqualFold(request.args[0], client.StatusBrief):
+	case len(request.args) == 1 && strings.EqualFold(request.args[0], client.StatusVerbose):
+		status.verbose = true
+	case strings.EqualFold(request.args[0], client.StatusLatency):
+		status.latency = true
+		if len(request.args) == 2 {
+			if !strings.EqualFold(request.args[1], client.StatusReset) {
+				return nil, ErrIncorrectCmd
+			}
+			status.reset = true
+		}
+	default:
+		return nil, ErrIncorrectCmd
+	}
+	return status, nil
+}
+
+type WatchRequest struct {
+	Request
+	n int
+}
+
+func NewWatchRequest(request Request) (*WatchRequest, error) {
+	if err := request.validate(client.CmdWatch, 1, 1); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return &WatchRequest{
+		Request: request,
+		n:       n,
+	}, nil
+}
+
+type UseRequest struct {
+	Request
+	stream string
+}
+
+func NewUseRequest(request Request) (*UseRequest, error) {
+	if err := request.validate(client.CmdUse, 0, 1); err != nil {
+		return nil, err
+	}
+	use := &UseRequest{Request: request}
+	if len(request.args) == 1 {
+		use.stream = request.args[0]
+	}
+	return use, nil
+}
+
+type GetByIDRequest struct {
+	Request
+	id string
+}
+
+func NewGetByIDRequest(request Request) (*GetByIDRequest, error) {
+	if err := request.validate(client.CmdGetByID, 1, 1); err != nil {
+		return nil, err
+	}
+	return &GetByIDRequest{
+		Request: request,
+		id:      request.args[0],
+	}, nil
+}
+
+type MgetRequest struct {
+	Request
+	ns []int
+}
+
+func NewMgetRequest(request Request) (*MgetRequest, error) {
+	if err := request.validate(client.CmdMget, 1, noLimit); err != nil {
+		return nil, err
+	}
+	ns := make([]int, 0, len(request.args))
+	for i := range request.args {
+		n, err := request.intArg(i)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return &MgetRequest{
+		Request: request,
+		ns:      ns,
+	}, nil
+}
+
+type HeartbeatRequest struct {
+	Request
+	n int
+}
+
+func NewHeartbeatRequest(request Request) (*HeartbeatRequest, error) {
+	if err := request.validate(client.CmdHeartbeat, 1, 1); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	return &HeartbeatRequest{
+		Request: request,
+		n:       n,
+	}, nil
+}
+
+type CasRequest struct {
+	Request
+	n        int
+	expected string
+	new      string
+}
+
+func NewCasRequest(request Request) (*CasRequest, error) {
+	if err := request.validate(client.CmdCas, 3, 3); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := request.checkValues(request.args[2]); err != nil {
+		return nil, err
+	}
+	return &CasRequest{
+		Request:  request,
+		n:        n,
+		expected: request.args[1],
+		new:      request.args[2],
+	}, nil
+}
+
+type SwapRequest struct {
+	Request
+	i, j int
+}
+
+func NewSwapRequest(request Request) (*SwapRequest, error) {
+	if err := request.validate(client.CmdSwap, 2, 2); err != nil {
+		return nil, err
+	}
+	i, err := request.indexArg(0)
+	if err != nil {
+		return nil, err
+	}
+	j, err := request.indexArg(1)
+	if err != nil {
+		return nil, err
+	}
+	return &SwapRequest{Request: request, i: i, j: j}, nil
+}
+
+type BatchRequest struct {
+	Request
+	commands []string
+	atomic   bool
+}
+
+func NewBatchRequest(request Request) (*BatchRequest, error) {
+	if err := request.validate(client.CmdBatch, 2, 3); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	batch := &BatchRequest{Request: request}
+	if len(request.args) == 3 {
+		if !strings.EqualFold(request.args[1], client.BatchAtomic) {
+			return nil, ErrIncorrectCmd
+		}
+		batch.atomic = true
+	}
+	batch.commands = strings.Split(request.args[len(request.args)-1], "\n")
+	if n <= 0 || n != len(batch.commands) {
+		return nil, ErrIncorrectCmd
+	}
+	return batch, nil
+}
@@ -0,0 +1,496 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+func TestParseRawMessage_Quoted(t *testing.T) {
+	cases := []struct {
+		message  string
+		expected []string
+	}{
+		{`PUSH a`, []string{"a"}},
+		{`PUSH "hello world"`, []string{"hello world"}},
+		{`PUSH "say \"hi\""`, []string{`say "hi"`}},
+		{`PUSH "c:\\dir"`, []string{`c:\dir`}},
+		{`PUSH ""`, []string{""}},
+		{`SET 1 id "a b"`, []string{"1", "id", "a b"}},
+		{"PUSH    a", []string{"a"}},
+		{"PUSH\ta", []string{"a"}},
+		{"  \tSET \t 1\tid  a  \t", []string{"1", "id", "a"}},
+		{"PUSH \"a \t  b\"", []string{"a \t  b"}},
+		{"PUSH $3  \r\na b", []string{"a b"}},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Errorf("%s: %s", c.message, err)
+			continue
+		}
+		if parsed.cmd != client.CmdPush && parsed.cmd != client.CmdSet {
+			t.Errorf("%s: unexpected cmd %s", c.message, parsed.cmd)
+		}
+		if len(parsed.args) != len(c.expected) {
+			t.Errorf("%s: %q != %q", c.message, parsed.args, c.expected)
+			continue
+		}
+		for i := range c.expected {
+			if parsed.args[i] != c.expected[i] {
+				t.Errorf("%s: %q != %q", c.message, parsed.args[i], c.expected[i])
+			}
+		}
+	}
+}
+
+func TestParseRawMessage_Unterminated(t *testing.T) {
+	for _, message := range []string{`PUSH "hello`, `PUSH "hello\"`} {
+		if _, err := parseRawMessage(message, nil); err != ErrIncorrectCmd {
+			t.Errorf("%s: expected %s, got %v", message, ErrIncorrectCmd, err)
+		}
+	}
+}
+
+func TestParseRawMessage_Blank(t *testing.T) {
+	for _, message := range []string{"", "\n", "\r\n", "   ", " \t\r\n", `{"cmd":" "}`} {
+		if parsed, err := parseRawMessage(message, nil); err != ErrIncorrectCmd {
+			t.Errorf("%q: expected %s, got %+v %v", message, ErrIncorrectCmd, parsed, err)
+		}
+	}
+	parsed, err := parseRawMessage("LEN \n", nil)
+	if err != nil || len(parsed.args) != 0 {
+		t.Errorf("unexpected %+v %v", parsed, err)
+	}
+}
+
+func TestParseRawMessage_ClientRoundTrip(t *testing.T) {
+	for _, v := range []string{"plain", "hello world", `a "quoted" \ value`, "", "\xff\xfe", "a\rb"} {
+		parsed, err := parseRawMessage((&client.Push{V: v}).String(), nil)
+		if err != nil {
+			t.Errorf("%q: %s", v, err)
+			continue
+		}
+		request, err := NewPushRequest(*parsed)
+		if err != nil {
+			t.Errorf("%q: %s", v, err)
+			continue
+		}
+		if request.v != v {
+			t.Errorf("%q != %q", request.v, v)
+		}
+	}
+}
+
+func TestParseRawMessage_CaseInsensitive(t *testing.T) {
+	for cmd := range availableCmds {
+		lower := strings.ToLower(cmd)
+		mixed := strings.ToUpper(lower[:1]) + lower[1:]
+		for _, variant := range []string{cmd, lower, mixed} {
+			parsed, err := parseRawMessage(variant+" Value", nil)
+			if err != nil {
+				t.Errorf("%s: %s", variant, err)
+				continue
+			}
+			if parsed.cmd != cmd {
+				t.Errorf("%s: %s != %s", variant, parsed.cmd, cmd)
+			}
+			if len(parsed.args) != 1 || parsed.args[0] != "Value" {
+				t.Errorf("%s: args must be kept as is, got %q", variant, parsed.args)
+			}
+		}
+	}
+}
+
+func TestNewPushRequest_EmptyValue(t *testing.T) {
+	cases := []struct {
+		message string
+		err     error
+	}{
+		{"PUSH", ErrMissingValue},
+		{"PUSH ", ErrMissingValue},
+		{"PUSH   ", ErrMissingValue},
+		{`PUSH ""`, nil},
+		{`PUSH "" key`, nil},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Fatalf("%q: %s", c.message, err)
+		}
+		push, err := NewPushRequest(*parsed)
+		if err != c.err {
+			t.Errorf("%q: expected %v, got %v", c.message, c.err, err)
+			continue
+		}
+		if err == nil && push.v != "" {
+			t.Errorf("%q: expected empty value, got %q", c.message, push.v)
+		}
+	}
+}
+
+func TestRequest_MaxValueSize(t *testing.T) {
+	constructors := map[string]func(Request) error{
+		client.CmdPush:      func(r Request) error { _, err := NewPushRequest(r); return err },
+		client.CmdSet:       func(r Request) error { _, err := NewSetRequest(r); return err },
+		client.CmdAccept:    func(r Request) error { _, err := NewAcceptRequest(r); return err },
+		client.CmdPushBatch: func(r Request) error { _, err := NewPushBatchRequest(r); return err },
+		client.CmdCommit:    func(r Request) error { _, err := NewCommitRequest(r); return err },
+	}
+	cases := []struct {
+		message string
+		err     error
+	}{
+		{"PUSH abcd", nil},
+		{"PUSH abcde", ErrValueTooLarge},
+		{"SET 1 id abcd", nil},
+		{"SET 1 id abcde", ErrValueTooLarge},
+		{"ACCEPT 1 id abcd", nil},
+		{"ACCEPT 1 id abcde", ErrValueTooLarge},
+		{"PUSHBATCH 3 a ab abcd", nil},
+		{"PUSHBATCH 3 a abcde ab", ErrValueTooLarge},
+		{"COMMIT abcd", nil},
+		{"COMMIT abcde", ErrValueTooLarge},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.message, err)
+		}
+		parsed.maxValueSize = 4
+		if err := constructors[parsed.cmd](*parsed); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.message, c.err, err)
+		}
+	}
+}
+
+func TestParseRawMessage_Timeout(t *testing.T) {
+	cases := []struct {
+		message string
+		args    []string
+		timeout time.Duration
+	}{
+		{"WATCH 5 timeout=100", []string{"5"}, 100 * time.Millisecond},
+		{"WATCH 5\tTIMEOUT=100  ", []string{"5"}, 100 * time.Millisecond},
+		{"WATCH 5", []string{"5"}, 0},
+		{`PUSH "timeout=100"`, []string{"timeout=100"}, 0},
+		{`PUSH "a timeout=5"`, []string{"a timeout=5"}, 0},
+		{`PUSH "wait timeout=now" timeout=10`, []string{"wait timeout=now"}, 10 * time.Millisecond},
+		{"PUSH $3 timeout=20\r\na b", []string{"a b"}, 20 * time.Millisecond},
+		{`{"cmd":"WATCH","args":["5"],"timeout_ms":30}`, []string{"5"}, 30 * time.Millisecond},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Errorf("%q: %s", c.message, err)
+			continue
+		}
+		if parsed.timeout != c.timeout || len(parsed.args) != len(c.args) || parsed.args[0] != c.args[0] {
+			t.Errorf("%q: unexpected %q %s", c.message, parsed.args, parsed.timeout)
+		}
+	}
+	for _, message := range []string{"WATCH 5 timeout=", "WATCH 5 timeout=-1", "WATCH 5 timeout=1s"} {
+		if _, err := parseRawMessage(message, nil); err != ErrIncorrectCmd {
+			t.Errorf("%q: expected %s, got %v", message, ErrIncorrectCmd, err)
+		}
+	}
+	if size, ok := PayloadSize("PUSH $3 timeout=20"); !ok || size != 3 {
+		t.Errorf("unexpected payload size %d %t", size, ok)
+	}
+	if _, ok := PayloadSize(`PUSH "$3"`); ok {
+		t.Error("the quoted value is not the payload length")
+	}
+
+	// The client quotes the values looking like the suffix.
+	for _, v := range []string{"wait timeout=now", "timeout=5", "a timeout=5"} {
+		for _, message := range []string{(&client.Push{V: v}).String(), client.WithTimeout((&client.Push{V: v}).String(), time.Second)} {
+			parsed, err := parseRawMessage(message, nil)
+			if err != nil || len(parsed.args) != 1 || parsed.args[0] != v {
+				t.Errorf("%q: unexpected %v %v", message, parsed, err)
+			}
+		}
+	}
+}
+
+func TestParseRawMessage_Aliases(t *testing.T) {
+	for message, cmd := range map[string]string{"p a": client.CmdPush, "G 0": client.CmdGet, "s": client.CmdStatus, "PUSH a": client.CmdPush} {
+		parsed, err := parseRawMessage(message, DefaultAliases)
+		if err != nil || parsed.cmd != cmd {
+			t.Errorf("%q: unexpected %v %v", message, parsed, err)
+		}
+	}
+	// The canonical name is not shadowed by the alias.
+	parsed, err := parseRawMessage("LEN", map[string]string{"LEN": client.CmdPing})
+	if err != nil || parsed.cmd != client.CmdLen {
+		t.Errorf("unexpected %v %v", parsed, err)
+	}
+	if _, err := parseRawMessage("p a", nil); err != ErrUnknownCmd {
+		t.Errorf("expected %s without the aliases, got %v", ErrUnknownCmd, err)
+	}
+}
+
+func TestRequest_ArgsCount(t *testing.T) {
+	constructors := map[string]func(Request) error{
+		client.CmdGet:     func(r Request) error { _, err := NewGetRequest(r); return err },
+		client.CmdPull:    func(r Request) error { _, err := NewPullRequest(r); return err },
+		client.CmdPush:    func(r Request) error { _, err := NewPushRequest(r); return err },
+		client.CmdPrepare: func(r Request) error { _, err := NewPrepareRequest(r); return err },
+		client.CmdAccept:  func(r Request) error { _, err := NewAcceptRequest(r); return err },
+		client.CmdSet:     func(r Request) error { _, err := NewSetRequest(r); return err },
+	}
+	cases := []struct {
+		message string
+		valid   bool
+	}{
+		{"GET", false},
+		{"GET 5", true},
+		{"GET 5 garbage", false},
+		{"GET 5 linearizable", true},
+		{"GET 5 LINEARIZABLE garbage", false},
+		{"PULL", false},
+		{"PULL 5", true},
+		{"PULL 5 garbage", false},
+		{"PUSH a", true},
+		{"PUSH a b", true},
+		{"PUSH a b c", false},
+		{"PREPARE", false},
+		{"PREPARE 5", true},
+		{"PREPARE 5 garbage", false},
+		{"ACCEPT 5 id", false},
+		{"ACCEPT 5 id v", true},
+		{"ACCEPT 5 id v garbage", false},
+		{"SET 5 id", false},
+		{"SET 5 id v", true},
+		{"SET 5 id v garbage", false},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.message, err)
+		}
+		err = constructors[parsed.cmd](*parsed)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", c.message, err)
+		}
+		if !c.valid && err != ErrIncorrectCmd {
+			t.Errorf("%s: expected %s, got %v", c.message, ErrIncorrectCmd, err)
+		}
+	}
+}
+
+func TestParseRawMessage_Framed(t *testing.T) {
+	cases := []struct {
+		message  string
+		expected []string
+	}{
+		{"PUSH $5\r\nhe\nlo", []string{"he\nlo"}},
+		{"PUSH $0\r\n", []string{""}},
+		{"SET 1 id $7\r\na b\r\n\"c", []string{"1", "id", "a b\r\n\"c"}},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Errorf("%q: %s", c.message, err)
+			continue
+		}
+		if len(parsed.args) != len(c.expected) {
+			t.Errorf("%q: %q != %q", c.message, parsed.args, c.expected)
+			continue
+		}
+		for i := range c.expected {
+			if parsed.args[i] != c.expected[i] {
+				t.Errorf("%q: %q != %q", c.message, parsed.args[i], c.expected[i])
+			}
+		}
+	}
+
+	for _, message := range []string{"PUSH $5\r\nhe", "PUSH a\r\nhello", "PUSH $x\r\nhello"} {
+		if _, err := parseRawMessage(message, nil); err != ErrIncorrectCmd {
+			t.Errorf("%q: expected %s, got %v", message, ErrIncorrectCmd, err)
+		}
+	}
+
+	for _, v := range []string{"line\nbreak", "crlf\r\n"} {
+		parsed, err := parseRawMessage((&client.Set{N: 1, ID: "id", V: v}).String(), nil)
+		if err != nil {
+			t.Errorf("%q: %s", v, err)
+			continue
+		}
+		request, err := NewSetRequest(*parsed)
+		if err != nil {
+			t.Errorf("%q: %s", v, err)
+			continue
+		}
+		if request.v != v {
+			t.Errorf("%q != %q", request.v, v)
+		}
+	}
+}
+
+func TestNewPullRequest(t *testing.T) {
+	cases := []struct {
+		message string
+		buffer  int
+		follow  bool
+		valid   bool
+	}{
+		{"PULL 0", 0, false, true},
+		{"PULL 0 10", 10, false, true},
+		{"PULL 0 follow", 0, true, true},
+		{"PULL 0 10 FOLLOW", 10, true, true},
+		{"PULL 0 FOLLOW 10", 0, false, false},
+		{"PULL 0 0", 0, false, false},
+		{"PULL 0 10 10", 0, false, false},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.message, err)
+		}
+		request, err := NewPullRequest(*parsed)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: expected error", c.message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.message, err)
+			continue
+		}
+		if request.buffer != c.buffer || request.follow != c.follow {
+			t.Errorf("%s: unexpected buffer %d and follow %t", c.message, request.buffer, request.follow)
+		}
+	}
+}
+
+func TestRateLimiter_Refill(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(2, 2)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if !l.allow("a") {
+			t.Fatalf("request %d is rejected", i)
+		}
+	}
+	if l.allow("a") {
+		t.Fatal("burst is exceeded")
+	}
+	if !l.allow("b") {
+		t.Fatal("clients share the bucket")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("a") {
+		t.Fatal("bucket is not refilled")
+	}
+	if l.allow("a") {
+		t.Fatal("bucket is refilled too much")
+	}
+}
+
+func TestRequest_ArgError(t *testing.T) {
+	constructors := map[string]func(Request) error{
+		client.CmdGet:       func(r Request) error { _, err := NewGetRequest(r); return err },
+		client.CmdPull:      func(r Request) error { _, err := NewPullRequest(r); return err },
+		client.CmdRange:     func(r Request) error { _, err := NewRangeRequest(r); return err },
+		client.CmdMget:      func(r Request) error { _, err := NewMgetRequest(r); return err },
+		client.CmdSet:       func(r Request) error { _, err := NewSetRequest(r); return err },
+		client.CmdTruncate:  func(r Request) error { _, err := NewTruncateRequest(r); return err },
+		client.CmdPushBatch: func(r Request) error { _, err := NewPushBatchRequest(r); return err },
+		client.CmdCas:       func(r Request) error { _, err := NewCasRequest(r); return err },
+	}
+	cases := []struct {
+		message string
+		index   int
+	}{
+		{"GET x", 0},
+		{"PULL x", 0},
+		{"RANGE 1 x", 1},
+		{"MGET 1 2 x", 2},
+		{"SET x id v", 0},
+		{"TRUNCATE x", 0},
+		{"PUSHBATCH x a", 0},
+		{"CAS x a b", 0},
+	}
+	for _, c := range cases {
+		parsed, err := parseRawMessage(c.message, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.message, err)
+		}
+		err = constructors[parsed.cmd](*parsed)
+		var argErr *ArgError
+		if !errors.As(err, &argErr) {
+			t.Errorf("%s: expected ArgError, got %v", c.message, err)
+			continue
+		}
+		if argErr.Cmd != parsed.cmd || argErr.ArgIndex != c.index || argErr.Raw != "x" {
+			t.Errorf("%s: unexpected %+v", c.message, argErr)
+		}
+		if !errors.Is(err, strconv.ErrSyntax) || ErrorCode(err) != client.CodeIncorrectCmd {
+			t.Errorf("%s: the underlying error is lost: %v", c.message, err)
+		}
+	}
+
+	expected := `argument 0 of GET is not an integer: "x"`
+	if _, err := NewGetRequest(Request{cmd: client.CmdGet, args: []string{"x"}}); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	expected = `argument 0 of GET is out of range: "99999999999999999999"`
+	if _, err := NewGetRequest(Request{cmd: client.CmdGet, args: []string{"99999999999999999999"}}); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestRequest_IndexArg(t *testing.T) {
+	indexes := func(message string) ([]int, error) {
+		parsed, err := parseRawMessage(message, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", message, err)
+		}
+		switch parsed.cmd {
+		case client.CmdGet:
+			get, err := NewGetRequest(*parsed)
+			if err != nil {
+				return nil, err
+			}
+			return []int{get.n}, nil
+		case client.CmdPull:
+			pull, err := NewPullRequest(*parsed)
+			if err != nil {
+				return nil, err
+			}
+			return []int{pull.n}, nil
+		default:
+			rng, err := NewRangeRequest(*parsed)
+			if err != nil {
+				return nil, err
+			}
+			return []int{rng.from, rng.to}, nil
+		}
+	}
+	for message, expected := range map[string][]int{
+		"GET 26":       {26},
+		"GET 026":      {26},
+		"GET 0x1a":     {26},
+		"PULL 0X1A":    {26},
+		"RANGE 0x0 10": {0, 10},
+		"RANGE 5 0xa":  {5, 10},
+	} {
+		if ns, err := indexes(message); err != nil || fmt.Sprint(ns) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %v, got %v %v", message, expected, ns, err)
+		}
+	}
+
+	for _, message := range []string{"GET 0x", "GET 0xg", "PULL 0x-1", "RANGE 1 0x1.5"} {
+		_, err := indexes(message)
+		var argErr *ArgError
+		if !errors.As(err, &argErr) || !errors.Is(err, strconv.ErrSyntax) {
+			t.Errorf("%s: expected ArgError, got %v", message, err)
+		}
+	}
+}
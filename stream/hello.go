@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// Version is the version of the node reported by HELLO.
+const Version = "0.1"
+
+// Hello pushes the version and the capabilities of the node, so the clients can adapt to it.
+func (h *Handler) Hello(request Request, response ServerResponse) error {
+	if err := request.validate(client.CmdHello, 0, 0); err != nil {
+		return err
+	}
+	response.Push(fmt.Sprintf("%s=%s", client.HelloVersion, Version))
+	response.Push(fmt.Sprintf("%s=%s", client.HelloCapabilities, strings.Join(h.capabilities(), ",")))
+	return nil
+}
+
+// capabilities lists the features built into the node and the enabled optional ones.
+func (h *Handler) capabilities() []string {
+	capabilities := []string{
+		client.CapJSON,
+		client.CapGzip,
+		client.CapBatch,
+		client.CapFollow,
+		client.CapTimeout,
+		client.CapTrace,
+		client.CapCoalesce,
+	}
+	if h.snapshotPath != "" {
+		capabilities = append(capabilities, client.CapSnapshot)
+	}
+	if h.logFactory != nil {
+		capabilities = append(capabilities, client.CapStreams)
+	}
+	if len(h.aliases) > 0 {
+		capabilities = append(capabilities, client.CapAliases)
+	}
+	return capabilities
+}
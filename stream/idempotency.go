@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// keyLocks serializes the pushes with the same idempotency key, so the retry arriving while the first
+// push is committed waits for it and is deduplicated.
+type keyLocks struct {
+	m    sync.Mutex
+	held map[string]chan struct{}
+}
+
+func (k *keyLocks) lock(ctx context.Context, key string) error {
+	for {
+		k.m.Lock()
+		released, ok := k.held[key]
+		if !ok {
+			k.held[key] = make(chan struct{})
+			k.m.Unlock()
+			return nil
+		}
+		k.m.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (k *keyLocks) unlock(key string) {
+	k.m.Lock()
+	defer k.m.Unlock()
+	close(k.held[key])
+	delete(k.held, key)
+}
+
+// pushKeyed commits the value unless its idempotency key has been seen and records the key against
+// the index chosen by Paxos. The keys are remembered by the node which committed the value, so the
+// retry must be sent to the same node to be deduplicated.
+func (h *Handler) pushKeyed(request *PushRequest, response ServerResponse) error {
+	if err := h.keys.lock(request.ctx, request.key); err != nil {
+		return err
+	}
+	defer h.keys.unlock(request.key)
+
+	index, seen, err := request.log.KeyIndex(request.ctx, request.key)
+	if err != nil {
+		return err
+	}
+	if !seen {
+		id := uuid.NewV4().String()
+		accepted, err := h.commit(request.ctx, request.log, id, request.v)
+		if err != nil {
+			return err
+		}
+		if index, err = chosenIndex(accepted, id); err != nil {
+			return err
+		}
+		if err := request.log.SetKey(request.ctx, request.key, index); err != nil {
+			return err
+		}
+	}
+	if err := h.syncDurable(request); err != nil {
+		return err
+	}
+	if seen {
+		response.Push(fmt.Sprintf("%s %d %s", client.CmdOK, index, client.PushDedup))
+	} else {
+		response.Push(fmt.Sprintf("%s %d", client.CmdOK, index))
+	}
+	return nil
+}
+
+// chosenIndex returns the index Paxos has chosen for the value with the proposal id.
+func chosenIndex(accepted []AcceptMessage, id string) (int, error) {
+	for _, message := range accepted {
+		if message.ID() == id {
+			return message.N(), nil
+		}
+	}
+	return 0, fmt.Errorf("index of the value %s is unknown", id)
+}
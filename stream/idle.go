@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// Prober is the ServerResponse able to tell whether the client is still connected.
+type Prober interface {
+	// Probe returns an error if the client is gone.
+	Probe() error
+}
+
+// probe asks the response about the client, the response unable to tell is considered gone.
+func probe(response ServerResponse) error {
+	if prober, ok := response.(Prober); ok {
+		return prober.Probe()
+	}
+	return ErrIdleTimeout
+}
+
+// idleWatch tracks the time since the last line pushed to the subscriber. After the idle timeout
+// it pushes KEEPALIVE, after the next one the subscription is closed unless the response proves
+// the client is alive. The zero timeout disables the watch.
+type idleWatch struct {
+	timeout  time.Duration
+	timer    *time.Timer
+	response ServerResponse
+	pinged   bool
+}
+
+func (h *Handler) watchIdle(response ServerResponse) *idleWatch {
+	w := &idleWatch{timeout: h.idleTimeout, response: response}
+	if w.timeout > 0 {
+		w.timer = time.NewTimer(w.timeout)
+	}
+	return w
+}
+
+// C fires when the subscriber has been idle for the timeout, it is nil for the disabled watch.
+func (w *idleWatch) C() <-chan time.Time {
+	if w.timer == nil {
+		return nil
+	}
+	return w.timer.C
+}
+
+// active restarts the idle window after a line is pushed.
+func (w *idleWatch) active() {
+	if w.timer == nil {
+		return
+	}
+	if !w.timer.Stop() {
+		select {
+		case <-w.timer.C:
+		default:
+		}
+	}
+	w.timer.Reset(w.timeout)
+	w.pinged = false
+}
+
+// expired handles the fired C: it pushes KEEPALIVE or returns ErrIdleTimeout for the gone client.
+func (w *idleWatch) expired() error {
+	if w.pinged {
+		if err := probe(w.response); err != nil {
+			return ErrIdleTimeout
+		}
+	}
+	w.response.Push(client.CmdKeepalive)
+	if err := flush(w.response); err != nil {
+		return ErrIdleTimeout
+	}
+	w.pinged = true
+	w.timer.Reset(w.timeout)
+	return nil
+}
+
+func (w *idleWatch) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
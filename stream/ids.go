@@ -0,0 +1,42 @@
+package stream
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// IDValidator reports whether the value id of ACCEPT and SET is well-formed, the rejected id fails the
+// command with ErrIncorrectCmd.
+type IDValidator func(id string) bool
+
+// DefaultIDValidator accepts any non-empty id without spaces and control characters.
+func DefaultIDValidator(id string) bool {
+	return id != "" && strings.IndexFunc(id, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) == -1
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// UUIDValidator accepts only the UUIDs in the canonical form, like the ids the node generates for the writes.
+func UUIDValidator(id string) bool {
+	return uuidPattern.MatchString(id)
+}
+
+// PatternValidator accepts the ids matching the pattern.
+func PatternValidator(pattern *regexp.Regexp) IDValidator {
+	return pattern.MatchString
+}
+
+// checkID returns ErrIncorrectCmd if the id is rejected by the validator set with WithIDValidator.
+func (r Request) checkID(id string) error {
+	valid := r.validID
+	if valid == nil {
+		valid = DefaultIDValidator
+	}
+	if !valid(id) {
+		return ErrIncorrectCmd
+	}
+	return nil
+}
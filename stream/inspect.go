@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"fmt"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// EntryMeta is the value of the log together with the Paxos decision it has been set by.
+type EntryMeta struct {
+	N int
+	// ProposalN is the number of the proposal the value has been accepted with. The values are chosen
+	// by the proposal numbered after their index, so it equals N for the values set by SET.
+	ProposalN int
+	// ID is the Paxos ID of the value, empty for the values appended without Paxos.
+	ID string
+	V  string
+	// Committed is set by the Handler if the quorum is known to have chosen the value.
+	Committed bool
+}
+
+type InspectRequest struct {
+	Request
+	n int
+}
+
+func NewInspectRequest(request Request) (*InspectRequest, error) {
+	if err := request.validate(client.CmdInspect, 1, 1); err != nil {
+		return nil, err
+	}
+	n, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	return &InspectRequest{Request: request, n: n}, nil
+}
+
+// Inspect pushes "n=<index> pn=<proposal> id=<id> committed=<bool> <value>" for the value of the local
+// log, the value is the last field framed like the GET one. The values of the named streams are
+// appended without Paxos, so they are always committed.
+func (h *Handler) Inspect(request *InspectRequest, response ServerResponse) error {
+	meta, err := request.log.Metadata(request.ctx, request.n)
+	if err != nil {
+		return err
+	}
+	meta.Committed = h.logFactory != nil || meta.N <= h.paxos.CommittedIndex()
+	response.Push(fmt.Sprintf("n=%d pn=%d id=%s committed=%t %s", meta.N, meta.ProposalN, meta.ID, meta.Committed, client.FrameValue(meta.V)))
+	return nil
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// jsonRequest is the JSON form of the message: {"cmd":"PUSH","args":["a"],"timeout_ms":100}.
+type jsonRequest struct {
+	Cmd       string   `json:"cmd"`
+	Args      []string `json:"args"`
+	TimeoutMs int      `json:"timeout_ms"`
+}
+
+// jsonLine is the JSON form of the response line: {"message":"OK"} or
+// {"error":"incorrect_cmd","message":"incorrect cmd"}.
+type jsonLine struct {
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message"`
+}
+
+func isJSON(message string) bool {
+	return strings.HasPrefix(strings.TrimLeft(message, " \t"), "{")
+}
+
+func tokenizeJSON(message string) ([]string, time.Duration, error) {
+	var request jsonRequest
+	if err := json.Unmarshal([]byte(message), &request); err != nil {
+		return nil, 0, ErrIncorrectCmd
+	}
+	if strings.TrimSpace(request.Cmd) == "" || request.TimeoutMs < 0 {
+		return nil, 0, ErrIncorrectCmd
+	}
+	return append([]string{request.Cmd}, request.Args...), time.Duration(request.TimeoutMs) * time.Millisecond, nil
+}
+
+// jsonResponse encodes every pushed line as JSON object.
+type jsonResponse struct {
+	ServerResponse
+}
+
+// Push sends the value without the framing, JSON escapes its line breaks.
+func (r *jsonResponse) Push(message string) {
+	r.push(jsonLine{Message: client.Unframe(message)})
+}
+
+func (r *jsonResponse) Probe() error {
+	return probe(r.ServerResponse)
+}
+
+func (r *jsonResponse) Flush() error {
+	return flush(r.ServerResponse)
+}
+
+func (r *jsonResponse) pushError(err error) {
+	r.push(jsonLine{Error: ErrorCode(err), Message: err.Error()})
+}
+
+func (r *jsonResponse) push(line jsonLine) {
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		// jsonLine consists of strings only, it is always encoded.
+		panic(err)
+	}
+	r.ServerResponse.Push(string(encoded))
+}
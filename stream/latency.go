@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyWindow is the number of the last durations of every command the latency stats are computed of.
+const LatencyWindow = 256
+
+// latencies keeps the ring of the last durations of every command for STATUS LATENCY.
+type latencies struct {
+	m     sync.Mutex
+	rings map[string]*latencyRing
+}
+
+type latencyRing struct {
+	durations []time.Duration
+	next      int
+}
+
+func (l *latencies) observe(cmd string, dur time.Duration) {
+	if cmd == "" {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	ring, ok := l.rings[cmd]
+	if !ok {
+		ring = &latencyRing{durations: make([]time.Duration, 0, LatencyWindow)}
+		l.rings[cmd] = ring
+	}
+	if len(ring.durations) < LatencyWindow {
+		ring.durations = append(ring.durations, dur)
+		return
+	}
+	ring.durations[ring.next] = dur
+	ring.next = (ring.next + 1) % LatencyWindow
+}
+
+func (l *latencies) reset() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.rings = map[string]*latencyRing{}
+}
+
+// lines returns "cmd=push avg=1.2ms p99=8ms" line for every observed command in the name order.
+func (l *latencies) lines() []string {
+	l.m.Lock()
+	defer l.m.Unlock()
+	cmds := make([]string, 0, len(l.rings))
+	for cmd := range l.rings {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	lines := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		durations := append([]time.Duration(nil), l.rings[cmd].durations...)
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		var total time.Duration
+		for _, dur := range durations {
+			total += dur
+		}
+		avg := total / time.Duration(len(durations))
+		p99 := durations[(len(durations)*99+99)/100-1]
+		lines = append(lines, fmt.Sprintf("cmd=%s avg=%s p99=%s", strings.ToLower(cmd), round(avg), round(p99)))
+	}
+	return lines
+}
+
+// round rounds the duration to microseconds, the shorter ones are kept as is.
+func round(dur time.Duration) time.Duration {
+	if dur < time.Microsecond {
+		return dur
+	}
+	return dur.Round(time.Microsecond)
+}
@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the leveled messages with the key-value pairs: "cmd", "PUSH", "address", "...".
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (l *nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (l *nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (l *nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// StdLogger writes the messages as "LEVEL msg key=value ..." lines to Logger or the standard logger if it is nil.
+type StdLogger struct {
+	Logger *log.Logger
+}
+
+func (l *StdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.print("DEBUG", msg, keyvals)
+}
+
+func (l *StdLogger) Info(msg string, keyvals ...interface{}) {
+	l.print("INFO", msg, keyvals)
+}
+
+func (l *StdLogger) Error(msg string, keyvals ...interface{}) {
+	l.print("ERROR", msg, keyvals)
+}
+
+func (l *StdLogger) print(level, msg string, keyvals []interface{}) {
+	var line strings.Builder
+	line.WriteString(level)
+	line.WriteString(" ")
+	line.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		fmt.Fprintf(&line, " %v=%q", keyvals[i], fmt.Sprint(v))
+	}
+	if l.Logger == nil {
+		log.Println(line.String())
+		return
+	}
+	l.Logger.Println(line.String())
+}
+
+// loggedMessage returns the message for the log. The redacted message keeps the command only.
+func (h *Handler) loggedMessage(message string) string {
+	if !h.redactLogs {
+		return message
+	}
+	if i := strings.IndexAny(message, " \r\n"); i != -1 {
+		return message[:i] + " [redacted]"
+	}
+	return message
+}
@@ -0,0 +1,36 @@
+package stream
+
+import "time"
+
+// Metrics collects statistics of the processed commands.
+type Metrics interface {
+	// ObserveCommand is called after each command. cmd is empty if the message could not be parsed.
+	ObserveCommand(cmd string, dur time.Duration, err error)
+}
+
+// StreamMetrics is the Metrics labelling the commands with the stream, the Handler calls
+// ObserveStreamCommand instead of ObserveCommand for the collector implementing it.
+type StreamMetrics interface {
+	Metrics
+	// ObserveStreamCommand is ObserveCommand of the named stream set with WithLogFactory. The stream
+	// is empty without the factory, all commands go to the single log then.
+	ObserveStreamCommand(stream, cmd string, dur time.Duration, err error)
+}
+
+type nopMetrics struct{}
+
+func (m *nopMetrics) ObserveCommand(cmd string, dur time.Duration, err error) {}
+
+// observe passes the command of the message to the metrics collector.
+func (h *Handler) observe(message ServerRequest, cmd string, dur time.Duration, err error) {
+	metrics, ok := h.metrics.(StreamMetrics)
+	if !ok {
+		h.metrics.ObserveCommand(cmd, dur, err)
+		return
+	}
+	name := ""
+	if h.logFactory != nil {
+		name = h.streamName(message)
+	}
+	metrics.ObserveStreamCommand(name, cmd, dur, err)
+}
@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// ProcessFunc processes the message from the client.
+type ProcessFunc func(context.Context, ServerRequest, ServerResponse) error
+
+// Middleware wraps the next ProcessFunc. It may return without calling next to stop the processing.
+type Middleware func(next ProcessFunc) ProcessFunc
+
+func chain(process ProcessFunc, middlewares []Middleware) ProcessFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		process = middlewares[i](process)
+	}
+	return process
+}
+
+// LoggingMiddleware logs every message with its result and duration.
+func LoggingMiddleware(next ProcessFunc) ProcessFunc {
+	return func(ctx context.Context, message ServerRequest, response ServerResponse) error {
+		start := time.Now()
+		name := message.Name()
+		if id := TraceIDFromContext(ctx); id != "" {
+			name += " [" + id + "]"
+		}
+		err := next(ctx, message, response)
+		if err != nil {
+			log.Printf("%s %s failed in %s: %s", name, message.Message(), time.Since(start), err)
+		} else {
+			log.Printf("%s %s done in %s", name, message.Message(), time.Since(start))
+		}
+		return err
+	}
+}
@@ -0,0 +1,231 @@
+package stream
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultMaxMessageSize is the default limit of the raw message length in bytes.
+const DefaultMaxMessageSize = 1 << 20
+
+// DefaultCommitAttempts limits the Paxos rounds of a single write.
+const DefaultCommitAttempts = 10
+
+// Option configures the Handler.
+type Option func(*Handler)
+
+// WithMetrics sets the metrics collector. Nil keeps the default no-op collector.
+func WithMetrics(metrics Metrics) Option {
+	return func(h *Handler) {
+		if metrics != nil {
+			h.metrics = metrics
+		}
+	}
+}
+
+// WithLogger sets the logger of the processed commands. Nil keeps the default no-op logger.
+// The received messages are logged with the Debug level, see WithLogRedaction.
+func WithLogger(logger Logger) Option {
+	return func(h *Handler) {
+		if logger != nil {
+			h.logger = logger
+		}
+	}
+}
+
+// WithLogRedaction hides the command arguments which may carry the values in the log.
+func WithLogRedaction(enabled bool) Option {
+	return func(h *Handler) {
+		h.redactLogs = enabled
+	}
+}
+
+// WithLogFactory routes the requests to the stream named after ServerRequest.Name(), the logs are created
+// by the factory on the first use. The writes to the named streams skip Paxos and append the values to the local
+// log, so the named streams are meant for a single node. The owner of the factory closes the logs.
+func WithLogFactory(factory LogFactory) Option {
+	return func(h *Handler) {
+		h.logFactory = factory
+	}
+}
+
+// WithMiddleware appends the middlewares. The first one is the outermost.
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(h *Handler) {
+		h.middlewares = append(h.middlewares, middlewares...)
+	}
+}
+
+// WithAuthorizer sets the authorizer consulted before each command. Nil keeps allowing everything.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(h *Handler) {
+		if authorizer != nil {
+			h.authorizer = authorizer
+		}
+	}
+}
+
+// WithPanicRecovery enables or disables converting panics of the command handlers into ErrInternal.
+// Recovery is enabled by default.
+func WithPanicRecovery(enabled bool) Option {
+	return func(h *Handler) {
+		h.recoverPanics = enabled
+	}
+}
+
+// WithSnapshotPath enables SNAPSHOT writing the log passed to NewHandler to the file at the path.
+func WithSnapshotPath(path string) Option {
+	return func(h *Handler) {
+		h.snapshotPath = path
+	}
+}
+
+// WithSlowSubscriberPolicy sets the default policy for the PULL subscribers lagging behind more
+// than their buffer. PULL may override it.
+func WithSlowSubscriberPolicy(policy SlowSubscriberPolicy) Option {
+	return func(h *Handler) {
+		h.slowPolicy = policy
+	}
+}
+
+// WithAliases replaces DefaultAliases with the map of the short names to the commands, the names are
+// case-insensitive. Nil or the empty map disables the aliases.
+func WithAliases(aliases map[string]string) Option {
+	return func(h *Handler) {
+		h.aliases = make(map[string]string, len(aliases))
+		for alias, cmd := range aliases {
+			h.aliases[strings.ToUpper(alias)] = strings.ToUpper(cmd)
+		}
+	}
+}
+
+// WithIdleTimeout makes PULL and WATCH push KEEPALIVE to the subscriber which has received nothing
+// for the timeout. If nothing is pushed for another timeout, the subscription is closed with
+// ErrIdleTimeout unless the response implements Prober and reports the client is alive.
+// The zero timeout disables the keepalives.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(h *Handler) {
+		h.idleTimeout = timeout
+	}
+}
+
+// WithMaxSubscribers limits the number of the live PULL and WATCH subscriptions, the subscription over
+// the limit fails with ErrTooManySubscribers. Zero means no limit.
+func WithMaxSubscribers(max int) Option {
+	return func(h *Handler) {
+		h.maxSubscribers = int64(max)
+	}
+}
+
+// WithReadReplica makes the node the read replica serving GET, PULL, PEEK and the other reads from
+// the log replicated by other means. The replica never proposes and does not vote: the writes and
+// PREPARE, ACCEPT, SET and the other Paxos commands fail with ErrReadOnly. The reads may lag.
+func WithReadReplica(enabled bool) Option {
+	return func(h *Handler) {
+		h.replica = enabled
+	}
+}
+
+// WithMaxMessageSize sets the limit of the raw message length in bytes.
+func WithMaxMessageSize(size int) Option {
+	return func(h *Handler) {
+		h.maxMessageSize = size
+	}
+}
+
+// WithRateLimit limits the commands of the category to rate per second for every client address
+// with up to burst commands at once. The categories without the limit are not limited.
+func WithRateLimit(category Category, rate float64, burst int) Option {
+	return func(h *Handler) {
+		h.limiters[category] = newRateLimiter(rate, burst)
+	}
+}
+
+// WithMaxValueSize limits the length of every value of PUSH, PUSHBATCH, COMMIT, SET and ACCEPT in bytes.
+// Unlike WithMaxMessageSize it does not limit the number of values in the batch. Zero means no limit.
+func WithMaxValueSize(size int) Option {
+	return func(h *Handler) {
+		h.maxValueSize = size
+	}
+}
+
+// WithUTF8Validation rejects the values of PUSH, PUSHBATCH, COMMIT, SET and ACCEPT which are not valid
+// UTF-8 with ErrInvalidEncoding, e.g. for EXPORT NDJSON. Without it the values are stored as raw bytes,
+// so the binary payloads are kept as is.
+func WithUTF8Validation(enabled bool) Option {
+	return func(h *Handler) {
+		h.utf8Only = enabled
+	}
+}
+
+// WithIDValidator sets the check of the value ids of ACCEPT and SET, e.g. UUIDValidator for the
+// deployments where every id is generated by the nodes. Nil keeps DefaultIDValidator.
+func WithIDValidator(validator IDValidator) Option {
+	return func(h *Handler) {
+		h.validID = validator
+	}
+}
+
+// WithForwardCompatible makes the node answer the listed commands it does not know with "UNSUPPORTED <cmd>"
+// instead of the unknown_cmd error, so the newer clients and peers can fall back during the rolling
+// upgrade. The other unknown commands still fail.
+func WithForwardCompatible(cmds ...string) Option {
+	return func(h *Handler) {
+		if h.compatible == nil {
+			h.compatible = map[string]struct{}{}
+		}
+		for _, cmd := range cmds {
+			h.compatible[strings.ToUpper(cmd)] = struct{}{}
+		}
+	}
+}
+
+// WithPaxosDedup answers the PREPARE and ACCEPT retried by the network within the window with the response
+// remembered for the first one, up to size last messages are remembered. Zero size or window means
+// DefaultPaxosDedupSize or DefaultPaxosDedupWindow. Without the option every message reaches the Paxos.
+func WithPaxosDedup(size int, window time.Duration) Option {
+	return func(h *Handler) {
+		if size <= 0 {
+			size = DefaultPaxosDedupSize
+		}
+		if window <= 0 {
+			window = DefaultPaxosDedupWindow
+		}
+		h.dedup = newPaxosDedup(size, window)
+	}
+}
+
+// WithCommitRetry sets the number of Paxos rounds made for a write on quorum failure. The delay
+// between the rounds is chosen by the Paxos.
+func WithCommitRetry(attempts int) Option {
+	return func(h *Handler) {
+		h.commitAttempts = attempts
+	}
+}
+
+// WithCodec sets the codec transforming the values of the logs at rest, see Codec. Nil keeps the values as is.
+func WithCodec(codec Codec) Option {
+	return func(h *Handler) {
+		h.codec = codec
+	}
+}
+
+// WithChecksums stores the checksum with every value of the logs and verifies it on the reads, the
+// corrupted value fails GET with ErrCorruptEntry instead of being returned. Nil checksum means CRC32.
+// The values stored without the checksum fail the reads as well, so the option is meant for the new logs.
+func WithChecksums(checksum Checksum) Option {
+	return func(h *Handler) {
+		if checksum == nil {
+			checksum = CRC32
+		}
+		h.checksum = checksum
+	}
+}
+
+// WithDeadLetter sets the hook receiving the write commands, such as PUSH, which have failed.
+// Nil disables it.
+func WithDeadLetter(hook DeadLetter) Option {
+	return func(h *Handler) {
+		h.deadLetters = hook
+	}
+}
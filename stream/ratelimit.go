@@ -0,0 +1,113 @@
+package stream
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// Category groups the commands for the rate limiting.
+type Category int
+
+const (
+	CategoryRead Category = iota
+	CategoryWrite
+	CategoryPaxos
+)
+
+// maxIdleBuckets is the number of buckets kept before the full ones are forgotten.
+const maxIdleBuckets = 1024
+
+// CommandCategory returns the category of the command.
+func CommandCategory(cmd string) Category {
+	switch cmd {
+	case client.CmdPush, client.CmdPushBatch, client.CmdCommit, client.CmdDelete, client.CmdDeleteRange, client.CmdTruncate, client.CmdCas, client.CmdRetention, client.CmdCompact, client.CmdSwap:
+		return CategoryWrite
+	case client.CmdPrepare, client.CmdAccept, client.CmdSet, client.CmdBumpN, client.CmdStepDown:
+		return CategoryPaxos
+	default:
+		return CategoryRead
+	}
+}
+
+// rateLimiter is the token bucket per client address.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	m       sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.forgetFull(now)
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		return l.burst
+	}
+	return tokens
+}
+
+// forgetFull drops the buckets of the idle clients, they are equal to the new ones.
+func (l *rateLimiter) forgetFull(now time.Time) {
+	if len(l.buckets) < maxIdleBuckets {
+		return
+	}
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (h *Handler) limit(cmd string, message ServerRequest) error {
+	limiter, ok := h.limiters[CommandCategory(cmd)]
+	if !ok || limiter.allow(clientHost(message.Address())) {
+		return nil
+	}
+	return ErrRateLimited
+}
+
+// clientHost strips the port, so the connections of the same client share the limit.
+func clientHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
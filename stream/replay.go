@@ -0,0 +1,37 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+type ReplayRequest struct {
+	Request
+	at time.Time
+}
+
+// NewReplayRequest parses REPLAY <unix milliseconds>.
+func NewReplayRequest(request Request) (*ReplayRequest, error) {
+	if err := request.validate(client.CmdReplay, 1, 1); err != nil {
+		return nil, err
+	}
+	ms, err := request.intArg(0)
+	if err != nil {
+		return nil, err
+	}
+	if ms < 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return &ReplayRequest{Request: request, at: time.Unix(0, int64(ms)*int64(time.Millisecond))}, nil
+}
+
+// Replay streams the values of the local log like PULL starting from the first one set at or after the
+// time, for the point-in-time recovery. The time is the one the value has been set to this node.
+func (h *Handler) Replay(request *ReplayRequest, response ServerResponse) error {
+	n, err := request.log.IndexAtTime(request.ctx, request.at)
+	if err != nil {
+		return err
+	}
+	return h.Pull(PullRequest{Request: request.Request, n: n}, response)
+}
@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"fmt"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// Roles of the node reported by STATUS.
+const (
+	RoleVoter   = "voter"
+	RoleReplica = "replica"
+)
+
+// Role returns RoleReplica for the handler started with WithReadReplica, RoleVoter otherwise.
+func (h *Handler) Role() string {
+	if h.replica {
+		return RoleReplica
+	}
+	return RoleVoter
+}
+
+// checkReplica rejects the writes and the Paxos commands of the read replica with ErrReadOnly. Unlike
+// DRAIN the role is permanent: the replica is not a voting member, its log is replicated by other means.
+func (h *Handler) checkReplica(cmd string) error {
+	if !h.replica {
+		return nil
+	}
+	switch CommandCategory(cmd) {
+	case CategoryWrite:
+		return ErrReadOnly
+	case CategoryPaxos:
+		return fmt.Errorf("%w: the replica is not a voting member", ErrReadOnly)
+	}
+	if cmd == client.CmdHeartbeat {
+		return fmt.Errorf("%w: the replica is not a voting member", ErrReadOnly)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package stream
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// RetentionPolicy limits the values kept by the log. The zero Count or Age means no limit.
+type RetentionPolicy struct {
+	// Count is the number of the last values kept.
+	Count int
+	// Age is the time the values are kept after they have been set.
+	Age time.Duration
+}
+
+type RetentionRequest struct {
+	Request
+	policy RetentionPolicy
+}
+
+// NewRetentionRequest parses RETENTION COUNT <k> or RETENTION AGE <seconds>.
+func NewRetentionRequest(request Request) (*RetentionRequest, error) {
+	if err := request.validate(client.CmdRetention, 2, 2); err != nil {
+		return nil, err
+	}
+	limit, err := request.intArg(1)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, ErrIncorrectCmd
+	}
+	retention := &RetentionRequest{Request: request}
+	switch {
+	case strings.EqualFold(request.args[0], client.RetentionCount):
+		retention.policy.Count = limit
+	case strings.EqualFold(request.args[0], client.RetentionAge):
+		retention.policy.Age = time.Duration(limit) * time.Second
+	default:
+		return nil, ErrIncorrectCmd
+	}
+	return retention, nil
+}
+
+// Retention replaces the retention policy of the local log, the limit of the other kind is removed.
+// Like Truncate it is destructive and is not replicated.
+func (h *Handler) Retention(request *RetentionRequest, response ServerResponse) error {
+	if err := request.log.SetRetention(request.policy); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
@@ -0,0 +1,55 @@
+package stream
+
+import (
+	"sync"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// sessions keeps the stream selected with USE for every connection address.
+type sessions struct {
+	m       sync.RWMutex
+	streams map[string]string
+}
+
+func (s *sessions) stream(address string) (string, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	stream, ok := s.streams[address]
+	return stream, ok
+}
+
+func (s *sessions) use(address, stream string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if stream == "" {
+		delete(s.streams, address)
+		return
+	}
+	s.streams[address] = stream
+}
+
+// streamName returns the stream of the message. The name set explicitly by the client
+// overrides the stream selected with USE, otherwise the client address names the stream.
+func (h *Handler) streamName(message ServerRequest) string {
+	if name := message.Name(); name != message.Address() {
+		return name
+	}
+	if stream, ok := h.sessions.stream(message.Address()); ok {
+		return stream
+	}
+	return message.Name()
+}
+
+// Use selects the stream for the following commands of the connection, USE without the name
+// resets the selection.
+func (h *Handler) Use(request *UseRequest, response ServerResponse) error {
+	h.sessions.use(request.address, request.stream)
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// EndSession forgets the stream selected by the connection. The server calls it on disconnect.
+func (h *Handler) EndSession(address string) {
+	h.sessions.use(address, "")
+}
@@ -0,0 +1,41 @@
+package stream
+
+import "github.com/tariel-x/stream/client"
+
+// SlowSubscriberPolicy decides the fate of the PULL subscriber lagging behind more than its buffer.
+// The writers never wait for the subscribers whatever the policy is.
+type SlowSubscriberPolicy string
+
+const (
+	// SlowDrop closes the subscription with ErrOverflow. It is the default.
+	SlowDrop SlowSubscriberPolicy = client.PullDrop
+	// SlowCoalesce keeps the subscription skipping the oldest values the subscriber has not received.
+	SlowCoalesce SlowSubscriberPolicy = client.PullCoalesce
+)
+
+// subscribe starts the subscription of the PULL request with its policy or the Handler default one.
+// The FOLLOW subscribers of the same index dropped when lagging behind share one log subscription.
+func (h *Handler) subscribe(request PullRequest) (chan string, error) {
+	policy := request.policy
+	if policy == "" {
+		policy = h.slowPolicy
+	}
+	if policy == SlowCoalesce {
+		return request.log.Coalesce(request.ctx, request.n, request.buffer, request.follow)
+	}
+	if request.follow {
+		return h.fanouts.follow(request.ctx, request.streamName, request.log, request.n, request.buffer)
+	}
+	return request.log.Pull(request.ctx, request.n, request.buffer)
+}
+
+// subscriptionClosed returns the reason the log closed the subscription while the request context
+// is alive: the node shuts down or the subscriber has been dropped for lagging behind.
+func (h *Handler) subscriptionClosed() error {
+	h.closingM.Lock()
+	defer h.closingM.Unlock()
+	if h.closing {
+		return ErrShuttingDown
+	}
+	return ErrOverflow
+}
@@ -0,0 +1,41 @@
+package stream
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// Snapshot writes the log passed to NewHandler to the file set with WithSnapshotPath. The snapshot
+// is written to a temporary file first and renamed, so the previous snapshot is kept if the write fails.
+// The node without the path does not know the command.
+func (h *Handler) Snapshot(request Request, response ServerResponse) error {
+	if h.snapshotPath == "" {
+		return ErrUnknownCmd
+	}
+	if err := request.validate(client.CmdSnapshot, 0, 0); err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(h.snapshotPath), filepath.Base(h.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if err := h.log.Snapshot(request.ctx, temporary); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary.Name(), h.snapshotPath); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
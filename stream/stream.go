@@ -1,93 +1,629 @@
 package stream
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+
+	"github.com/satori/go.uuid"
 
 	"github.com/tariel-x/stream/client"
 )
 
+// redirect pushes the leader address if another node is the leader. Writes are processed
+// locally when the leader is unknown. SET is not redirected because it carries the value
+// already chosen by the quorum and every node must apply it. The named streams are not replicated,
+// their values are appended to the streams of the node the client has chosen.
+func (h *Handler) redirect(response ServerResponse) bool {
+	if h.logFactory != nil {
+		return false
+	}
+	addr, isSelf := h.paxos.Leader()
+	if isSelf || addr == "" {
+		return false
+	}
+	response.Push(fmt.Sprintf("%s %s", client.CmdRedirect, addr))
+	return true
+}
+
+// Push commits the value with Paxos. The response to the value with the idempotency key is
+// "OK <index>", or "OK <index> DEDUP" if the key has been seen, see pushKeyed. The blocking one
+// is answered with "OK <index>" as well, see pushBlocking.
 func (h *Handler) Push(request *PushRequest, response ServerResponse) error {
-	acceptedMessages, err := h.paxos.Commit(request.v)
+	if err := h.begin(); err != nil {
+		return err
+	}
+	defer h.inflight.Done()
+	if request.key != "" {
+		return h.pushKeyed(request, response)
+	}
+	if request.block {
+		return h.pushBlocking(request, response)
+	}
+	if _, err := h.commit(request.ctx, request.log, uuid.NewV4().String(), request.v); err != nil {
+		return err
+	}
+	if err := h.syncDurable(request); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// pushBlocking appends the value to the local log once it has room under the retention count. Like
+// PUSHBATCH it skips Paxos, so the node with peers does not accept it.
+func (h *Handler) pushBlocking(request *PushRequest, response ServerResponse) error {
+	if h.paxos.State().Peers > 0 && h.logFactory == nil {
+		return fmt.Errorf("%w: %s %s is not replicated, use it on the single node", ErrIncorrectCmd, client.CmdPush, client.PushBlock)
+	}
+	n, err := request.log.SetBlocking(request.ctx, request.v)
+	if err != nil {
+		return err
+	}
+	if err := h.syncDurable(request); err != nil {
+		return err
+	}
+	response.Push(fmt.Sprintf("%s %d", client.CmdOK, n))
+	return nil
+}
+
+// syncDurable syncs the log of the durable PUSH, the other pushes are acknowledged without waiting
+// for the disk.
+func (h *Handler) syncDurable(request *PushRequest) error {
+	if !request.durable {
+		return nil
+	}
+	return request.log.Sync(request.ctx)
+}
+
+// Flush syncs the log, every value set before is durable after OK.
+func (h *Handler) Flush(request Request, response ServerResponse) error {
+	if err := request.validate(client.CmdFlush, 0, 0); err != nil {
+		return err
+	}
+	if err := request.log.Sync(request.ctx); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// Commit runs the Paxos round for the value and pushes every message accepted during it
+// as "<n> <id> <v>" line followed by OK. The round may also choose the values proposed earlier
+// by other nodes. No lines before OK mean the value has already been committed. On error
+// nothing is pushed and the values chosen before the failure are kept in the log.
+func (h *Handler) Commit(request *CommitRequest, response ServerResponse) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	defer h.inflight.Done()
+	acceptedMessages, err := h.commit(request.ctx, request.log, uuid.NewV4().String(), request.v)
 	if err != nil {
 		return err
 	}
 	for _, acceptedMessage := range acceptedMessages {
-		if err := h.log.Set(request.ctx, acceptedMessage.N(), acceptedMessage.V()); err != nil {
-			return err
-		}
+		response.Push(fmt.Sprintf("%d %s %s", acceptedMessage.N(), acceptedMessage.ID(), client.FrameValue(acceptedMessage.V())))
 	}
 	response.Push(client.CmdOK)
 	return nil
 }
 
+// commit runs the Paxos rounds until the value with the proposal id is chosen and sets the accepted
+// values to the local log. On quorum failure the round is retried with the same id until the attempts
+// are exhausted or ctx is done.
+func (h *Handler) commit(ctx context.Context, lg Log, id, v string) ([]AcceptMessage, error) {
+	if h.logFactory != nil {
+		return appendLocal(ctx, lg, id, v)
+	}
+	var accepted []AcceptMessage
+	for attempt := 1; ; attempt++ {
+		acceptedMessages, err := h.paxos.Commit(ctx, v, id)
+		// Values chosen before the failure must be set as well.
+		for _, acceptedMessage := range acceptedMessages {
+			if err := lg.SetID(ctx, acceptedMessage.N(), acceptedMessage.ID(), acceptedMessage.V()); err != nil {
+				return nil, err
+			}
+		}
+		accepted = append(accepted, acceptedMessages...)
+		if !errors.Is(err, ErrQuorumFailed) {
+			return accepted, err
+		}
+		if attempt >= h.commitAttempts {
+			return accepted, fmt.Errorf("%w after %d attempts", err, attempt)
+		}
+		if err := ctx.Err(); err != nil {
+			return accepted, fmt.Errorf("%w after %d attempts", err, attempt)
+		}
+	}
+}
+
+// localValue is the value appended to the named stream without Paxos.
+type localValue struct {
+	n     int
+	id, v string
+}
+
+func (lv *localValue) N() int {
+	return lv.n
+}
+
+func (lv *localValue) ID() string {
+	return lv.id
+}
+
+func (lv *localValue) V() string {
+	return lv.v
+}
+
+// appendLocal appends the value after the last one of the named stream. The named streams are not
+// replicated: the Paxos indexes are shared by all streams, so they would leave gaps in every stream
+// and the replicas could not tell the stream of the SET.
+func appendLocal(ctx context.Context, lg Log, id, v string) ([]AcceptMessage, error) {
+	n, err := lg.SetBatch(ctx, []string{v})
+	if err != nil {
+		return nil, err
+	}
+	return []AcceptMessage{&localValue{n: n, id: id, v: v}}, nil
+}
+
+// PushBatch appends all values to the local log and responds with the index of the first one.
+// The values are not replicated and their indexes would collide with the ones chosen by Paxos,
+// so the node with peers does not accept the command. The log failed midway pushes "PARTIAL <written>"
+// before the error, the client resumes from the first value not written.
+func (h *Handler) PushBatch(request *PushBatchRequest, response ServerResponse) error {
+	if h.paxos.State().Peers > 0 {
+		return fmt.Errorf("%w: %s is not replicated, use it on the single node", ErrIncorrectCmd, client.CmdPushBatch)
+	}
+	base, err := request.log.SetBatch(request.ctx, request.vs)
+	var partial *PartialWriteError
+	if errors.As(err, &partial) && partial.Written > 0 {
+		response.Push(fmt.Sprintf("%s %d", client.CmdPartial, partial.Written))
+	}
+	if err != nil {
+		return err
+	}
+	response.Push(fmt.Sprintf("%s %d", client.CmdOK, base))
+	return nil
+}
+
 func (h *Handler) Set(request *SetRequest, response ServerResponse) error {
-	h.paxos.Set(request.id)
-	if err := h.log.Set(request.ctx, request.n, request.v); err != nil {
+	h.paxos.Set(request.n, request.id)
+	if err := request.log.SetID(request.ctx, request.n, request.id, request.v); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
+
+func (h *Handler) Delete(request *DeleteRequest, response ServerResponse) error {
+	if err := request.log.Delete(request.ctx, request.n); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// DeleteRange removes the values of the local log with the indexes in [from, to) and pushes their number.
+// Like DELETE it leaves the gap, the indexes of the other values are kept.
+func (h *Handler) DeleteRange(request *DeleteRangeRequest, response ServerResponse) error {
+	deleted, err := request.log.DeleteRange(request.ctx, request.from, request.to)
+	if err != nil {
+		return err
+	}
+	response.Push(strconv.Itoa(deleted))
+	return nil
+}
+
+// Swap exchanges two values of the local log. Like CAS it is not replicated.
+func (h *Handler) Swap(request *SwapRequest, response ServerResponse) error {
+	if err := request.log.Swap(request.ctx, request.i, request.j); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// Compact reclaims the slots of the values removed from the local log and pushes their number.
+func (h *Handler) Compact(request Request, response ServerResponse) error {
+	if err := request.validate(client.CmdCompact, 0, 0); err != nil {
+		return err
+	}
+	reclaimed, err := request.log.Compact(request.ctx)
+	if err != nil {
+		return err
+	}
+	response.Push(strconv.Itoa(reclaimed))
+	return nil
+}
+
+// Cas replaces the value of the local log if it equals the expected one and pushes OK. The mismatch
+// is answered with "CAS_FAILED <actual>", the actual value is read after the attempt, so it may
+// be already replaced again when the client retries with it.
+func (h *Handler) Cas(request *CasRequest, response ServerResponse) error {
+	swapped, err := request.log.CompareAndSet(request.ctx, request.n, request.expected, request.new)
+	if err != nil {
+		return err
+	}
+	if swapped {
+		response.Push(client.CmdOK)
+		return nil
+	}
+	actual, found, err := request.log.GetMany(request.ctx, []int{request.n})
+	if err != nil {
+		return err
+	}
+	if !found[0] {
+		return ErrOutOfRange
+	}
+	response.Push(client.CmdCasFailed + " " + client.FrameValue(actual[0]))
+	return nil
+}
+
+// BumpN raises the proposal numbers of the node above n, it is meant for the recovery after a crash
+// which may have lost the promises. Deployments should allow it to the operators only with the Authorizer.
+func (h *Handler) BumpN(request *BumpNRequest, response ServerResponse) error {
+	h.paxos.SetMinN(request.n)
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// Truncate is destructive, deployments should forbid it for the clients with the Authorizer.
+func (h *Handler) Truncate(request *TruncateRequest, response ServerResponse) error {
+	if err := request.log.Truncate(request.ctx, request.keepLast); err != nil {
+		return err
+	}
+	response.Push(client.CmdOK)
+	return nil
+}
+
+func (h *Handler) Len(request Request, response ServerResponse) error {
+	length, err := request.log.Len(request.ctx)
+	if err != nil {
+		return err
+	}
+	response.Push(strconv.Itoa(length))
+	return nil
+}
+
+// First pushes the oldest value as "<n> <v>".
+func (h *Handler) First(request Request, response ServerResponse) error {
+	n, v, err := request.log.First(request.ctx)
+	if err != nil {
+		return err
+	}
+	response.Push(fmt.Sprintf("%d %s", n, client.FrameValue(v)))
+	return nil
+}
+
+// Last pushes the newest value as "<n> <v>".
+func (h *Handler) Last(request Request, response ServerResponse) error {
+	n, v, err := request.log.Last(request.ctx)
+	if err != nil {
+		return err
+	}
+	response.Push(fmt.Sprintf("%d %s", n, client.FrameValue(v)))
+	return nil
+}
+
+func (h *Handler) Peek(request *PeekRequest, response ServerResponse) error {
+	results, err := request.log.Tail(request.ctx, request.k)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		response.Push(client.FrameValue(result))
+	}
+	return nil
+}
+
+// Committed pushes the highest index chosen by the quorum. Unlike LEN and LAST it excludes the values
+// appended to the local log only, such as PUSHBATCH ones.
+func (h *Handler) Committed(response ServerResponse) error {
+	response.Push(strconv.Itoa(h.paxos.CommittedIndex()))
+	return nil
+}
+
+func (h *Handler) Ping(response ServerResponse) error {
+	response.Push(client.CmdPong)
+	return nil
+}
+
+// StepDown hands the leadership of the node over to the target peer for the planned maintenance and
+// pushes OK, the writes are redirected to the target since then. The deployments restrict it with the Authorizer.
+func (h *Handler) StepDown(request *StepDownRequest, response ServerResponse) error {
+	if err := h.paxos.TransferLeadership(request.target); err != nil {
 		return err
 	}
 	response.Push(client.CmdOK)
 	return nil
 }
 
-func (h *Handler) Status(response ServerResponse) error {
+// Health pushes OK if the node can reach the quorum of the peers, otherwise "DEGRADED <reason>", so the
+// load balancer can drain the node which is up but can not commit.
+func (h *Handler) Health(response ServerResponse) error {
+	if ok, reason := h.paxos.QuorumReachable(); !ok {
+		response.Push(client.CmdDegraded + " " + reason)
+		return nil
+	}
 	response.Push(client.CmdOK)
 	return nil
 }
 
+// Status pushes the node state as key=value lines, the verbose one adds the cluster view of the node.
+// STATUS LATENCY pushes the average and p99 durations of the last LatencyWindow runs of every command.
+func (h *Handler) Status(request *StatusRequest, response ServerResponse) error {
+	if request.latency {
+		for _, line := range h.latencies.lines() {
+			response.Push(line)
+		}
+		if request.reset {
+			h.latencies.reset()
+		}
+		return nil
+	}
+	length, err := request.log.Len(request.ctx)
+	if err != nil {
+		return err
+	}
+	state := h.paxos.State()
+	response.Push(fmt.Sprintf("%s=%d", client.StatusLen, length))
+	response.Push(fmt.Sprintf("%s=%d", client.StatusProposal, state.N))
+	response.Push(fmt.Sprintf("%s=%t", client.StatusLeader, state.Leader))
+	response.Push(fmt.Sprintf("%s=%d", client.StatusSubscribers, h.subscriptions.count()))
+	response.Push(fmt.Sprintf("%s=%t", client.StatusDrained, h.Drained()))
+	response.Push(fmt.Sprintf("%s=%s", client.StatusRole, h.Role()))
+	if !request.verbose {
+		return nil
+	}
+	leader, _ := h.paxos.Leader()
+	response.Push(fmt.Sprintf("%s=%d", client.StatusPeers, state.Peers))
+	response.Push(fmt.Sprintf("%s=%d", client.StatusCommitted, h.paxos.CommittedIndex()))
+	response.Push(fmt.Sprintf("%s=%s", client.StatusLeaderAddress, leader))
+	return nil
+}
+
+// Get pushes the values of the local log starting from the index. The linearizable GET first asks
+// the quorum for the last committed index and waits until the local log has it, so it costs
+// a network round and possibly the replication delay. The GET with the default pushes it instead of
+// failing if there is no value at the index or it has been trimmed, the other errors still fail.
 func (h *Handler) Get(request GetRequest, response ServerResponse) error {
-	results, err := h.log.Get(request.ctx, request.n)
+	if request.linearizable {
+		if err := h.catchUp(request.ctx, request.log); err != nil {
+			return err
+		}
+	}
+	results, err := request.log.Get(request.ctx, request.n)
+	missing := err == nil && len(results) == 0 || errors.Is(err, ErrOutOfRange)
+	if request.hasFallback && missing {
+		response.Push(client.FrameValue(request.fallback))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		response.Push(client.FrameValue(result))
+	}
+	return nil
+}
+
+// catchUp waits until the local log has the last value committed in the cluster.
+func (h *Handler) catchUp(ctx context.Context, lg Log) error {
+	index, err := h.paxos.ReadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if index < 0 {
+		return nil
+	}
+	_, err = lg.WaitFor(ctx, index)
+	return err
+}
+
+// Mget pushes a line for every requested index in order: the value or client.MgetMissing if there is
+// no such value. The values with $ are framed, so they differ from the marker.
+func (h *Handler) Mget(request *MgetRequest, response ServerResponse) error {
+	values, found, err := request.log.GetMany(request.ctx, request.ns)
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		switch {
+		case !found[i]:
+			response.Push(client.MgetMissing)
+		default:
+			response.Push(client.FrameValue(v))
+		}
+	}
+	return nil
+}
+
+// GetByID pushes the value with the Paxos ID.
+func (h *Handler) GetByID(request *GetByIDRequest, response ServerResponse) error {
+	v, err := request.log.GetByID(request.ctx, request.id)
+	if err != nil {
+		return err
+	}
+	response.Push(client.FrameValue(v))
+	return nil
+}
+
+func (h *Handler) Range(request *RangeRequest, response ServerResponse) error {
+	results, err := request.log.Range(request.ctx, request.from, request.to)
 	if err != nil {
 		return err
 	}
 	for _, result := range results {
-		response.Push(result)
+		response.Push(client.FrameValue(result))
 	}
 	return nil
 }
 
+func (h *Handler) Dump(request Request, response ServerResponse) error {
+	return request.log.Iterate(request.ctx, func(index int, value string) error {
+		response.Push(client.FrameValue(value))
+		return nil
+	})
+}
+
 func (h *Handler) Pull(request PullRequest, response ServerResponse) error {
-	results, err := h.log.Pull(request.ctx, request.n)
+	if err := h.begin(); err != nil {
+		return err
+	}
+	defer h.inflight.Done()
+	release, err := h.acquireSubscriber()
+	if err != nil {
+		return err
+	}
+	defer release()
+	// The subscription outlives the request context if the idle subscriber is closed.
+	ctx, cancel := context.WithCancel(request.ctx)
+	defer cancel()
+	request.ctx = ctx
+	sub := h.register(request, cancel)
+	defer h.subscriptions.remove(sub)
+	results, err := h.subscribe(request)
 	if err != nil {
 		return err
 	}
-readCycle:
+	if err := windowID(sub, response); err != nil {
+		return err
+	}
+	if err := subscriptionID(request, sub, response); err != nil {
+		return err
+	}
+	idle := h.watchIdle(response)
+	defer idle.stop()
+	return sub.ended(h.forward(request, sub, results, idle, response))
+}
+
+// forward pushes the values of the subscription until it is closed.
+func (h *Handler) forward(request PullRequest, sub *subscription, results chan string, idle *idleWatch, response ServerResponse) error {
+	if request.gzip {
+		if err := pushBatches(request.ctx, results, response, idle, sub); err != nil {
+			return err
+		}
+		return h.subscriptionClosed()
+	}
 	for {
+		// The subscription out of the credit stops reading the values until WINDOW tops it up.
+		values, topped := results, sub.window.paused()
+		if topped != nil {
+			values = nil
+		}
 		select {
 		case <-request.ctx.Done():
-			return nil
-		case result, ok := <-results:
+			return request.ctx.Err()
+		case <-topped:
+		case result, ok := <-values:
 			if !ok {
-				break readCycle
+				return h.subscriptionClosed()
+			}
+			// The value filtered out is not behind.
+			if request.filter != nil && !request.filter(result) {
+				sub.pushed(1)
+				continue
+			}
+			response.Push(client.FrameValue(result))
+			if err := flush(response); err != nil {
+				return err
+			}
+			sub.pushed(1)
+			sub.window.spend()
+			idle.active()
+		case <-idle.C():
+			if err := idle.expired(); err != nil {
+				return err
 			}
-			response.Push(result)
 		}
 	}
-	return nil
 }
 
-func (h *Handler) Accept(request *AcceptRequest, response ServerResponse) error {
-	if h.paxos.Accept(request.n, request.v, request.id) {
-		response.Push(client.CmdAccepted)
+// Watch waits until the value with the index is set and pushes it once.
+func (h *Handler) Watch(request *WatchRequest, response ServerResponse) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	defer h.inflight.Done()
+	release, err := h.acquireSubscriber()
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(request.ctx)
+	defer cancel()
+	var v string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v, err = request.log.WaitFor(ctx, request.n)
+	}()
+	idle := h.watchIdle(response)
+	defer idle.stop()
+	for {
+		select {
+		case <-done:
+			if err != nil {
+				return err
+			}
+			response.Push(client.FrameValue(v))
+			return nil
+		case <-idle.C():
+			if err := idle.expired(); err != nil {
+				cancel()
+				<-done
+				return err
+			}
+		}
+	}
+}
+
+// Heartbeat renews the lease of the leader node, the refused heartbeat is answered with REFUSE.
+func (h *Handler) Heartbeat(request *HeartbeatRequest, response ServerResponse) error {
+	if h.paxos.Lease(request.name, request.n) {
+		response.Push(client.CmdOK)
 	} else {
 		response.Push(client.CmdRefuse)
 	}
 	return nil
 }
 
+// Accept answers "ACCEPTED" or "REJECT <n>" carrying the promised N when the node has promised
+// a higher proposal since, so the preempted proposer can outbid it.
+func (h *Handler) Accept(request *AcceptRequest, response ServerResponse) error {
+	h.dedup.answer(dedupKey{cmd: client.CmdAccept, n: request.n, id: request.id}, response, func(response ServerResponse) {
+		if accepted, promised := h.paxos.Accept(request.n, request.v, request.id); accepted {
+			response.Push(client.CmdAccepted)
+		} else {
+			response.Push(fmt.Sprintf("%s %d", client.CmdReject, promised))
+		}
+	})
+	return nil
+}
+
+// Prepare answers "PROMISE" or "PROMISE <n> <id> <v>" with the value accepted earlier, the proposer
+// must adopt it. The proposal not greater than the promised one is answered with "REJECT <n>"
+// carrying the promised N, so the proposer can outbid it.
 func (h *Handler) Prepare(request *PrepareRequest, response ServerResponse) error {
-	agreement, previousAccepted := h.paxos.Prepare(request.n)
+	h.dedup.answer(dedupKey{cmd: client.CmdPrepare, n: request.n, id: request.name}, response, func(response ServerResponse) {
+		h.prepare(request, response)
+	})
+	return nil
+}
 
-	decision := client.CmdPromise
+func (h *Handler) prepare(request *PrepareRequest, response ServerResponse) {
+	agreement, previousAccepted := h.paxos.Prepare(request.n, request.name)
 
 	if !agreement {
-		decision = client.CmdRefuse
+		response.Push(fmt.Sprintf("%s %d", client.CmdReject, h.paxos.State().N))
+		return
 	}
 
 	if previousAccepted == nil {
-		response.Push(decision)
+		response.Push(client.CmdPromise)
 	} else {
-		response.Push(fmt.Sprintf("%s %d %s %s", decision, previousAccepted.N(), previousAccepted.ID(), previousAccepted.V()))
+		response.Push(fmt.Sprintf("%s %d %s %s", client.CmdPromise, previousAccepted.N(), previousAccepted.ID(),
+			client.FrameValue(previousAccepted.V())))
 	}
-
-	return nil
 }
@@ -0,0 +1,3372 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tariel-x/stream/client"
+	storage "github.com/tariel-x/stream/log"
+	"github.com/tariel-x/stream/stream"
+)
+
+type request struct {
+	message string
+	name    string
+}
+
+func (r *request) Message() string {
+	return r.message
+}
+
+func (r *request) Address() string {
+	return "localhost:7000"
+}
+
+func (r *request) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	return r.Address()
+}
+
+type response struct {
+	messages []string
+}
+
+func (r *response) Push(message string) {
+	r.messages = append(r.messages, message)
+}
+
+type acceptMessage struct {
+	n  int
+	id string
+	v  string
+}
+
+func (am *acceptMessage) N() int {
+	return am.n
+}
+
+func (am *acceptMessage) ID() string {
+	return am.id
+}
+
+func (am *acceptMessage) V() string {
+	return am.v
+}
+
+// paxos commits every value immediately with the next N.
+type paxos struct {
+	n      int
+	leader string
+	self   bool
+	err    error
+	// failures is the number of rounds failed with ErrQuorumFailed before the success.
+	failures int
+	commits  int
+	// ids are the proposal ids of the rounds, delay is the wait of the failed round.
+	ids   []string
+	delay time.Duration
+	peers int
+	// reject makes Prepare reject the proposals, previous is returned by Prepare.
+	reject   bool
+	previous stream.AcceptMessage
+	// accepts is the number of the Accept calls.
+	accepts int
+	// unreachable is the reason the quorum is not reachable.
+	unreachable string
+}
+
+func (p *paxos) Commit(ctx context.Context, v, id string) ([]stream.AcceptMessage, error) {
+	p.commits++
+	p.ids = append(p.ids, id)
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.commits <= p.failures {
+		time.Sleep(p.delay)
+		return nil, stream.ErrQuorumFailed
+	}
+	msg := &acceptMessage{n: p.n, id: id, v: v}
+	p.n++
+	return []stream.AcceptMessage{msg}, nil
+}
+
+func (p *paxos) Prepare(n int, proposer string) (bool, stream.AcceptMessage) {
+	return !p.reject, p.previous
+}
+
+// ReadIndex returns the index of the last committed value.
+func (p *paxos) ReadIndex(ctx context.Context) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.n - 1, nil
+}
+
+// Accept accepts the proposals not less than the promised N.
+func (p *paxos) Accept(n int, v, id string) (bool, int) {
+	p.accepts++
+	return n >= p.n, p.n
+}
+
+func (p *paxos) Set(n int, id string) {}
+
+func (p *paxos) Lease(leader string, n int) bool {
+	p.leader = leader
+	return n >= p.n
+}
+
+func (p *paxos) CommittedIndex() int {
+	return p.n - 1
+}
+
+// TransferLeadership makes the target the leader.
+func (p *paxos) TransferLeadership(target string) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.leader, p.self = target, false
+	return nil
+}
+
+// QuorumReachable fails with the unreachable reason if it is set.
+func (p *paxos) QuorumReachable() (bool, string) {
+	return p.unreachable == "", p.unreachable
+}
+
+// SetMinN raises the next N above n.
+func (p *paxos) SetMinN(n int) {
+	if n >= p.n {
+		p.n = n + 1
+	}
+}
+
+func (p *paxos) Leader() (string, bool) {
+	return p.leader, p.self
+}
+
+func (p *paxos) State() stream.PaxosState {
+	return stream.PaxosState{N: p.n, Leader: true, Peers: p.peers}
+}
+
+func newHandler(t *testing.T) *stream.Handler {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(lg, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func process(t *testing.T, h *stream.Handler, message string) ([]string, error) {
+	resp := &response{}
+	err := h.Process(context.Background(), &request{message: message}, resp)
+	return resp.messages, err
+}
+
+func TestHandler_Len(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := process(t, h, client.CmdLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "3" {
+		t.Errorf("expected 3, got %v", messages)
+	}
+
+	if _, err := process(t, h, client.CmdDelete+" 1"); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = process(t, h, client.CmdLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "2" {
+		t.Errorf("expected 2, got %v", messages)
+	}
+}
+
+func TestHandler_DeleteRange(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages, err := process(t, h, (&client.DeleteRange{From: 1, To: 10}).String()); err != nil || len(messages) != 1 || messages[0] != "2" {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+	if messages, _ := process(t, h, client.CmdLen); len(messages) != 1 || messages[0] != "1" {
+		t.Errorf("unexpected length %v", messages)
+	}
+	for _, message := range []string{"DELRANGE 2 1", "DELRANGE -1 1", "DELRANGE 1"} {
+		if _, err := process(t, h, message); !errors.Is(err, stream.ErrIncorrectCmd) {
+			t.Errorf("%s: expected %s, got %v", message, stream.ErrIncorrectCmd, err)
+		}
+	}
+}
+
+func TestHandler_Compact(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c", "d"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := process(t, h, (&client.DeleteRange{From: 0, To: 2}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := process(t, h, (&client.Compact{}).String()); err != nil || len(messages) != 1 || messages[0] != "2" {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+	// GET pushes the values from the epoch on.
+	for n, expected := range map[int]string{2: "c", 3: "d"} {
+		if messages, err := process(t, h, (&client.Get{N: n}).String()); err != nil || len(messages) == 0 || messages[0] != expected {
+			t.Errorf("%d: unexpected %v %v", n, messages, err)
+		}
+	}
+	if _, err := process(t, h, client.CmdCompact+" 1"); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_ErrorResponse(t *testing.T) {
+	h := newHandler(t)
+	cases := []struct {
+		message string
+		code    string
+	}{
+		{"FOO 1", client.CodeUnknownCmd},
+		{client.CmdGet + " a", client.CodeIncorrectCmd},
+		{client.CmdDelete + " 10", client.CodeOutOfRange},
+	}
+	for _, c := range cases {
+		messages, err := process(t, h, c.message)
+		if err == nil {
+			t.Errorf("%s: expected error", c.message)
+			continue
+		}
+		if len(messages) != 1 {
+			t.Errorf("%s: expected one response, got %v", c.message, messages)
+			continue
+		}
+		nodeErr, ok := (&client.Response{Message: messages[0]}).Err().(*client.Error)
+		if !ok {
+			t.Errorf("%s: %s is not an error response", c.message, messages[0])
+			continue
+		}
+		if nodeErr.Code != c.code {
+			t.Errorf("%s: %s != %s", c.message, nodeErr.Code, c.code)
+		}
+	}
+}
+
+func TestHandler_PullTimeout(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp := &response{}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(ctx, &request{message: client.CmdPull + " 0"}, resp)
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pull has not returned after the deadline")
+	}
+	if len(resp.messages) == 0 || resp.messages[0] != "a" {
+		t.Errorf("unexpected pull results %v", resp.messages)
+	}
+
+	// The log must not be blocked by the finished subscription.
+	if _, err := process(t, h, client.CmdPush+" b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandler_Ping(t *testing.T) {
+	h := newHandler(t)
+	for _, message := range []string{client.CmdPing, client.CmdPing + " trailing args"} {
+		messages, err := process(t, h, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0] != client.CmdPong {
+			t.Errorf("%s: expected %s, got %v", message, client.CmdPong, messages)
+		}
+	}
+}
+
+func TestHandler_PushBatch(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, (&client.PushBatch{V: []string{"b", "c d"}}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != client.CmdOK+" 1" {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	if _, err := process(t, h, client.CmdPushBatch+" 3 e f"); err != stream.ErrIncorrectCmd {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+
+	expected := []string{"a", "b", "c d"}
+	messages, err = process(t, h, client.CmdGet+" 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("%v != %v", messages, expected)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Errorf("%v != %v", messages, expected)
+		}
+	}
+
+	lg, _ := storage.NewLog()
+	h, _ = stream.NewHandler(lg, &paxos{peers: 2})
+	if _, err := process(t, h, (&client.PushBatch{V: []string{"a"}}).String()); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("the node with peers must refuse the batch, got %v", err)
+	}
+}
+
+func TestHandler_Close(t *testing.T) {
+	h := newHandler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	pulled := make(chan error, 1)
+	go func() {
+		pulled <- h.Process(ctx, &request{message: client.CmdPull + " 0"}, &response{})
+	}()
+	// Let the subscription start.
+	time.Sleep(20 * time.Millisecond)
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer closeCancel()
+	if err := h.Close(closeCtx); err != context.DeadlineExceeded {
+		t.Errorf("close must wait for the pull, got %v", err)
+	}
+
+	if _, err := process(t, h, client.CmdPush+" a"); err != stream.ErrShuttingDown {
+		t.Errorf("expected %s, got %v", stream.ErrShuttingDown, err)
+	}
+	if _, err := process(t, h, client.CmdPull+" 0"); err != stream.ErrShuttingDown {
+		t.Errorf("expected %s, got %v", stream.ErrShuttingDown, err)
+	}
+
+	cancel()
+	<-pulled
+	if err := h.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+type observation struct {
+	cmd string
+	dur time.Duration
+	err error
+}
+
+type metrics struct {
+	m            sync.Mutex
+	observations []observation
+}
+
+func (m *metrics) ObserveCommand(cmd string, dur time.Duration, err error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.observations = append(m.observations, observation{cmd: cmd, dur: dur, err: err})
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	lg, _ := storage.NewLog()
+	m := &metrics{}
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, h, client.CmdPush+" a")
+	process(t, h, client.CmdGet+" 0")
+	process(t, h, "FOO")
+
+	expected := []observation{
+		{cmd: client.CmdPush},
+		{cmd: client.CmdGet},
+		{cmd: "", err: stream.ErrUnknownCmd},
+	}
+	if len(m.observations) != len(expected) {
+		t.Fatalf("%v != %v", m.observations, expected)
+	}
+	for i := range expected {
+		if m.observations[i].cmd != expected[i].cmd || m.observations[i].err != expected[i].err {
+			t.Errorf("%v != %v", m.observations[i], expected[i])
+		}
+		if m.observations[i].dur <= 0 {
+			t.Errorf("%s: duration is not measured", m.observations[i].cmd)
+		}
+	}
+}
+
+// streamMetrics groups the observed commands by the stream.
+type streamMetrics struct {
+	metrics
+	streams map[string][]string
+}
+
+func (m *streamMetrics) ObserveStreamCommand(stream, cmd string, dur time.Duration, err error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.streams[stream] = append(m.streams[stream], cmd)
+}
+
+func TestHandler_StreamMetrics(t *testing.T) {
+	m := &streamMetrics{streams: map[string][]string{}}
+	h, err := stream.NewHandler(nil, &paxos{}, stream.WithMetrics(m), stream.WithLogFactory(func(name string) (stream.Log, error) {
+		return storage.NewLog()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []request{
+		{message: (&client.Push{V: "a"}).String(), name: "orders"},
+		{message: (&client.Push{V: "b"}).String(), name: "orders"},
+		{message: (&client.Push{V: "c"}).String(), name: "events"},
+		{message: client.CmdLen, name: "events"},
+	} {
+		r := r
+		if err := h.Process(context.Background(), &r, &response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string][]string{
+		"orders": {client.CmdPush, client.CmdPush},
+		"events": {client.CmdPush, client.CmdLen},
+	}
+	if fmt.Sprint(m.streams) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, m.streams)
+	}
+	if len(m.observations) != 0 {
+		t.Errorf("the stream commands are observed without the stream: %v", m.observations)
+	}
+
+	// The single log has no stream name.
+	m = &streamMetrics{streams: map[string][]string{}}
+	lg, _ := storage.NewLog()
+	if h, err = stream.NewHandler(lg, &paxos{}, stream.WithMetrics(m)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, client.CmdLen); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.streams[""]) != 1 {
+		t.Errorf("unexpected %v", m.streams)
+	}
+}
+
+type streamResponse struct {
+	messages chan string
+}
+
+func (r *streamResponse) Push(message string) {
+	r.messages <- message
+}
+
+func TestHandler_PullFollow(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := &streamResponse{messages: make(chan string)}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(ctx, &request{message: (&client.Pull{N: 0, Follow: true}).String()}, resp)
+	}()
+	// Let the subscription start.
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := process(t, h, client.CmdPush+" b"); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-resp.messages; message != "b" {
+		t.Errorf("expected b, got %s", message)
+	}
+
+	cancel()
+	for {
+		select {
+		case <-resp.messages:
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("expected %s, got %v", context.Canceled, err)
+			}
+			return
+		}
+	}
+}
+
+func TestHandler_Middleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) stream.Middleware {
+		return func(next stream.ProcessFunc) stream.ProcessFunc {
+			return func(ctx context.Context, message stream.ServerRequest, response stream.ServerResponse) error {
+				calls = append(calls, name)
+				return next(ctx, message, response)
+			}
+		}
+	}
+	errDenied := errors.New("denied")
+	deny := func(next stream.ProcessFunc) stream.ProcessFunc {
+		return func(ctx context.Context, message stream.ServerRequest, response stream.ServerResponse) error {
+			if message.Message() == client.CmdLen {
+				return errDenied
+			}
+			return next(ctx, message, response)
+		}
+	}
+
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithMiddleware(trace("first"), trace("second"), deny))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := process(t, h, client.CmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != client.CmdPong {
+		t.Errorf("unexpected response %v", messages)
+	}
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("unexpected order %v", calls)
+	}
+
+	messages, err = process(t, h, client.CmdLen)
+	if err != errDenied {
+		t.Errorf("expected %s, got %v", errDenied, err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("short-circuited request must not be processed, got %v", messages)
+	}
+}
+
+// peersOnly forbids Paxos commands for the clients except the peer node.
+type peersOnly struct {
+	peer string
+}
+
+func (a *peersOnly) Allow(ctx context.Context, cmd string, req stream.ServerRequest) error {
+	switch cmd {
+	case client.CmdPrepare, client.CmdAccept, client.CmdSet:
+		if req.Name() != a.peer {
+			return errors.New("paxos commands are allowed only for peers")
+		}
+	}
+	return nil
+}
+
+func TestHandler_Authorizer(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithAuthorizer(&peersOnly{peer: "node2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Errorf("push must be allowed: %s", err)
+	}
+	messages, err := process(t, h, client.CmdPrepare+" 5")
+	if !errors.Is(err, stream.ErrUnauthorized) {
+		t.Errorf("expected %s, got %v", stream.ErrUnauthorized, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeUnauthorized {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+// identifiedRequest is the request with the identity verified by the transport.
+type identifiedRequest struct {
+	request
+	identity string
+}
+
+func (r *identifiedRequest) Identity() string {
+	return r.identity
+}
+
+// identityOnly allows the writes to the requests with the identity.
+type identityOnly struct {
+	identity string
+}
+
+func (a *identityOnly) Allow(ctx context.Context, cmd string, req stream.ServerRequest) error {
+	if stream.CommandCategory(cmd) == stream.CategoryWrite && stream.IdentityOf(req) != a.identity {
+		return errors.New("writes are allowed only for the identified clients")
+	}
+	return nil
+}
+
+func TestHandler_Identity(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithAuthorizer(&identityOnly{identity: "writer"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := client.CmdPush + " a"
+	// The name is chosen by the client and is not trusted.
+	if err := h.Process(context.Background(), &request{message: push, name: "writer"}, &response{}); !errors.Is(err, stream.ErrUnauthorized) {
+		t.Errorf("expected %s, got %v", stream.ErrUnauthorized, err)
+	}
+	identified := &identifiedRequest{request: request{message: push}, identity: "writer"}
+	if err := h.Process(context.Background(), identified, &response{}); err != nil {
+		t.Errorf("push must be allowed: %s", err)
+	}
+	// The identity survives stripping the trace ID.
+	identified.message = "trace:abc " + push
+	if err := h.Process(context.Background(), identified, &response{}); err != nil {
+		t.Errorf("traced push must be allowed: %s", err)
+	}
+	if stream.IdentityOf(&request{}) != "" {
+		t.Error("plain request must have no identity")
+	}
+}
+
+func TestHandler_PanicRecovery(t *testing.T) {
+	// Nil log makes every log command panic.
+	lg := &logger{}
+	h, err := stream.NewHandler(nil, &paxos{}, stream.WithLogger(lg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, client.CmdLen)
+	if !errors.Is(err, stream.ErrInternal) {
+		t.Errorf("expected %s, got %v", stream.ErrInternal, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err() == nil {
+		t.Errorf("unexpected response %v", messages)
+	}
+	var stack interface{}
+	for _, entry := range lg.entries {
+		if entry.level == "error" && entry.msg == "panic" {
+			stack = entry.value("stack")
+		}
+	}
+	if s, ok := stack.(string); !ok || !strings.Contains(s, "goroutine") {
+		t.Errorf("the panic stack is not logged: %v", lg.entries)
+	}
+
+	h, err = stream.NewHandler(nil, &paxos{}, stream.WithPanicRecovery(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic with disabled recovery")
+		}
+	}()
+	process(t, h, client.CmdLen)
+}
+
+func TestHandler_Status(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := process(t, h, client.CmdStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		client.StatusLen:         "2",
+		client.StatusProposal:    "2",
+		client.StatusLeader:      "true",
+		client.StatusSubscribers: "0",
+		client.StatusDrained:     "false",
+		client.StatusRole:        stream.RoleVoter,
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("unexpected status %v", messages)
+	}
+	for _, message := range messages {
+		key, value, err := (&client.Response{Message: message}).Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected[key] != value {
+			t.Errorf("%s: %s != %s", key, value, expected[key])
+		}
+	}
+
+	if brief, err := process(t, h, client.CmdStatus+" brief"); err != nil || len(brief) != len(expected) {
+		t.Errorf("unexpected brief status %v %v", brief, err)
+	}
+	verbose, err := process(t, h, (&client.Status{Verbose: true}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verbose) != len(expected)+3 || !contains(verbose, client.StatusCommitted+"=1") || !contains(verbose, client.StatusPeers+"=0") {
+		t.Errorf("unexpected verbose status %v", verbose)
+	}
+	for _, message := range []string{client.CmdStatus + " all", client.CmdStatus + " verbose 1"} {
+		if _, err := process(t, h, message); !errors.Is(err, stream.ErrIncorrectCmd) {
+			t.Errorf("%s: expected %s, got %v", message, stream.ErrIncorrectCmd, err)
+		}
+	}
+}
+
+func TestHandler_StatusLatency(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	process(t, h, client.CmdLen)
+	stats, err := process(t, h, (&client.Status{Latency: true, Reset: true}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || !strings.HasPrefix(stats[0], "cmd=len avg=") || !strings.HasPrefix(stats[1], "cmd=push avg=") {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+	for _, line := range stats {
+		fields := strings.Fields(line)
+		avg, err := time.ParseDuration(strings.TrimPrefix(fields[1], "avg="))
+		if err != nil || avg <= 0 {
+			t.Errorf("%s: unexpected avg %v", line, err)
+		}
+		p99, err := time.ParseDuration(strings.TrimPrefix(fields[2], "p99="))
+		if err != nil || p99 < avg {
+			t.Errorf("%s: unexpected p99 %v", line, err)
+		}
+	}
+	// The reset has cleared everything but the STATUS itself.
+	if stats, _ := process(t, h, (&client.Status{Latency: true}).String()); len(stats) != 1 || !strings.HasPrefix(stats[0], "cmd=status ") {
+		t.Errorf("unexpected stats after reset %v", stats)
+	}
+	if _, err := process(t, h, client.CmdStatus+" LATENCY ALL"); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_BumpN(t *testing.T) {
+	h := newHandler(t)
+	if messages, err := process(t, h, (&client.BumpN{N: 100}).String()); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if messages, _ := process(t, h, client.CmdStatus); !contains(messages, client.StatusProposal+"=101") {
+		t.Errorf("the proposal is not above the floor: %v", messages)
+	}
+	for _, message := range []string{"BUMPN", "BUMPN -1", "BUMPN 1 2"} {
+		if _, err := process(t, h, message); !errors.Is(err, stream.ErrIncorrectCmd) {
+			t.Errorf("%s: expected %s, got %v", message, stream.ErrIncorrectCmd, err)
+		}
+	}
+}
+
+func TestHandler_Redirect(t *testing.T) {
+	lg, _ := storage.NewLog()
+	leader := &paxos{leader: "localhost:7001", self: true}
+	h, _ := stream.NewHandler(lg, leader)
+	messages, err := process(t, h, client.CmdPush+" a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Errorf("leader must accept the write, got %v", messages)
+	}
+
+	lg, _ = storage.NewLog()
+	follower := &paxos{leader: "localhost:7001"}
+	h, _ = stream.NewHandler(lg, follower)
+	messages, err = process(t, h, client.CmdPush+" a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("unexpected response %v", messages)
+	}
+	if addr, ok := (&client.Response{Message: messages[0]}).Redirect(); !ok || addr != "localhost:7001" {
+		t.Errorf("follower must redirect to the leader, got %v", messages)
+	}
+	if follower.n != 0 {
+		t.Error("redirected write must not be committed")
+	}
+	if messages, _ := process(t, h, client.CmdGet+" 0"); len(messages) != 0 {
+		t.Errorf("reads are served locally, got %v", messages)
+	}
+
+	// The named streams are local to the node, the follower appends the value itself.
+	h, _ = stream.NewHandler(nil, follower, stream.WithLogFactory(func(name string) (stream.Log, error) {
+		return storage.NewLog()
+	}))
+	if messages, err := process(t, h, client.CmdPush+" a"); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Errorf("the named stream must not redirect, got %v %v", messages, err)
+	}
+	if messages, _ := process(t, h, client.CmdGet+" 0"); len(messages) != 1 || messages[0] != "a" {
+		t.Errorf("unexpected values %v", messages)
+	}
+}
+
+func TestHandler_MaxMessageSize(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, _ := stream.NewHandler(lg, &paxos{}, stream.WithMaxMessageSize(8))
+
+	// "PUSH abc" is exactly 8 bytes.
+	if _, err := process(t, h, client.CmdPush+" abc"); err != nil {
+		t.Errorf("message under the limit must be accepted: %s", err)
+	}
+	if _, err := process(t, h, client.CmdPush+" abcd"); err != stream.ErrMessageTooLarge {
+		t.Errorf("expected %s, got %v", stream.ErrMessageTooLarge, err)
+	}
+}
+
+func TestHandler_Commit(t *testing.T) {
+	h := newHandler(t)
+	messages, err := process(t, h, (&client.Commit{V: "a b"}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || !strings.HasPrefix(messages[0], "0 ") || !strings.HasSuffix(messages[0], " a b") ||
+		messages[1] != client.CmdOK {
+		t.Errorf("expected the accepted value and OK, got %v", messages)
+	}
+	if messages, _ := process(t, h, client.CmdGet+" 0"); len(messages) != 1 || messages[0] != "a b" {
+		t.Errorf("committed value must be in the log, got %v", messages)
+	}
+
+	lg, _ := storage.NewLog()
+	errQuorum := errors.New("quorum failed")
+	h, _ = stream.NewHandler(lg, &paxos{err: errQuorum})
+	messages, err = process(t, h, client.CmdCommit+" a")
+	if err != errQuorum {
+		t.Errorf("expected %s, got %v", errQuorum, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err() == nil {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_CommitRetry(t *testing.T) {
+	lg, _ := storage.NewLog()
+	px := &paxos{failures: 2}
+	h, _ := stream.NewHandler(lg, px, stream.WithCommitRetry(3))
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+	if px.commits != 3 {
+		t.Errorf("expected 3 rounds, got %d", px.commits)
+	}
+	if px.ids[0] == "" || px.ids[1] != px.ids[0] || px.ids[2] != px.ids[0] {
+		t.Errorf("retries must reuse the proposal id, got %v", px.ids)
+	}
+	if process(t, h, client.CmdPush+" a"); px.ids[3] == px.ids[0] {
+		t.Errorf("the next write must have the new proposal id, got %v", px.ids)
+	}
+
+	px = &paxos{failures: 5}
+	h, _ = stream.NewHandler(lg, px, stream.WithCommitRetry(3))
+	_, err := process(t, h, client.CmdPush+" a")
+	if !errors.Is(err, stream.ErrQuorumFailed) || !strings.Contains(err.Error(), "3 attempts") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	px = &paxos{failures: 5, delay: 30 * time.Millisecond}
+	h, _ = stream.NewHandler(lg, px, stream.WithCommitRetry(5))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = h.Process(ctx, &request{message: client.CmdPush + " a"}, &response{})
+	if !errors.Is(err, context.DeadlineExceeded) || px.commits != 1 {
+		t.Errorf("cancelled context must abort retries, got %v after %d rounds", err, px.commits)
+	}
+}
+
+func TestHandler_JSON(t *testing.T) {
+	h := newHandler(t)
+	messages, err := process(t, h, `{"cmd":"push","args":["a b"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != `{"message":"OK"}` {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	messages, err = process(t, h, `{"cmd":"GET","args":["0"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != `{"message":"a b"}` {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	messages, _ = process(t, h, `{"cmd":"GET"}`)
+	if len(messages) != 1 || messages[0] != `{"error":"incorrect_cmd","message":"incorrect cmd"}` {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	// The text protocol stays the default.
+	messages, _ = process(t, h, client.CmdGet+" 0")
+	if len(messages) != 1 || messages[0] != "a b" {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_PushIdempotent(t *testing.T) {
+	lg, _ := storage.NewLog()
+	px := &paxos{}
+	h, _ := stream.NewHandler(lg, px)
+	push := (&client.Push{V: "a b", Key: "k1"}).String()
+	messages, err := process(t, h, push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != client.CmdOK+" 0" {
+		t.Errorf("unexpected response %v", messages)
+	}
+	messages, err = process(t, h, push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != client.CmdOK+" 0 "+client.PushDedup {
+		t.Errorf("unexpected response %v", messages)
+	}
+	messages, _ = process(t, h, client.CmdLen)
+	if len(messages) != 1 || messages[0] != "1" {
+		t.Errorf("expected single value, got %v", messages)
+	}
+	if px.commits != 1 {
+		t.Errorf("the keyed value must be committed once, got %d rounds", px.commits)
+	}
+
+	// The index is the one chosen by Paxos.
+	process(t, h, client.CmdPush+" c")
+	messages, _ = process(t, h, (&client.Push{V: "d", Key: "k2"}).String())
+	if len(messages) != 1 || messages[0] != client.CmdOK+" 2" {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_TraceID(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithMiddleware(func(next stream.ProcessFunc) stream.ProcessFunc {
+		return func(ctx context.Context, message stream.ServerRequest, response stream.ServerResponse) error {
+			if id := stream.TraceIDFromContext(ctx); id != "abc" {
+				t.Errorf("unexpected trace ID %q", id)
+			}
+			if message.Message() != client.CmdGet {
+				t.Errorf("trace ID is not stripped from %q", message.Message())
+			}
+			return next(ctx, message, response)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, stream.TracePrefix+"abc "+client.CmdGet)
+	if !errors.Is(err, stream.ErrIncorrectCmd) || !strings.Contains(err.Error(), "abc") {
+		t.Errorf("expected traced %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+	if len(messages) != 1 || !strings.HasPrefix(messages[0], client.CmdErr+" "+client.CodeIncorrectCmd) {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_Watch(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, (&client.Watch{N: 0}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "a" {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		process(t, h, client.CmdPush+" b")
+	}()
+	messages, err = process(t, h, (&client.Watch{N: 1}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "b" {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithRateLimit(stream.CategoryWrite, 0.001, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := process(t, h, client.CmdPush+" a")
+	if err != stream.ErrRateLimited {
+		t.Errorf("expected %s, got %v", stream.ErrRateLimited, err)
+	}
+	if len(messages) != 1 || !strings.HasPrefix(messages[0], client.CmdErr+" "+client.CodeRateLimited) {
+		t.Errorf("unexpected response %v", messages)
+	}
+	// Reads are not limited.
+	if _, err := process(t, h, client.CmdLen); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandler_Prepare(t *testing.T) {
+	cases := []struct {
+		paxos    *paxos
+		expected string
+		promise  client.Promise
+	}{
+		{
+			paxos:    &paxos{n: 3},
+			expected: client.CmdPromise,
+			promise:  client.Promise{Promise: true},
+		},
+		{
+			paxos:    &paxos{n: 3, previous: &acceptMessage{n: 2, id: "id", v: "a b"}},
+			expected: client.CmdPromise + " 2 id a b",
+			promise:  client.Promise{Promise: true, Previous: true, N: 2, ID: "id", V: "a b"},
+		},
+		{
+			paxos:    &paxos{n: 7, reject: true},
+			expected: client.CmdReject + " 7",
+			promise:  client.Promise{N: 7},
+		},
+		{
+			paxos:    &paxos{n: 7, reject: true, previous: &acceptMessage{n: 6, id: "id", v: "a"}},
+			expected: client.CmdReject + " 7",
+			promise:  client.Promise{N: 7},
+		},
+	}
+	for _, c := range cases {
+		lg, _ := storage.NewLog()
+		h, err := stream.NewHandler(lg, c.paxos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := process(t, h, (&client.Prepare{N: 5}).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0] != c.expected {
+			t.Errorf("expected %q, got %v", c.expected, messages)
+			continue
+		}
+		promise, err := (&client.Response{Message: messages[0] + "\n"}).Promise()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *promise != c.promise {
+			t.Errorf("expected %+v, got %+v", c.promise, *promise)
+		}
+	}
+}
+
+func TestHandler_First(t *testing.T) {
+	h := newHandler(t)
+	messages, err := process(t, h, (&client.First{}).String())
+	if err != stream.ErrEmptyLog {
+		t.Errorf("expected %s, got %v", stream.ErrEmptyLog, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeEmptyLog {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	for _, v := range []string{"a", "b", "c d"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := process(t, h, (&client.Truncate{KeepLast: 2}).String()); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		request  client.Request
+		expected client.Entry
+	}{
+		{&client.First{}, client.Entry{N: 1, V: "b"}},
+		{&client.Last{}, client.Entry{N: 2, V: "c d"}},
+	}
+	for _, c := range cases {
+		messages, err := process(t, h, c.request.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 {
+			t.Fatalf("unexpected response %v", messages)
+		}
+		entry, err := (&client.Response{Message: messages[0]}).Entry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *entry != c.expected {
+			t.Errorf("expected %+v, got %+v", c.expected, *entry)
+		}
+	}
+}
+
+// countingResponse counts the pulled values and stops the pull after the expected number.
+type countingResponse struct {
+	gzip     bool
+	expected int
+	cancel   context.CancelFunc
+
+	values []string
+	bytes  int
+	err    error
+}
+
+func (r *countingResponse) Push(message string) {
+	// The error frame of the canceled pull follows.
+	if len(r.values) >= r.expected || r.err != nil {
+		return
+	}
+	r.bytes += len(message) + 1
+	if !r.gzip {
+		r.values = append(r.values, message)
+	} else if batch, err := client.DecodeBatch(message); err != nil {
+		r.err = err
+	} else {
+		r.values = append(r.values, batch...)
+	}
+	if len(r.values) >= r.expected || r.err != nil {
+		r.cancel()
+	}
+}
+
+func pullAll(h *stream.Handler, expected int, gzip bool) *countingResponse {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := &countingResponse{gzip: gzip, expected: expected, cancel: cancel}
+	h.Process(ctx, &request{message: (&client.Pull{N: 0, Gzip: gzip}).String()}, resp)
+	return resp
+}
+
+func TestHandler_PullGzip(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a", "b c", "d\ne", ""}
+	if _, err := lg.SetBatch(context.Background(), expected); err != nil {
+		t.Fatal(err)
+	}
+	resp := pullAll(h, len(expected), true)
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if len(resp.values) != len(expected) {
+		t.Fatalf("%q != %q", resp.values, expected)
+	}
+	for i := range expected {
+		if resp.values[i] != expected[i] {
+			t.Errorf("%q != %q", resp.values[i], expected[i])
+		}
+	}
+}
+
+func benchmarkPull(b *testing.B, gzip bool) {
+	const entries = 10000
+	lg, _ := storage.NewLog()
+	values := make([]string, entries)
+	for i := range values {
+		values[i] = fmt.Sprintf("{\"event\":\"click\",\"user\":%d,\"page\":\"/items/%d\"}", i%100, i%1000)
+	}
+	if _, err := lg.SetBatch(context.Background(), values); err != nil {
+		b.Fatal(err)
+	}
+	h, err := stream.NewHandler(lg, &paxos{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	transferred := 0
+	for i := 0; i < b.N; i++ {
+		resp := pullAll(h, entries, gzip)
+		if resp.err != nil || len(resp.values) != entries {
+			b.Fatalf("pulled %d values: %v", len(resp.values), resp.err)
+		}
+		transferred += resp.bytes
+	}
+	b.ReportMetric(float64(transferred)/float64(b.N), "bytes/pull")
+}
+
+func BenchmarkHandler_Pull(b *testing.B) {
+	benchmarkPull(b, false)
+}
+
+func BenchmarkHandler_PullGzip(b *testing.B) {
+	benchmarkPull(b, true)
+}
+
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+type logger struct {
+	entries []logEntry
+}
+
+func (l *logger) Debug(msg string, keyvals ...interface{}) {
+	l.entries = append(l.entries, logEntry{"debug", msg, keyvals})
+}
+
+func (l *logger) Info(msg string, keyvals ...interface{}) {
+	l.entries = append(l.entries, logEntry{"info", msg, keyvals})
+}
+
+func (l *logger) Error(msg string, keyvals ...interface{}) {
+	l.entries = append(l.entries, logEntry{"error", msg, keyvals})
+}
+
+func (e logEntry) value(key string) interface{} {
+	for i := 0; i+1 < len(e.keyvals); i += 2 {
+		if e.keyvals[i] == key {
+			return e.keyvals[i+1]
+		}
+	}
+	return nil
+}
+
+func TestHandler_Logger(t *testing.T) {
+	lg, _ := storage.NewLog()
+	l := &logger{}
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithLogger(l), stream.WithLogRedaction(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(t, h, client.CmdPush+" secret")
+	process(t, h, client.CmdGet)
+
+	if len(l.entries) != 4 {
+		t.Fatalf("unexpected log %v", l.entries)
+	}
+	received, done, failed := l.entries[0], l.entries[1], l.entries[3]
+	if received.level != "debug" || received.value("message") != client.CmdPush+" [redacted]" {
+		t.Errorf("unexpected entry %v", received)
+	}
+	if done.level != "info" || done.value("cmd") != client.CmdPush || done.value("address") != "localhost:7000" {
+		t.Errorf("unexpected entry %v", done)
+	}
+	if failed.level != "error" || failed.value("cmd") != client.CmdGet || failed.value("error") != stream.ErrIncorrectCmd {
+		t.Errorf("unexpected entry %v", failed)
+	}
+}
+
+func TestHandler_GetLinearizable(t *testing.T) {
+	lg, _ := storage.NewLog()
+	// The value 1 is committed in the cluster but not set on this node yet.
+	h, err := stream.NewHandler(lg, &paxos{n: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lg.Set(context.Background(), 0, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := process(t, h, (&client.Get{N: 0}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "a" {
+		t.Errorf("unexpected local read %v", messages)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		process(t, h, (&client.Set{N: 1, ID: "id", V: "b"}).String())
+	}()
+	messages, err = process(t, h, (&client.Get{N: 0, Linearizable: true}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[1] != "b" {
+		t.Errorf("unexpected linearizable read %v", messages)
+	}
+
+	if _, err := process(t, h, client.CmdGet+" 0 garbage"); err != stream.ErrIncorrectCmd {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+// failingGetLog fails every GET with the error.
+type failingGetLog struct {
+	stream.Log
+	err error
+}
+
+func (l *failingGetLog) Get(ctx context.Context, n int) ([]string, error) {
+	return nil, l.err
+}
+
+// failingSetLog fails to store the values chosen by Paxos.
+type failingSetLog struct {
+	stream.Log
+	err error
+}
+
+func (l *failingSetLog) SetID(ctx context.Context, n int, id, v string) error {
+	return l.err
+}
+
+// deadLetter is the recorded DeadLetter call.
+type deadLetter struct {
+	message string
+	err     error
+}
+
+func TestHandler_DeadLetter(t *testing.T) {
+	lg, _ := storage.NewLog()
+	failing := &failingSetLog{Log: lg, err: errors.New("disk is full")}
+	letters := make(chan deadLetter, 1)
+	h, err := stream.NewHandler(failing, &paxos{}, stream.WithDeadLetter(func(ctx context.Context, req stream.ServerRequest, err error) {
+		letters <- deadLetter{message: req.Message(), err: err}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := (&client.Push{V: "a"}).String()
+	messages, err := process(t, h, push)
+	if !errors.Is(err, failing.err) {
+		t.Fatalf("expected %s, got %v", failing.err, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err() == nil {
+		t.Errorf("the error is not pushed: %v", messages)
+	}
+	select {
+	case letter := <-letters:
+		if letter.message != push || !errors.Is(letter.err, failing.err) {
+			t.Errorf("unexpected dead letter %+v", letter)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the dead letter hook is not called")
+	}
+
+	// The failed reads are not dead letters.
+	if _, err := process(t, h, client.CmdGet+" a"); err == nil {
+		t.Fatal("expected the error")
+	}
+	select {
+	case letter := <-letters:
+		t.Errorf("unexpected dead letter %+v", letter)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// partialLog fails the first batch on its third value.
+type partialLog struct {
+	stream.Log
+	err    error
+	failed bool
+}
+
+func (l *partialLog) SetBatch(ctx context.Context, vs []string) (int, error) {
+	if l.failed || len(vs) < 3 {
+		return l.Log.SetBatch(ctx, vs)
+	}
+	l.failed = true
+	base, err := l.Log.SetBatch(ctx, vs[:2])
+	if err != nil {
+		return 0, err
+	}
+	return base, &stream.PartialWriteError{Written: 2, Err: l.err}
+}
+
+func TestHandler_PushBatchPartial(t *testing.T) {
+	lg, _ := storage.NewLog()
+	partial := &partialLog{Log: lg, err: errors.New("disk is full")}
+	h, err := stream.NewHandler(partial, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := []string{"a", "b", "c", "d", "e"}
+	messages, err := process(t, h, (&client.PushBatch{V: vs}).String())
+	if !errors.Is(err, partial.err) {
+		t.Fatalf("expected %s, got %v", partial.err, err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("unexpected %v", messages)
+	}
+	written, ok := (&client.Response{Message: messages[0]}).Partial()
+	if !ok || written != 2 {
+		t.Fatalf("unexpected %v", messages)
+	}
+	if (&client.Response{Message: messages[1]}).Err() == nil {
+		t.Errorf("the error does not follow %v", messages)
+	}
+
+	// The client resumes from the first value not written.
+	if messages, err := process(t, h, (&client.PushBatch{V: vs[written:]}).String()); err != nil || len(messages) != 1 || messages[0] != "OK 2" {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if values, _ := lg.Get(context.Background(), 0); strings.Join(values, "") != "abcde" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestHandler_GetDefault(t *testing.T) {
+	h := newHandler(t)
+	fallback := "none yet"
+	get := func(n int) []string {
+		t.Helper()
+		messages, err := process(t, h, (&client.Get{N: n, Default: &fallback}).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return messages
+	}
+	if messages := get(0); len(messages) != 1 || messages[0] != fallback {
+		t.Errorf("expected the default for the empty log, got %v", messages)
+	}
+	for _, v := range []string{"a", "b"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages := get(1); len(messages) != 1 || messages[0] != "b" {
+		t.Errorf("unexpected values %v", messages)
+	}
+	if messages := get(5); len(messages) != 1 || messages[0] != fallback {
+		t.Errorf("expected the default for the missing index, got %v", messages)
+	}
+
+	// The trimmed value is missing as well.
+	if _, err := process(t, h, (&client.Retention{Count: 1}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Push{V: "c"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if messages := get(0); len(messages) != 1 || messages[0] != fallback {
+		t.Errorf("expected the default for the trimmed index, got %v", messages)
+	}
+
+	if _, err := process(t, h, client.CmdGet+" 0 DEFAULT"); err != stream.ErrIncorrectCmd {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+
+	// The failure of the log is not replaced with the default.
+	lg, _ := storage.NewLog()
+	failure := errors.New("disk failure")
+	h, err := stream.NewHandler(&failingGetLog{Log: lg, err: failure}, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Get{N: 0, Default: &fallback}).String()); !errors.Is(err, failure) {
+		t.Errorf("expected %v, got %v", failure, err)
+	}
+}
+
+func TestHandler_Committed(t *testing.T) {
+	h := newHandler(t)
+	messages, err := process(t, h, (&client.Committed{}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "-1" {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	if _, err := process(t, h, (&client.Push{V: "a"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	// The batch is staged in the local log only.
+	if _, err := process(t, h, (&client.PushBatch{V: []string{"b", "c"}}).String()); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = process(t, h, (&client.Committed{}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "0" {
+		t.Errorf("unexpected response %v", messages)
+	}
+	messages, _ = process(t, h, client.CmdLen)
+	if len(messages) != 1 || messages[0] != "3" {
+		t.Errorf("unexpected length %v", messages)
+	}
+}
+
+func TestHandler_NamedStreams(t *testing.T) {
+	created := map[string]int{}
+	factory := func(name string) (stream.Log, error) {
+		created[name]++
+		return storage.NewLog()
+	}
+	px := &paxos{}
+	h, err := stream.NewHandler(nil, px, stream.WithLogFactory(factory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	named := func(name, message string) []string {
+		resp := &response{}
+		if err := h.Process(context.Background(), &request{message: message, name: name}, resp); err != nil {
+			t.Fatalf("%s %s: %s", name, message, err)
+		}
+		return resp.messages
+	}
+	named("a", (&client.Push{V: "a1"}).String())
+	named("a", (&client.Push{V: "a2"}).String())
+	named("b", (&client.Push{V: "b1"}).String())
+
+	if messages := named("a", client.CmdGet+" 0"); len(messages) != 2 || messages[0] != "a1" || messages[1] != "a2" {
+		t.Errorf("unexpected stream a %v", messages)
+	}
+	// Every stream numbers its values from 0 without Paxos.
+	if messages := named("b", client.CmdFirst); len(messages) != 1 || messages[0] != "0 b1" {
+		t.Errorf("unexpected stream b %v", messages)
+	}
+	if px.commits != 0 {
+		t.Errorf("the named streams must skip Paxos, got %d rounds", px.commits)
+	}
+	if messages := named("c", client.CmdLen); len(messages) != 1 || messages[0] != "0" {
+		t.Errorf("unexpected stream c %v", messages)
+	}
+	if created["a"] != 1 || created["b"] != 1 || created["c"] != 1 {
+		t.Errorf("unexpected logs created %v", created)
+	}
+}
+
+func TestHandler_PushEmptyValue(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Push{V: ""}).String()); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, client.CmdPush)
+	if err != stream.ErrMissingValue {
+		t.Errorf("expected %s, got %v", stream.ErrMissingValue, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeMissingValue {
+		t.Errorf("unexpected response %v", messages)
+	}
+	messages, err = process(t, h, client.CmdGet+" 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "" {
+		t.Errorf("expected the single empty value, got %q", messages)
+	}
+}
+
+func TestHandler_Use(t *testing.T) {
+	h, err := stream.NewHandler(nil, &paxos{}, stream.WithLogFactory(func(name string) (stream.Log, error) {
+		return storage.NewLog()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two connections of the same client.
+	first := func(message string) []string {
+		resp := &response{}
+		if err := h.Process(context.Background(), &request{message: message}, resp); err != nil {
+			t.Fatalf("%s: %s", message, err)
+		}
+		return resp.messages
+	}
+	named := func(name, message string) []string {
+		resp := &response{}
+		if err := h.Process(context.Background(), &request{message: message, name: name}, resp); err != nil {
+			t.Fatalf("%s: %s", message, err)
+		}
+		return resp.messages
+	}
+
+	if messages := first((&client.Use{Stream: "a"}).String()); len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected response %v", messages)
+	}
+	first((&client.Push{V: "a1"}).String())
+	if messages := named("a", client.CmdLen); len(messages) != 1 || messages[0] != "1" {
+		t.Errorf("push has not reached the stream selected with USE: %v", messages)
+	}
+	// The explicit name overrides the session.
+	named("b", (&client.Push{V: "b1"}).String())
+	if messages := first(client.CmdLen); len(messages) != 1 || messages[0] != "1" {
+		t.Errorf("unexpected stream a length %v", messages)
+	}
+
+	h.EndSession("localhost:7000")
+	if messages := first(client.CmdLen); len(messages) != 1 || messages[0] != "0" {
+		t.Errorf("session is not cleared: %v", messages)
+	}
+}
+
+func TestHandler_Drain(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Drain{}).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []client.Request{
+		&client.Push{V: "b"},
+		&client.Set{N: 5, ID: "id", V: "b"},
+		&client.Delete{N: 0},
+		&client.Truncate{KeepLast: 0},
+	}
+	for _, w := range writes {
+		messages, err := process(t, h, w.String())
+		if err != stream.ErrReadOnly {
+			t.Errorf("%s: expected %s, got %v", w, stream.ErrReadOnly, err)
+		}
+		if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeReadOnly {
+			t.Errorf("%s: unexpected response %v", w, messages)
+		}
+	}
+
+	reads := []string{client.CmdGet + " 0", client.CmdPeek, client.CmdStatus, client.CmdLen}
+	for _, r := range reads {
+		if _, err := process(t, h, r); err != nil {
+			t.Errorf("%s: %s", r, err)
+		}
+	}
+	status, _ := process(t, h, client.CmdStatus)
+	if !contains(status, client.StatusDrained+"=true") {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	if _, err := process(t, h, (&client.Undrain{}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, client.CmdPush+" b"); err != nil {
+		t.Errorf("push after undrain: %s", err)
+	}
+}
+
+func contains(messages []string, message string) bool {
+	for _, m := range messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandler_MaxValueSize(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithMaxValueSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, client.CmdPush+" abc"); err != nil {
+		t.Errorf("value at the limit: %s", err)
+	}
+	messages, err := process(t, h, client.CmdPush+" abcd")
+	if err != stream.ErrValueTooLarge {
+		t.Errorf("expected %s, got %v", stream.ErrValueTooLarge, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeValueTooLarge {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_GetByID(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Set{N: 3, ID: "uuid", V: "a b"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, (&client.GetByID{ID: "uuid"}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "a b" {
+		t.Errorf("unexpected response %v", messages)
+	}
+	messages, err = process(t, h, (&client.GetByID{ID: "unknown"}).String())
+	if err != stream.ErrNotFound {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeNotFound {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_Mget(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "$b", "c d"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := process(t, h, (&client.Mget{N: []int{2, 7, 1, 0}}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		v     string
+		found bool
+	}{{"c d", true}, {"", false}, {"$b", true}, {"a", true}}
+	if len(messages) != len(expected) {
+		t.Fatalf("unexpected response %v", messages)
+	}
+	for i, e := range expected {
+		v, found := (&client.Response{Message: messages[i]}).MgetValue()
+		if v != e.v || found != e.found {
+			t.Errorf("%d: %q %t != %q %t", i, v, found, e.v, e.found)
+		}
+	}
+
+	if _, err := process(t, h, client.CmdMget+" 1 x"); !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("expected %s, got %v", strconv.ErrSyntax, err)
+	}
+}
+
+func TestHandler_Heartbeat(t *testing.T) {
+	p := &paxos{n: 5}
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &response{}
+	if err := h.Process(context.Background(), &request{message: (&client.Heartbeat{N: 5}).String(), name: "leader:7000"}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.messages) != 1 || resp.messages[0] != client.CmdOK || p.leader != "leader:7000" {
+		t.Errorf("unexpected response %v, leader %q", resp.messages, p.leader)
+	}
+	messages, _ := process(t, h, (&client.Heartbeat{N: 4}).String())
+	if len(messages) != 1 || messages[0] != client.CmdRefuse {
+		t.Errorf("stale heartbeat is not refused: %v", messages)
+	}
+}
+
+func TestHandler_Timeout(t *testing.T) {
+	h := newHandler(t)
+	start := time.Now()
+	messages, err := process(t, h, client.WithTimeout((&client.Watch{N: 5}).String(), 20*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("watch has not returned after the timeout")
+	}
+	if len(messages) != 1 || (&client.Response{Message: messages[0]}).Err().(*client.Error).Code != client.CodeTimeout {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	// The earlier inherited deadline wins.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = h.Process(ctx, &request{message: client.WithTimeout((&client.Watch{N: 5}).String(), time.Hour)}, &response{})
+	if err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("expected %s after the inherited deadline, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestHandler_Snapshot(t *testing.T) {
+	lg, _ := storage.NewLog()
+	path := filepath.Join(t.TempDir(), "snapshot")
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithSnapshotPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg.SetID(context.Background(), 0, "id0", "a")
+	lg.Set(context.Background(), 1, "b")
+	if messages, err := process(t, h, (&client.Snapshot{}).String()); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	restored, _ := storage.NewLog()
+	if err := restored.Restore(context.Background(), f); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := restored.GetByID(context.Background(), "id0"); err != nil || v != "a" {
+		t.Errorf("unexpected %q %v", v, err)
+	}
+	if n, _ := restored.Len(context.Background()); n != 2 {
+		t.Errorf("unexpected length %d", n)
+	}
+
+	if _, err := process(t, newHandler(t), (&client.Snapshot{}).String()); err != stream.ErrUnknownCmd {
+		t.Errorf("expected %s without the path, got %v", stream.ErrUnknownCmd, err)
+	}
+}
+
+func TestHandler_PullSlowSubscriber(t *testing.T) {
+	const values = 10
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithSlowSubscriberPolicy(stream.SlowCoalesce))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pull := func(ctx context.Context, policy string) ([]string, error) {
+		resp := &streamResponse{messages: make(chan string)}
+		done := make(chan error, 1)
+		message := (&client.Pull{N: 0, Buffer: 1, Follow: true, Policy: policy}).String()
+		go func() {
+			done <- h.Process(ctx, &request{message: message}, resp)
+		}()
+		// Let the subscription start.
+		time.Sleep(50 * time.Millisecond)
+		// Nobody reads the response, the writer must not block.
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			for i := 0; i < values; i++ {
+				lg.Set(context.Background(), i, strconv.Itoa(i))
+			}
+		}()
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatal("writer is blocked by the slow subscriber")
+		}
+		var messages []string
+		for {
+			select {
+			case m := <-resp.messages:
+				messages = append(messages, m)
+				if m == strconv.Itoa(values-1) {
+					return messages, nil
+				}
+			case err := <-done:
+				return messages, err
+			case <-time.After(time.Second):
+				t.Fatalf("pull hangs after %v", messages)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, err := pull(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) >= values {
+		t.Errorf("values are not coalesced: %v", messages)
+	}
+	cancel()
+
+	// DROP overrides the node policy.
+	messages, err = pull(context.Background(), client.PullDrop)
+	if err != stream.ErrOverflow {
+		t.Fatalf("expected %s, got %v after %v", stream.ErrOverflow, err, messages)
+	}
+	last := &client.Response{Message: messages[len(messages)-1]}
+	if e, ok := last.Err().(*client.Error); !ok || e.Code != client.CodeOverflow {
+		t.Errorf("unexpected last message %v", messages)
+	}
+}
+
+func TestHandler_ForwardCompatible(t *testing.T) {
+	strict := newHandler(t)
+	if _, err := process(t, strict, "FUTURECMD 1"); err != stream.ErrUnknownCmd {
+		t.Errorf("expected %s, got %v", stream.ErrUnknownCmd, err)
+	}
+
+	tolerant, err := stream.NewHandler(nil, &paxos{}, stream.WithForwardCompatible("futurecmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, tolerant, "FUTURECMD 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("unexpected %v", messages)
+	}
+	if cmd, ok := (&client.Response{Message: messages[0]}).Unsupported(); !ok || cmd != "FUTURECMD" {
+		t.Errorf("unexpected %v", messages)
+	}
+	if _, err := process(t, tolerant, `{"cmd":"futurecmd"}`); err != nil {
+		t.Errorf("unexpected error of the JSON command %v", err)
+	}
+	if _, err := process(t, tolerant, "OTHERCMD"); err != stream.ErrUnknownCmd {
+		t.Errorf("expected %s for the command not listed, got %v", stream.ErrUnknownCmd, err)
+	}
+}
+
+func TestHandler_Aliases(t *testing.T) {
+	h := newHandler(t)
+	for _, message := range []string{"PUSH a", "p b"} {
+		if _, err := process(t, h, message); err != nil {
+			t.Fatalf("%q: %s", message, err)
+		}
+	}
+	full, err := process(t, h, "GET 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := process(t, h, "g 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(full, ",") != "a,b" || strings.Join(short, ",") != "a,b" {
+		t.Errorf("unexpected %v and %v", full, short)
+	}
+	if status, err := process(t, h, "s"); err != nil || !contains(status, "len=2") {
+		t.Errorf("unexpected status %v %v", status, err)
+	}
+
+	disabled, err := stream.NewHandler(nil, &paxos{}, stream.WithAliases(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, disabled, "s"); err != stream.ErrUnknownCmd {
+		t.Errorf("expected %s with the disabled aliases, got %v", stream.ErrUnknownCmd, err)
+	}
+	custom, err := stream.NewHandler(nil, &paxos{}, stream.WithAliases(map[string]string{"hi": "ping"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := process(t, custom, "HI"); err != nil || len(messages) != 1 || messages[0] != client.CmdPong {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+}
+
+func TestHandler_Hello(t *testing.T) {
+	messages, err := process(t, newHandler(t), (&client.Hello{}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.ParseHello(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != stream.Version {
+		t.Errorf("unexpected version %q", info.Version)
+	}
+	for _, capability := range []string{client.CapJSON, client.CapGzip, client.CapBatch, client.CapFollow, client.CapAliases} {
+		if !info.Supports(capability) {
+			t.Errorf("%s is not listed in %v", capability, info.Capabilities)
+		}
+	}
+	if info.Supports(client.CapSnapshot) || info.Supports(client.CapStreams) {
+		t.Errorf("disabled features are listed in %v", info.Capabilities)
+	}
+
+	h, err := stream.NewHandler(nil, &paxos{},
+		stream.WithSnapshotPath(filepath.Join(t.TempDir(), "snapshot")),
+		stream.WithLogFactory(func(name string) (stream.Log, error) { return storage.NewLog() }),
+		stream.WithAliases(nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err = process(t, h, (&client.Hello{}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = client.ParseHello(messages); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Supports(client.CapSnapshot) || !info.Supports(client.CapStreams) || info.Supports(client.CapAliases) {
+		t.Errorf("capabilities do not reflect the options: %v", info.Capabilities)
+	}
+}
+
+func TestHandler_Cas(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Push{V: "a b"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, (&client.Cas{N: 0, Expected: "x", New: "c"}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, ok := (&client.Response{Message: messages[0]}).CasFailed(); !ok || actual != "a b" {
+		t.Errorf("unexpected response %v", messages)
+	}
+	messages, err = process(t, h, (&client.Cas{N: 0, Expected: "a b", New: "c\nd"}).String())
+	if err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+	if messages, _ := process(t, h, client.CmdGet+" 0"); len(messages) != 1 || (&client.Response{Message: messages[0]}).Value() != "c\nd" {
+		t.Errorf("unexpected values %v", messages)
+	}
+	if _, err := process(t, h, (&client.Cas{N: 5, Expected: "a", New: "b"}).String()); err != stream.ErrOutOfRange {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+}
+
+func TestHandler_Swap(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages, err := process(t, h, (&client.Swap{I: 0, J: 2}).String()); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if messages, _ := process(t, h, (&client.Get{N: 0}).String()); strings.Join(messages, "") != "cba" {
+		t.Errorf("unexpected values %v", messages)
+	}
+	if _, err := process(t, h, (&client.Swap{I: 0, J: 10}).String()); !errors.Is(err, stream.ErrOutOfRange) {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+	if messages, _ := process(t, h, (&client.Get{N: 0}).String()); strings.Join(messages, "") != "cba" {
+		t.Errorf("unexpected values %v after the failed swap", messages)
+	}
+}
+
+func TestHandler_CasRace(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Push{V: "initial"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	responses := make([]*response, 2)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = &response{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			message := (&client.Cas{N: 0, Expected: "initial", New: strconv.Itoa(i)}).String()
+			if err := h.Process(context.Background(), &request{message: message}, responses[i]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, resp := range responses {
+		if len(resp.messages) == 1 && resp.messages[0] == client.CmdOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("exactly one CAS must succeed, got %v and %v", responses[0].messages, responses[1].messages)
+	}
+}
+
+// syncingLog counts the syncs of the log.
+type syncingLog struct {
+	*storage.Log
+	syncs int
+}
+
+func (l *syncingLog) Sync(ctx context.Context) error {
+	l.syncs++
+	return l.Log.Sync(ctx)
+}
+
+func TestHandler_DurablePush(t *testing.T) {
+	inner, _ := storage.NewLog()
+	lg := &syncingLog{Log: inner}
+	h, err := stream.NewHandler(lg, &paxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Push{V: "a"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Push{V: "b", Key: "k"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if lg.syncs != 0 {
+		t.Errorf("non-durable push must not sync, got %d syncs", lg.syncs)
+	}
+
+	for i, push := range []*client.Push{{V: "c d", Durable: true}, {V: "e", Key: "k2", Durable: true}} {
+		messages, err := process(t, h, push.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := (&client.Response{Message: messages[0]}).Ok(); err != nil || !ok {
+			t.Errorf("unexpected response %v", messages)
+		}
+		if lg.syncs != i+1 {
+			t.Errorf("durable push must sync, got %d syncs", lg.syncs)
+		}
+	}
+	if values, _ := inner.Get(context.Background(), 0); len(values) != 4 || !contains(values, "c d") {
+		t.Errorf("unexpected values %q", values)
+	}
+
+	if messages, err := process(t, h, (&client.Flush{}).String()); err != nil || messages[0] != client.CmdOK || lg.syncs != 3 {
+		t.Errorf("unexpected flush %v %v %d", messages, err, lg.syncs)
+	}
+	if _, err := process(t, h, "PUSH a key garbage"); err != stream.ErrIncorrectCmd {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+// aliveResponse is the response of the connected client.
+type aliveResponse struct {
+	response
+}
+
+func (r *aliveResponse) Probe() error {
+	return nil
+}
+
+func TestHandler_IdleTimeout(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithIdleTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{(&client.Pull{N: 0}).String(), (&client.Pull{N: 0, Gzip: true}).String(), (&client.Watch{N: 0}).String()} {
+		start := time.Now()
+		messages, err := process(t, h, message)
+		if err != stream.ErrIdleTimeout {
+			t.Errorf("%s: expected %s, got %v", message, stream.ErrIdleTimeout, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("%s: the idle subscriber is not closed in time", message)
+		}
+		if len(messages) != 2 || messages[0] != client.CmdKeepalive {
+			t.Errorf("%s: unexpected response %v", message, messages)
+		}
+	}
+
+	// The subscriber of the live client is kept.
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	resp := &aliveResponse{}
+	if err := h.Process(ctx, &request{message: (&client.Pull{N: 0}).String()}, resp); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if len(resp.messages) < 3 || resp.messages[0] != client.CmdKeepalive {
+		t.Errorf("unexpected response %v", resp.messages)
+	}
+}
+
+func TestHandler_Batch(t *testing.T) {
+	h := newHandler(t)
+	batch := &client.Batch{Commands: []string{"PUSH a", "GET x", "PUSH b", "PULL 0", "GET 0"}}
+	messages, err := process(t, h, batch.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.ParseBatch(messages)
+	if err != nil {
+		t.Fatalf("%s: %v", err, messages)
+	}
+	if len(results) != 5 {
+		t.Fatalf("unexpected results %v", results)
+	}
+	codes := []string{"", client.CodeIncorrectCmd, "", client.CodeIncorrectCmd, ""}
+	for i, code := range codes {
+		e, _ := (&client.Response{Message: results[i][0]}).Err().(*client.Error)
+		if (code == "") != (e == nil) || (e != nil && e.Code != code) {
+			t.Errorf("command %d: unexpected %v", i, results[i])
+		}
+	}
+	if strings.Join(results[4], ",") != "a,b" {
+		t.Errorf("unexpected GET response %v", results[4])
+	}
+
+	// ATOMIC skips the commands after the failed one.
+	batch = &client.Batch{Commands: []string{"PUSH c", "GET x", "PUSH d"}, Atomic: true}
+	messages, err = process(t, h, batch.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err = client.ParseBatch(messages); err != nil || len(results) != 3 {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if e, ok := (&client.Response{Message: results[2][0]}).Err().(*client.Error); !ok || e.Code != client.CodeAborted {
+		t.Errorf("unexpected response %v", results[2])
+	}
+	if length, _ := process(t, h, client.CmdLen); length[0] != "3" {
+		t.Errorf("the aborted command is executed: %v", length)
+	}
+
+	if _, err := process(t, h, "BATCH 3 $6\r\nPING\nP"); err != stream.ErrIncorrectCmd {
+		t.Errorf("expected %s for the wrong count, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_AcceptRejected(t *testing.T) {
+	lg, _ := storage.NewLog()
+	px := &paxos{n: 5}
+	h, err := stream.NewHandler(lg, px)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept := (&client.Accept{N: 5, ID: "id", V: "v"}).String()
+	messages, err := process(t, h, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted, err := (&client.Response{Message: messages[0]}).Accepted(); err != nil || !accepted.Accepted {
+		t.Errorf("unexpected response %v", messages)
+	}
+
+	// A higher proposal has been promised since.
+	px.n = 7
+	if messages, err = process(t, h, accept); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := (&client.Response{Message: messages[0]}).Accepted()
+	if err != nil || accepted.Accepted || accepted.N != 7 {
+		t.Errorf("unexpected response %v", messages)
+	}
+}
+
+func TestHandler_PaxosDedup(t *testing.T) {
+	lg, _ := storage.NewLog()
+	px := &paxos{n: 5}
+	h, err := stream.NewHandler(lg, px, stream.WithPaxosDedup(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept := (&client.Accept{N: 5, ID: "id", V: "v"}).String()
+	first, err := process(t, h, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The higher proposal promised since does not change the answer to the retry.
+	px.n = 7
+	retry, err := process(t, h, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(first, ",") != client.CmdAccepted || strings.Join(retry, ",") != client.CmdAccepted {
+		t.Errorf("unexpected %v and %v", first, retry)
+	}
+	if px.accepts != 1 {
+		t.Errorf("expected one Accept call, got %d", px.accepts)
+	}
+
+	// The other messages reach the Paxos and push the oldest one out of the cache.
+	for _, message := range []string{(&client.Accept{N: 6, ID: "id", V: "v"}).String(), (&client.Accept{N: 5, ID: "other", V: "v"}).String()} {
+		if _, err := process(t, h, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if px.accepts != 3 {
+		t.Errorf("expected the Accept call per message, got %d", px.accepts)
+	}
+	if messages, err := process(t, h, accept); err != nil || len(messages) != 1 || messages[0] != client.CmdReject+" 7" {
+		t.Errorf("expected the evicted message to reach the Paxos, got %v %v", messages, err)
+	}
+}
+
+func TestHandler_IDValidation(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{n: 5}, stream.WithIDValidator(stream.UUIDValidator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{
+		`ACCEPT 5 "" v`,
+		`SET 1 "" v`,
+		(&client.Accept{N: 5, ID: "not-a-uuid", V: "v"}).String(),
+		(&client.Set{N: 1, ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c", V: "v"}).String(),
+	} {
+		if _, err := process(t, h, message); !errors.Is(err, stream.ErrIncorrectCmd) {
+			t.Errorf("%q: expected %s, got %v", message, stream.ErrIncorrectCmd, err)
+		}
+	}
+
+	id := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	if _, err := process(t, h, (&client.Accept{N: 5, ID: id, V: "v"}).String()); err != nil {
+		t.Error(err)
+	}
+	if _, err := process(t, h, (&client.Set{N: 1, ID: id, V: "v"}).String()); err != nil {
+		t.Error(err)
+	}
+
+	// The default validator rejects only the empty ids and the ones with spaces.
+	h = newHandler(t)
+	if _, err := process(t, h, `SET 1 "a b" v`); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+	if _, err := process(t, h, (&client.Set{N: 1, ID: "any", V: "v"}).String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandler_Subscribers(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	// The first subscriber reads only one value, the second one follows the new values.
+	first := &streamResponse{messages: make(chan string)}
+	second := &streamResponse{messages: make(chan string)}
+	for _, s := range []struct {
+		pull *client.Pull
+		resp *streamResponse
+	}{{&client.Pull{N: 0}, first}, {&client.Pull{N: 0, Follow: true}, second}} {
+		wg.Add(1)
+		go func(message string, resp *streamResponse) {
+			defer wg.Done()
+			h.Process(ctx, &request{message: message}, resp)
+		}(s.pull.String(), s.resp)
+	}
+	if v := <-first.messages; v != "a" {
+		t.Errorf("unexpected value %q", v)
+	}
+	// Let the subscriptions start.
+	time.Sleep(50 * time.Millisecond)
+
+	messages, err := process(t, h, (&client.Subscribers{}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("unexpected subscribers %v", messages)
+	}
+	behind := map[int]int{}
+	for _, m := range messages {
+		subscriber, err := (&client.Response{Message: m}).Subscriber()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subscriber.Address != "localhost:7000" {
+			t.Errorf("unexpected address %q", subscriber.Address)
+		}
+		if subscriber.From != 0 {
+			t.Errorf("unexpected epoch %d", subscriber.From)
+		}
+		behind[subscriber.Behind]++
+	}
+	// The first subscriber lags behind by two values, the second one has skipped the history.
+	if behind[2] != 1 || behind[0] != 1 {
+		t.Errorf("unexpected subscribers %v", messages)
+	}
+
+	cancel()
+	// Unblock the pushes of the remaining values and the error frames.
+	for _, resp := range []*streamResponse{first, second} {
+		go func(resp *streamResponse) {
+			for range resp.messages {
+			}
+		}(resp)
+	}
+	wg.Wait()
+	if messages, _ := process(t, h, (&client.Subscribers{}).String()); len(messages) != 0 {
+		t.Errorf("finished subscriptions are listed: %v", messages)
+	}
+}
+
+func TestHandler_Checksums(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithChecksums(nil), stream.WithCodec(stream.Base64Codec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages, err := process(t, h, (&client.Get{N: 0}).String()); err != nil || strings.Join(messages, ",") != "a,b" {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+
+	// The stored byte flipped behind the handler is detected.
+	ctx := context.Background()
+	stored, err := lg.Range(ctx, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := []byte(stored[0])
+	corrupted[len(corrupted)-2] ^= 1
+	if err := lg.Set(ctx, 1, string(corrupted)); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, (&client.Get{N: 1}).String())
+	if !errors.Is(err, stream.ErrCorruptEntry) {
+		t.Fatalf("expected %s, got %v %v", stream.ErrCorruptEntry, messages, err)
+	}
+	if code := (&client.Response{Message: messages[len(messages)-1]}).Err().(*client.Error).Code; code != client.CodeCorruptEntry {
+		t.Errorf("unexpected code %s", code)
+	}
+
+	// The checksum is pluggable.
+	lg, _ = storage.NewLog()
+	length := func(v []byte) uint32 { return uint32(len(v)) }
+	if h, err = stream.NewHandler(lg, &paxos{}, stream.WithChecksums(length)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Push{V: "abc"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := lg.Get(ctx, 0); err != nil || len(stored) != 1 || stored[0] != "00000003abc" {
+		t.Errorf("unexpected stored value %q %v", stored, err)
+	}
+}
+
+func TestHandler_Codec(t *testing.T) {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithCodec(stream.Base64Codec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{"a b", "c\nd", ""}
+	for _, v := range values {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The log keeps the encoded values.
+	stored, err := lg.Range(context.Background(), 0, len(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if encoded, _ := (stream.Base64Codec{}).Encode([]byte(v)); stored[i] != string(encoded) {
+			t.Errorf("value %d is stored as %q", i, stored[i])
+		}
+	}
+
+	messages, err := process(t, h, (&client.Range{From: 0, To: len(values)}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(values) {
+		t.Fatalf("unexpected range %q", messages)
+	}
+	for i, v := range values {
+		if got := (&client.Response{Message: messages[i]}).Value(); got != v {
+			t.Errorf("value %d: got %q, want %q", i, got, v)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := &streamResponse{messages: make(chan string)}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(ctx, &request{message: (&client.Pull{N: 0}).String()}, resp)
+	}()
+	if got := (&client.Response{Message: <-resp.messages}).Value(); got != values[0] {
+		t.Errorf("pulled %q, want %q", got, values[0])
+	}
+	cancel()
+	for {
+		select {
+		case <-resp.messages:
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestHandler_Retention(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages, err := process(t, h, (&client.Retention{Count: 1}).String()); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if _, err := process(t, h, (&client.Get{N: 1}).String()); !errors.Is(err, stream.ErrOutOfRange) {
+		t.Errorf("expected %s, got %v", stream.ErrOutOfRange, err)
+	}
+	if messages, err := process(t, h, (&client.Get{N: 2}).String()); err != nil || len(messages) != 1 || messages[0] != "c" {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+	for _, message := range []string{"RETENTION COUNT", "RETENTION SIZE 1", "RETENTION AGE -1"} {
+		if _, err := process(t, h, message); !errors.Is(err, stream.ErrIncorrectCmd) {
+			t.Errorf("%s: expected %s, got %v", message, stream.ErrIncorrectCmd, err)
+		}
+	}
+}
+
+func TestHandler_Inspect(t *testing.T) {
+	lg, _ := storage.NewLog()
+	// The cluster has committed the values up to 2.
+	h, err := stream.NewHandler(lg, &paxos{n: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []client.Set{{N: 1, ID: "first", V: "a b"}, {N: 4, ID: "second", V: "$"}} {
+		if _, err := process(t, h, set.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for message, expected := range map[string]string{
+		(&client.Inspect{N: 1}).String(): "n=1 pn=1 id=first committed=true a b",
+		(&client.Inspect{N: 4}).String(): "n=4 pn=4 id=second committed=false $",
+	} {
+		messages, err := process(t, h, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || client.Unframe(messages[0]) != expected {
+			t.Errorf("%s: expected %q, got %q", message, expected, messages)
+		}
+	}
+
+	for _, n := range []int{0, 2, 5} {
+		if _, err := process(t, h, (&client.Inspect{N: n}).String()); !errors.Is(err, stream.ErrNotFound) {
+			t.Errorf("%d: expected %s, got %v", n, stream.ErrNotFound, err)
+		}
+	}
+	if _, err := process(t, h, client.CmdInspect); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_StepDown(t *testing.T) {
+	lg, _ := storage.NewLog()
+	px := &paxos{leader: "localhost:7000", self: true}
+	h, err := stream.NewHandler(lg, px)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := process(t, h, (&client.Push{V: "a"}).String()); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if messages, err := process(t, h, (&client.StepDown{Target: "localhost:7001"}).String()); err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	messages, err := process(t, h, (&client.Push{V: "b"}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := (&client.Response{Message: messages[0]}).Redirect(); !ok || addr != "localhost:7001" {
+		t.Errorf("expected the redirect to the new leader, got %v", messages)
+	}
+
+	px.err = stream.ErrIncorrectCmd
+	if _, err := process(t, h, (&client.StepDown{Target: "localhost:7002"}).String()); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+	if _, err := process(t, h, client.CmdStepDown); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s without the target, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_Replay(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Push{V: "before"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	for _, v := range []string{"a", "b"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := &streamResponse{messages: make(chan string)}
+	go h.Process(ctx, &request{message: (&client.Replay{At: at}).String()}, resp)
+	for _, expected := range []string{"a", "b"} {
+		if message := <-resp.messages; message != expected {
+			t.Errorf("expected %s, got %s", expected, message)
+		}
+	}
+	// The replay follows the new values.
+	if _, err := process(t, h, (&client.Push{V: "c"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-resp.messages; message != "c" {
+		t.Errorf("expected c, got %s", message)
+	}
+
+	if _, err := process(t, h, client.CmdReplay+" -1"); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_Window(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := &streamResponse{messages: make(chan string)}
+	go h.Process(ctx, &request{message: (&client.Pull{N: 0, Window: 2}).String()}, resp)
+	id, err := (&client.Response{Message: <-resp.messages}).WindowID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "b"} {
+		if message := <-resp.messages; message != expected {
+			t.Errorf("expected %s, got %s", expected, message)
+		}
+	}
+	// The subscription is out of the credit.
+	select {
+	case message := <-resp.messages:
+		t.Fatalf("unexpected %s before the window top-up", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Another client can not add the credit.
+	foreign := &identifiedRequest{request: request{message: (&client.Window{ID: id, K: 1}).String()}, identity: "other"}
+	if err := h.Process(context.Background(), foreign, &response{}); !errors.Is(err, stream.ErrNotFound) {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+	select {
+	case message := <-resp.messages:
+		t.Fatalf("unexpected %s after the foreign top-up", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+	messages, err := process(t, h, (&client.Window{ID: id, K: 1}).String())
+	if err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	if message := <-resp.messages; message != "c" {
+		t.Errorf("expected c, got %s", message)
+	}
+
+	if _, err := process(t, h, (&client.Window{ID: id + 1, K: 1}).String()); !errors.Is(err, stream.ErrNotFound) {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+	if _, err := process(t, h, (&client.Pull{N: 0, Gzip: true, Window: 1}).String()); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_Unsubscribe(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Push{V: "a"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	resp := &streamResponse{messages: make(chan string, 10)}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(context.Background(), &request{message: (&client.Pull{N: 0, ID: true}).String()}, resp)
+	}()
+	id, err := (&client.Response{Message: <-resp.messages}).SubscriptionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message := <-resp.messages; message != "a" {
+		t.Fatalf("unexpected %s", message)
+	}
+
+	// Another client can not end the subscription.
+	foreign := &identifiedRequest{request: request{message: (&client.Unsubscribe{ID: id}).String()}, identity: "other"}
+	if err := h.Process(context.Background(), foreign, &response{}); !errors.Is(err, stream.ErrNotFound) {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+	messages, err := process(t, h, (&client.Unsubscribe{ID: id}).String())
+	if err != nil || len(messages) != 1 || messages[0] != client.CmdOK {
+		t.Fatalf("unexpected %v %v", messages, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the subscription ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the subscription is not ended")
+	}
+	// Nothing is delivered after UNSUB, not even the error.
+	if _, err := process(t, h, (&client.Push{V: "b"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-resp.messages:
+		t.Errorf("unexpected %s after UNSUB", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if status, _ := process(t, h, client.CmdStatus); !contains(status, client.StatusSubscribers+"=0") {
+		t.Errorf("the subscription is not released: %v", status)
+	}
+	if _, err := process(t, h, (&client.Unsubscribe{ID: id}).String()); !errors.Is(err, stream.ErrNotFound) {
+		t.Errorf("expected %s, got %v", stream.ErrNotFound, err)
+	}
+}
+
+func TestHandler_CountIf(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"log:a", "metric:b", "log:c b.json", "d.json", "log:e"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		countif  *client.CountIf
+		expected string
+	}{
+		{&client.CountIf{Pattern: "log:"}, "3"},
+		{&client.CountIf{Filter: client.FilterSuffix, Pattern: ".json"}, "2"},
+		{&client.CountIf{Filter: client.FilterContains, Pattern: "c b"}, "1"},
+		{&client.CountIf{Pattern: "trace:"}, "0"},
+	}
+	for _, c := range cases {
+		messages, err := process(t, h, c.countif.String())
+		if err != nil || len(messages) != 1 || messages[0] != c.expected {
+			t.Errorf("%s: expected %s, got %v %v", c.countif, c.expected, messages, err)
+		}
+	}
+	if _, err := process(t, h, client.CmdCountIf+" REGEX log"); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_SubscribeFilter(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"log:a", "metric:b", "log:c b.json", "d.json"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		subf     *client.SubscribeFilter
+		expected []string
+	}{
+		{&client.SubscribeFilter{Pattern: "log:"}, []string{"log:a", "log:c b.json", "log:e"}},
+		{&client.SubscribeFilter{Filter: client.FilterSuffix, Pattern: ".json"}, []string{"log:c b.json", "d.json", "f.json"}},
+		{&client.SubscribeFilter{N: 1, Filter: client.FilterContains, Pattern: "c b"}, []string{"log:c b.json", "c b.txt"}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	responses := make([]*streamResponse, len(cases))
+	for i, c := range cases {
+		responses[i] = &streamResponse{messages: make(chan string, 10)}
+		go h.Process(ctx, &request{message: c.subf.String()}, responses[i])
+	}
+	// The new values are filtered as well.
+	for _, v := range []string{"log:e", "f.json", "c b.txt"} {
+		if _, err := process(t, h, (&client.Push{V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range cases {
+		for _, expected := range c.expected {
+			if message := <-responses[i].messages; message != expected {
+				t.Errorf("%s: expected %s, got %s", c.subf, expected, message)
+			}
+		}
+	}
+	// The last pushed value is filtered out by the first two subscriptions.
+	for i := range cases[:2] {
+		select {
+		case message := <-responses[i].messages:
+			t.Errorf("%s: unexpected %s", cases[i].subf, message)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if _, err := process(t, h, client.CmdSubscribeFilter+" 0 REGEXP a"); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_MaxSubscribers(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithMaxSubscribers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Push{V: "a"}).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The PULL and the WATCH of the missing value take both slots.
+	pullCtx, cancelPull := context.WithCancel(context.Background())
+	watchCtx, cancelWatch := context.WithCancel(context.Background())
+	defer cancelWatch()
+	pull := &streamResponse{messages: make(chan string, 10)}
+	pulled := make(chan error)
+	go func() {
+		pulled <- h.Process(pullCtx, &request{message: (&client.Pull{N: 0}).String()}, pull)
+	}()
+	go h.Process(watchCtx, &request{message: (&client.Watch{N: 10}).String()}, &streamResponse{messages: make(chan string, 10)})
+	if message := <-pull.messages; message != "a" {
+		t.Fatalf("unexpected %s", message)
+	}
+	// Let the WATCH start.
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := process(t, h, (&client.Watch{N: 0}).String()); !errors.Is(err, stream.ErrTooManySubscribers) {
+		t.Errorf("expected %s, got %v", stream.ErrTooManySubscribers, err)
+	}
+	cancelPull()
+	<-pulled
+	if messages, err := process(t, h, (&client.Watch{N: 0}).String()); err != nil || len(messages) != 1 || messages[0] != "a" {
+		t.Errorf("unexpected %v %v after the slot is freed", messages, err)
+	}
+}
+
+func TestHandler_Config(t *testing.T) {
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{},
+		stream.WithMaxMessageSize(4096),
+		stream.WithRateLimit(stream.CategoryWrite, 10, 20),
+		stream.WithSnapshotPath("/var/lib/stream/secret.snapshot"),
+		stream.WithCodec(stream.Base64Codec{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := process(t, h, (&client.Config{}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		client.ConfigMaxMessageSize + "=4096",
+		client.ConfigRateLimit + "write=10/20",
+		client.ConfigRateLimit + "read=" + client.ConfigOff,
+		client.ConfigCodec + "=true",
+		client.ConfigSnapshotPath + "=" + client.ConfigRedacted,
+	} {
+		if !contains(messages, expected) {
+			t.Errorf("%s is missing in %v", expected, messages)
+		}
+	}
+	for _, message := range messages {
+		if strings.Contains(message, "secret") {
+			t.Errorf("the snapshot path is exposed: %s", message)
+		}
+	}
+}
+
+func TestHandler_ReadReplica(t *testing.T) {
+	lg, _ := storage.NewLog()
+	ctx := context.Background()
+	// The log of the replica is replicated by other means.
+	for i, v := range []string{"a", "b"} {
+		lg.Set(ctx, i, v)
+	}
+	h, err := stream.NewHandler(lg, &paxos{}, stream.WithReadReplica(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{
+		(&client.Prepare{N: 10}).String(),
+		(&client.Accept{N: 10, V: "c", ID: "id"}).String(),
+		(&client.Set{N: 2, ID: "id", V: "c"}).String(),
+		(&client.Push{V: "c"}).String(),
+	} {
+		if _, err := process(t, h, message); !errors.Is(err, stream.ErrReadOnly) {
+			t.Errorf("%s: expected %s, got %v", message, stream.ErrReadOnly, err)
+		}
+	}
+
+	if messages, err := process(t, h, (&client.Get{N: 1}).String()); err != nil || len(messages) != 1 || messages[0] != "b" {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+	if messages, err := process(t, h, (&client.Peek{K: 1}).String()); err != nil || len(messages) != 1 || messages[0] != "b" {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+	pullCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pull := &streamResponse{messages: make(chan string, 10)}
+	go h.Process(pullCtx, &request{message: (&client.Pull{N: 0}).String()}, pull)
+	for _, expected := range []string{"a", "b"} {
+		if message := <-pull.messages; message != expected {
+			t.Errorf("expected %s, got %s", expected, message)
+		}
+	}
+	if status, _ := process(t, h, client.CmdStatus); !contains(status, client.StatusRole+"="+stream.RoleReplica) {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+func TestHandler_UTF8Validation(t *testing.T) {
+	invalid := "a\xff\xfeb"
+	for _, enabled := range []bool{true, false} {
+		lg, _ := storage.NewLog()
+		h, err := stream.NewHandler(lg, &paxos{}, stream.WithUTF8Validation(enabled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := process(t, h, (&client.Push{V: "héllo ✓"}).String()); err != nil {
+			t.Errorf("%t: the valid UTF-8 is rejected: %v", enabled, err)
+		}
+		for _, message := range []string{
+			(&client.Push{V: invalid}).String(),
+			(&client.PushBatch{V: []string{"a", invalid}}).String(),
+			(&client.Set{N: 5, ID: "id", V: invalid}).String(),
+		} {
+			_, err := process(t, h, message)
+			if enabled && !errors.Is(err, stream.ErrInvalidEncoding) {
+				t.Errorf("%q: expected %s, got %v", message, stream.ErrInvalidEncoding, err)
+			}
+			if !enabled && err != nil {
+				t.Errorf("%q: the raw value is rejected: %v", message, err)
+			}
+		}
+		if enabled {
+			continue
+		}
+		// The binary payload is stored as is.
+		if messages, err := process(t, h, (&client.Get{N: 1}).String()); err != nil || len(messages) == 0 || messages[0] != invalid {
+			t.Errorf("unexpected %q %v", messages, err)
+		}
+	}
+}
+
+func TestHandler_Health(t *testing.T) {
+	px := &paxos{}
+	h, err := stream.NewHandler(nil, px)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := func() (bool, string) {
+		t.Helper()
+		messages, err := process(t, h, (&client.Health{}).String())
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("unexpected %v %v", messages, err)
+		}
+		ok, reason, err := (&client.Response{Message: messages[0]}).Healthy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, reason
+	}
+	if ok, reason := health(); !ok || reason != "" {
+		t.Errorf("unexpected %t %q", ok, reason)
+	}
+	px.unreachable = "1 of 2 peers reachable"
+	if ok, reason := health(); ok || reason != px.unreachable {
+		t.Errorf("unexpected %t %q", ok, reason)
+	}
+	px.unreachable = ""
+	if ok, _ := health(); !ok {
+		t.Error("the node with the quorum back is degraded")
+	}
+}
+
+func TestHandler_Export(t *testing.T) {
+	h := newHandler(t)
+	for i, v := range []string{"a,b", `say "hi"`, "line\nbreak"} {
+		if _, err := process(t, h, (&client.Set{N: i, ID: fmt.Sprintf("id%d", i), V: v}).String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export := func(format string) []string {
+		t.Helper()
+		messages, err := process(t, h, (&client.Export{Format: format}).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range messages {
+			messages[i] = (&client.Response{Message: messages[i]}).Value()
+		}
+		return messages
+	}
+
+	ndjson := []string{
+		`{"index":0,"id":"id0","value":"a,b"}`,
+		`{"index":1,"id":"id1","value":"say \"hi\""}`,
+		`{"index":2,"id":"id2","value":"line\nbreak"}`,
+	}
+	for _, format := range []string{"", client.ExportNDJSON} {
+		if messages := export(format); strings.Join(messages, "|") != strings.Join(ndjson, "|") {
+			t.Errorf("%q: unexpected %q", format, messages)
+		}
+	}
+	csv := []string{"index,id,value", `0,id0,"a,b"`, `1,id1,"say ""hi"""`, "2,id2,\"line\nbreak\""}
+	if messages := export("csv"); strings.Join(messages, "|") != strings.Join(csv, "|") {
+		t.Errorf("unexpected %q", messages)
+	}
+
+	if _, err := process(t, h, client.CmdExport+" XML"); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+func TestHandler_PushBlock(t *testing.T) {
+	h := newHandler(t)
+	if _, err := process(t, h, (&client.Retention{Count: 2}).String()); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []string{"a", "b"} {
+		messages, err := process(t, h, (&client.Push{V: v, Block: true}).String())
+		if err != nil || len(messages) != 1 || messages[0] != fmt.Sprintf("%s %d", client.CmdOK, i) {
+			t.Fatalf("unexpected %v %v", messages, err)
+		}
+	}
+
+	done := make(chan []string)
+	go func() {
+		messages, err := process(t, h, (&client.Push{V: "c", Block: true}).String())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- messages
+	}()
+	select {
+	case messages := <-done:
+		t.Fatalf("the blocking push has not waited: %v", messages)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := process(t, h, (&client.Delete{N: 0}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if messages := <-done; len(messages) != 1 || messages[0] != client.CmdOK+" 2" {
+		t.Errorf("unexpected %v", messages)
+	}
+
+	// Without BLOCK the oldest value is dropped.
+	if _, err := process(t, h, (&client.Push{V: "d"}).String()); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := process(t, h, (&client.Len{}).String()); err != nil || len(messages) != 1 || messages[0] != "2" {
+		t.Errorf("unexpected %v %v", messages, err)
+	}
+
+	if _, err := process(t, h, `PUSH a key BLOCK`); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s for the keyed push, got %v", stream.ErrIncorrectCmd, err)
+	}
+	lg, _ := storage.NewLog()
+	h, err := stream.NewHandler(lg, &paxos{peers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(t, h, (&client.Push{V: "a", Block: true}).String()); !errors.Is(err, stream.ErrIncorrectCmd) {
+		t.Errorf("expected %s on the node with peers, got %v", stream.ErrIncorrectCmd, err)
+	}
+}
+
+// flushingResponse records the pushed lines, flushes and the end of the response in order.
+type flushingResponse struct {
+	events chan string
+}
+
+func (r *flushingResponse) Push(message string) {
+	r.events <- message
+}
+
+func (r *flushingResponse) Flush() error {
+	r.events <- "flush"
+	return nil
+}
+
+func (r *flushingResponse) Close() error {
+	r.events <- "close"
+	close(r.events)
+	return nil
+}
+
+func TestHandler_PullFlush(t *testing.T) {
+	h := newHandler(t)
+	for _, v := range []string{"a", "b"} {
+		if _, err := process(t, h, client.CmdPush+" "+v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := &flushingResponse{events: make(chan string)}
+	go h.Process(ctx, &request{message: (&client.Pull{N: 0}).String()}, resp)
+
+	var events []string
+	for len(events) < 4 {
+		events = append(events, <-resp.events)
+	}
+	if strings.Join(events, " ") != "a flush b flush" {
+		t.Errorf("unexpected events %v", events)
+	}
+	cancel()
+	var last string
+	for event := range resp.events {
+		last = event
+	}
+	if last != "close" {
+		t.Errorf("the response is not closed after the last line, got %q", last)
+	}
+}
+
+// lockedPaxos is the paxos safe for the concurrent requests.
+type lockedPaxos struct {
+	m sync.Mutex
+	paxos
+}
+
+func (p *lockedPaxos) Commit(ctx context.Context, v, id string) ([]stream.AcceptMessage, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.paxos.Commit(ctx, v, id)
+}
+
+func (p *lockedPaxos) ReadIndex(ctx context.Context) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.paxos.ReadIndex(ctx)
+}
+
+func (p *lockedPaxos) CommittedIndex() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.paxos.CommittedIndex()
+}
+
+func (p *lockedPaxos) State() stream.PaxosState {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.paxos.State()
+}
+
+func TestHandler_Concurrent(t *testing.T) {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(lg, &lockedPaxos{}, stream.WithRateLimit(stream.CategoryRead, 1e6, 1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, pushes = 8, 50
+	total := workers * pushes
+	ctx := context.Background()
+
+	// Every subscriber gets all values and stops.
+	var pullers sync.WaitGroup
+	pulled := make(chan int, workers)
+	for i := 0; i < workers; i++ {
+		pullers.Add(1)
+		go func() {
+			defer pullers.Done()
+			pullCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			resp := &countingResponse{expected: total, cancel: cancel}
+			h.Process(pullCtx, &request{message: (&client.Pull{N: 0}).String()}, resp)
+			pulled <- len(resp.values)
+		}()
+	}
+	var writers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			for j := 0; j < pushes; j++ {
+				for _, message := range []string{
+					(&client.Push{V: fmt.Sprintf("%d-%d", i, j)}).String(),
+					(&client.Get{N: j}).String(),
+					client.CmdStatus,
+					client.CmdLen,
+				} {
+					if err := h.Process(ctx, &request{message: message, name: strconv.Itoa(i)}, &response{}); err != nil {
+						t.Errorf("%s: %s", message, err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	writers.Wait()
+
+	messages, err := process(t, h, client.CmdLen)
+	if err != nil || len(messages) != 1 || messages[0] != strconv.Itoa(total) {
+		t.Errorf("unexpected length %v %v", messages, err)
+	}
+	pullers.Wait()
+	close(pulled)
+	for count := range pulled {
+		if count != total {
+			t.Errorf("pulled %d values of %d", count, total)
+		}
+	}
+}
+
+// followCountingLog counts the log subscriptions of FOLLOW made and the active ones.
+type followCountingLog struct {
+	stream.Log
+	follows int32
+	active  int32
+}
+
+func (l *followCountingLog) Follow(ctx context.Context, n, buffer int) (chan string, error) {
+	atomic.AddInt32(&l.follows, 1)
+	atomic.AddInt32(&l.active, 1)
+	go func() {
+		<-ctx.Done()
+		atomic.AddInt32(&l.active, -1)
+	}()
+	return l.Log.Follow(ctx, n, buffer)
+}
+
+// follow starts the FOLLOW subscribers and waits until they are subscribed.
+func follow(ctx context.Context, t testing.TB, h *stream.Handler, subscribers int) []*streamResponse {
+	responses := make([]*streamResponse, subscribers)
+	for i := range responses {
+		responses[i] = &streamResponse{messages: make(chan string, 1)}
+		go h.Process(ctx, &request{message: (&client.Pull{N: 0, Follow: true}).String()}, responses[i])
+	}
+	for {
+		resp := &response{}
+		if err := h.Process(context.Background(), &request{message: client.CmdStatus}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if contains(resp.messages, fmt.Sprintf("%s=%d", client.StatusSubscribers, subscribers)) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Let the registered subscriptions start.
+	time.Sleep(20 * time.Millisecond)
+	return responses
+}
+
+func newFollowHandler(t testing.TB) (*stream.Handler, *followCountingLog) {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &followCountingLog{Log: lg}
+	h, err := stream.NewHandler(counting, &lockedPaxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, counting
+}
+
+func TestHandler_FollowFanout(t *testing.T) {
+	h, lg := newFollowHandler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	responses := follow(ctx, t, h, 10)
+	if _, err := process(t, h, client.CmdPush+" a"); err != nil {
+		t.Fatal(err)
+	}
+	for i, resp := range responses {
+		if message := <-resp.messages; message != "a" {
+			t.Errorf("subscriber %d: expected a, got %s", i, message)
+		}
+	}
+	if follows := atomic.LoadInt32(&lg.follows); follows != 1 {
+		t.Errorf("the subscribers have made %d log subscriptions", follows)
+	}
+	cancel()
+	for atomic.LoadInt32(&lg.active) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The last subscriber has stopped the shared subscription, the next one starts the new one.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	resp := follow(ctx, t, h, 1)[0]
+	if _, err := process(t, h, client.CmdPush+" b"); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-resp.messages; message != "b" {
+		t.Errorf("expected b, got %s", message)
+	}
+	if follows := atomic.LoadInt32(&lg.follows); follows != 2 {
+		t.Errorf("expected the new log subscription, got %d", follows)
+	}
+}
+
+// unhashableLog is the Log value which can not be the map key.
+type unhashableLog struct {
+	stream.Log
+	tags []string
+}
+
+func TestHandler_FollowUnhashableLog(t *testing.T) {
+	lg, err := storage.NewLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := stream.NewHandler(unhashableLog{Log: lg}, &lockedPaxos{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := &streamResponse{messages: make(chan string, 10)}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(ctx, &request{message: (&client.Pull{N: 0, Follow: true}).String()}, resp)
+	}()
+	for i := 0; ; i++ {
+		if _, err := process(t, h, (&client.Push{V: "a"}).String()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case message := <-resp.messages:
+			if message != "a" {
+				t.Errorf("expected a, got %s", message)
+			}
+			return
+		case err := <-done:
+			t.Fatalf("FOLLOW has failed with %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if i == 100 {
+			t.Fatal("no value is followed")
+		}
+	}
+}
+
+// benchmarkFollow pushes the values to the FOLLOW subscribers and reports the log subscriptions made.
+func benchmarkFollow(b *testing.B, subscribers int) {
+	h, lg := newFollowHandler(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	responses := follow(ctx, b, h, subscribers)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.Process(ctx, &request{message: client.CmdPush + " v"}, &response{}); err != nil {
+			b.Fatal(err)
+		}
+		for _, resp := range responses {
+			<-resp.messages
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(&lg.follows)), "follows")
+}
+
+func BenchmarkHandler_Follow(b *testing.B) {
+	b.Run("1", func(b *testing.B) { benchmarkFollow(b, 1) })
+	b.Run("10", func(b *testing.B) { benchmarkFollow(b, 10) })
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// subscription is the live PULL.
+type subscription struct {
+	id      uint64
+	address string
+	// owner is the client allowed to control the subscription, see ownerOf.
+	owner string
+	// from is the index requested by PULL.
+	from int
+	// skipped is the number of the values FOLLOW has skipped, it is estimated on the registration.
+	skipped int
+	log     Log
+	sent    int64
+	// window is the credit of the PULL with WINDOW, nil for the other subscriptions.
+	window *credit
+	// cancel ends the subscription, unsubscribed is set by UNSUB.
+	cancel       context.CancelFunc
+	unsubscribed int32
+}
+
+// pushed counts the values pushed to the subscriber.
+func (s *subscription) pushed(count int) {
+	atomic.AddInt64(&s.sent, int64(count))
+}
+
+// behind estimates the number of the values the subscriber has not received yet assuming
+// there are no gaps between the indexes.
+func (s *subscription) behind(ctx context.Context) int {
+	last, _, err := s.log.Last(ctx)
+	if err != nil {
+		return 0
+	}
+	behind := last - s.from + 1 - s.skipped - int(atomic.LoadInt64(&s.sent))
+	if behind < 0 {
+		return 0
+	}
+	return behind
+}
+
+// subscriptions is the registry of the live PULL requests.
+type subscriptions struct {
+	m      sync.Mutex
+	nextID uint64
+	active map[uint64]*subscription
+}
+
+func (s *subscriptions) add(sub *subscription) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.nextID++
+	sub.id = s.nextID
+	s.active[sub.id] = sub
+}
+
+func (s *subscriptions) remove(sub *subscription) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.active, sub.id)
+}
+
+func (s *subscriptions) find(id uint64) (*subscription, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sub, ok := s.active[id]
+	return sub, ok
+}
+
+// findOwned returns the subscription of the client sending the request, the subscription of another
+// client is not found as well as the unknown one.
+func (s *subscriptions) findOwned(id uint64, request Request) (*subscription, bool) {
+	sub, ok := s.find(id)
+	if !ok || sub.owner != ownerOf(request) {
+		return nil, false
+	}
+	return sub, true
+}
+
+// ownerOf returns the verified identity of the client or its host if the transport identifies no one.
+// The port is dropped, the client controls the subscription with another connection.
+func ownerOf(request Request) string {
+	if identity := IdentityOf(request.source); identity != "" {
+		return identity
+	}
+	return clientHost(request.address)
+}
+
+func (s *subscriptions) count() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.active)
+}
+
+// list returns the live subscriptions in the order they have started.
+func (s *subscriptions) list() []*subscription {
+	s.m.Lock()
+	list := make([]*subscription, 0, len(s.active))
+	for _, sub := range s.active {
+		list = append(list, sub)
+	}
+	s.m.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// acquireSubscriber takes the slot of the subscription, release returns it once the subscription ends.
+func (h *Handler) acquireSubscriber() (release func(), err error) {
+	if count := atomic.AddInt64(&h.subscribers, 1); h.maxSubscribers > 0 && count > h.maxSubscribers {
+		atomic.AddInt64(&h.subscribers, -1)
+		return nil, ErrTooManySubscribers
+	}
+	return func() {
+		atomic.AddInt64(&h.subscribers, -1)
+	}, nil
+}
+
+// register adds the PULL to the registry. FOLLOW skips the values set before the subscription,
+// their number is read separately from the subscription, so the lag of FOLLOW is approximate.
+func (h *Handler) register(request PullRequest, cancel context.CancelFunc) *subscription {
+	sub := &subscription{
+		address: request.address,
+		owner:   ownerOf(request.Request),
+		from:    request.n,
+		log:     request.log,
+		cancel:  cancel,
+	}
+	if request.window > 0 {
+		sub.window = newCredit(request.window)
+	}
+	if last, _, err := request.log.Last(request.ctx); request.follow && err == nil && last >= sub.from {
+		sub.skipped = last - sub.from + 1
+	}
+	h.subscriptions.add(sub)
+	return sub
+}
+
+// Subscribers pushes "<address> <from> <behind>" line for every live PULL: the client address,
+// the index requested by PULL and the estimated number of the values the subscriber lags behind.
+// The addresses are exposed, so deployments should allow the command to the operators only.
+func (h *Handler) Subscribers(request Request, response ServerResponse) error {
+	if err := request.validate(client.CmdSubscribers, 0, 0); err != nil {
+		return err
+	}
+	for _, sub := range h.subscriptions.list() {
+		response.Push(fmt.Sprintf("%s %d %d", sub.address, sub.from, sub.behind(request.ctx)))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"context"
+	"strings"
+)
+
+// TracePrefix starts the optional trace ID of the message: "trace:<id> PUSH a".
+const TracePrefix = "trace:"
+
+type traceIDKey struct{}
+
+// WithTraceID returns the context carrying the trace ID.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceIDFromContext returns the trace ID of the request or empty string if the request is not traced.
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// extractTraceID splits the message into the trace ID and the rest of the message.
+func extractTraceID(message string) (string, string, bool) {
+	if !strings.HasPrefix(message, TracePrefix) {
+		return "", message, false
+	}
+	i := strings.IndexAny(message, " \t")
+	if i == -1 {
+		return "", message, false
+	}
+	id := message[len(TracePrefix):i]
+	if id == "" {
+		return "", message, false
+	}
+	return id, strings.TrimLeft(message[i:], " \t"), true
+}
+
+// tracedRequest is the request with the trace ID stripped from the message.
+type tracedRequest struct {
+	ServerRequest
+	message string
+}
+
+func (r *tracedRequest) Message() string {
+	return r.message
+}
+
+func (r *tracedRequest) Identity() string {
+	return IdentityOf(r.ServerRequest)
+}
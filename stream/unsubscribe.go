@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/tariel-x/stream/client"
+)
+
+type UnsubscribeRequest struct {
+	Request
+	id uint64
+}
+
+// NewUnsubscribeRequest parses UNSUB <subscription id>.
+func NewUnsubscribeRequest(request Request) (*UnsubscribeRequest, error) {
+	if err := request.validate(client.CmdUnsubscribe, 1, 1); err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseUint(request.args[0], 10, 64)
+	if err != nil {
+		return nil, ErrIncorrectCmd
+	}
+	return &UnsubscribeRequest{Request: request, id: id}, nil
+}
+
+// Unsubscribe ends the PULL subscription, the subscription ends without the error and frees its
+// slot. The connection of PULL is busy with the values, so the subscriber sends UNSUB with another
+// one. The unknown subscription and the one of another client fail with ErrNotFound.
+func (h *Handler) Unsubscribe(request *UnsubscribeRequest, response ServerResponse) error {
+	sub, ok := h.subscriptions.findOwned(request.id, request.Request)
+	if !ok {
+		return ErrNotFound
+	}
+	atomic.StoreInt32(&sub.unsubscribed, 1)
+	sub.cancel()
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// ended returns nil instead of the error the subscription ended with after UNSUB.
+func (s *subscription) ended(err error) error {
+	if atomic.LoadInt32(&s.unsubscribed) == 1 {
+		return nil
+	}
+	return err
+}
+
+// subscriptionID pushes the ID of the subscription requested with the ID keyword.
+func subscriptionID(request PullRequest, sub *subscription, response ServerResponse) error {
+	if !request.announce {
+		return nil
+	}
+	response.Push(fmt.Sprintf("%s %d", client.CmdSubscription, sub.id))
+	return flush(response)
+}
@@ -0,0 +1,33 @@
+package stream
+
+import (
+	"strings"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// unsupported returns the forward-compatible command of the message set with WithForwardCompatible,
+// the node answers it with "UNSUPPORTED <cmd>" instead of failing with ErrUnknownCmd.
+func (h *Handler) unsupported(message string) (string, bool) {
+	if len(h.compatible) == 0 {
+		return "", false
+	}
+	tokenize := tokenizeText
+	if isJSON(message) {
+		tokenize = tokenizeJSON
+	}
+	tokens, _, err := tokenize(message)
+	if err != nil || len(tokens) == 0 {
+		return "", false
+	}
+	cmd := strings.ToUpper(tokens[0])
+	if _, ok := h.compatible[cmd]; !ok {
+		return "", false
+	}
+	return cmd, true
+}
+
+// pushUnsupported answers the forward-compatible command unknown to the node.
+func pushUnsupported(response ServerResponse, cmd string) {
+	response.Push(client.CmdUnsupported + " " + cmd)
+}
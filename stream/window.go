@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/tariel-x/stream/client"
+)
+
+// credit is the number of the values the PULL with the window may push before it pauses. The nil
+// credit never pauses the subscription.
+type credit struct {
+	m    sync.Mutex
+	left int
+	// topped is signalled when the credit is added.
+	topped chan struct{}
+}
+
+func newCredit(k int) *credit {
+	return &credit{left: k, topped: make(chan struct{}, 1)}
+}
+
+// ready reports whether the subscription may push the next value.
+func (c *credit) ready() bool {
+	if c == nil {
+		return true
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.left > 0
+}
+
+// spend takes the pushed value from the credit.
+func (c *credit) spend() {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.left--
+}
+
+// add tops the credit up and wakes the paused subscription.
+func (c *credit) add(k int) {
+	c.m.Lock()
+	c.left += k
+	c.m.Unlock()
+	select {
+	case c.topped <- struct{}{}:
+	default:
+	}
+}
+
+// paused returns the channel signalled when the credit of the paused subscription is added, nil
+// if the subscription may push.
+func (c *credit) paused() <-chan struct{} {
+	if c.ready() {
+		return nil
+	}
+	return c.topped
+}
+
+type WindowRequest struct {
+	Request
+	id uint64
+	k  int
+}
+
+// NewWindowRequest parses WINDOW <subscription id> <k>.
+func NewWindowRequest(request Request) (*WindowRequest, error) {
+	if err := request.validate(client.CmdWindow, 2, 2); err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseUint(request.args[0], 10, 64)
+	if err != nil {
+		return nil, ErrIncorrectCmd
+	}
+	k, err := request.intArg(1)
+	if err != nil {
+		return nil, err
+	}
+	if k <= 0 {
+		return nil, ErrIncorrectCmd
+	}
+	return &WindowRequest{Request: request, id: id, k: k}, nil
+}
+
+// Window lets the subscriber top up the credit of its PULL started with WINDOW k. The connection of
+// PULL is busy with the values, so the subscriber names the subscription with the ID pushed first and
+// sends WINDOW with another connection. The unknown subscription, the one without the window and the
+// one of another client fail with ErrNotFound.
+func (h *Handler) Window(request *WindowRequest, response ServerResponse) error {
+	sub, ok := h.subscriptions.findOwned(request.id, request.Request)
+	if !ok || sub.window == nil {
+		return ErrNotFound
+	}
+	sub.window.add(request.k)
+	response.Push(client.CmdOK)
+	return nil
+}
+
+// windowID pushes the ID of the subscription with the window, the subscriber needs it for WINDOW.
+func windowID(sub *subscription, response ServerResponse) error {
+	if sub.window == nil {
+		return nil
+	}
+	response.Push(fmt.Sprintf("%s %d", client.CmdWindow, sub.id))
+	return flush(response)
+}